@@ -0,0 +1,151 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Accounts of OBUs. A prepaid account is topped up in advance and tolls are
+// taken from its credit, a postpaid account accumulates debt until an
+// invoice settles it. An OBU without an account is postpaid.
+const (
+	AccountPrepaid  = "prepaid"
+	AccountPostpaid = "postpaid"
+)
+
+// TollOperatorMSP is the only organization allowed to register, change,
+// delete and charge OBUs and to manage their accounts.
+const TollOperatorMSP = "Org1MSP"
+
+// requireOrg fails unless the client belongs to the organization msp.
+func requireOrg(ctx contractapi.TransactionContextInterface, msp, action string) error {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get client identity: %v", err)
+	}
+	if mspID != msp {
+		return fmt.Errorf("the organization %s is not allowed to %s", mspID, action)
+	}
+	return nil
+}
+
+func validAccount(account string) bool {
+	return account == AccountPrepaid || account == AccountPostpaid
+}
+
+// validAmount reports whether amount is a finite sum of money, not negative.
+func validAmount(amount float64) bool {
+	return amount >= 0 && !math.IsInf(amount, 1)
+}
+
+func isPrepaid(obu *OnBoardUnit) bool {
+	return obu.Account == AccountPrepaid
+}
+
+// chargeObu takes the toll sum from the credit of a prepaid account or adds
+// it to the debt of a postpaid one.
+func chargeObu(obu *OnBoardUnit, sum float64) error {
+	if !validAmount(sum) {
+		return fmt.Errorf("invalid toll %.2f", sum)
+	}
+	if !isPrepaid(obu) {
+		obu.Credit += sum
+		return nil
+	}
+	if obu.Credit < sum {
+		return fmt.Errorf("insufficient credit %.2f %s of the obu %s for the toll %.2f",
+			obu.Credit, obu.Currency, obu.ID, sum)
+	}
+	obu.Credit -= sum
+	return nil
+}
+
+// TopUpCredit adds amount to the credit of a prepaid account.
+func (s *SmartContract) TopUpCredit(ctx contractapi.TransactionContextInterface, id, spz, country string, amount float64) (*OnBoardUnit, error) {
+	if err := requireOrg(ctx, TollOperatorMSP, "top up credit"); err != nil {
+		return nil, err
+	}
+	if amount == 0 || !validAmount(amount) {
+		return nil, fmt.Errorf("invalid amount %.2f", amount)
+	}
+	return s.updateAccount(ctx, id, spz, country, func(obu *OnBoardUnit) error {
+		if !isPrepaid(obu) {
+			return fmt.Errorf("the obu %s does not have a prepaid account", id)
+		}
+		obu.Credit += amount
+		return nil
+	})
+}
+
+// SettleInvoice pays amount of the debt of a postpaid account.
+func (s *SmartContract) SettleInvoice(ctx contractapi.TransactionContextInterface, id, spz, country string, amount float64) (*OnBoardUnit, error) {
+	if err := requireOrg(ctx, TollOperatorMSP, "settle invoices"); err != nil {
+		return nil, err
+	}
+	if amount == 0 || !validAmount(amount) {
+		return nil, fmt.Errorf("invalid amount %.2f", amount)
+	}
+	return s.updateAccount(ctx, id, spz, country, func(obu *OnBoardUnit) error {
+		if isPrepaid(obu) {
+			return fmt.Errorf("the obu %s does not have a postpaid account", id)
+		}
+		if amount > obu.Credit {
+			return fmt.Errorf("amount %.2f exceeds the debt %.2f of the obu %s", amount, obu.Credit, id)
+		}
+		obu.Credit -= amount
+		return nil
+	})
+}
+
+// SetAccount switches the OBU to a prepaid or postpaid account. The credit
+// means a different thing for each of them, so it has to be zero.
+func (s *SmartContract) SetAccount(ctx contractapi.TransactionContextInterface, id, spz, country, account string) (*OnBoardUnit, error) {
+	if err := requireOrg(ctx, TollOperatorMSP, "switch accounts"); err != nil {
+		return nil, err
+	}
+	if !validAccount(account) {
+		return nil, fmt.Errorf("unknown account %s", account)
+	}
+	return s.updateAccount(ctx, id, spz, country, func(obu *OnBoardUnit) error {
+		if obu.Credit != 0 {
+			return fmt.Errorf("the obu %s has to have zero credit to change its account", id)
+		}
+		obu.Account = account
+		return nil
+	})
+}
+
+func (s *SmartContract) updateAccount(ctx contractapi.TransactionContextInterface, id, spz, country string, update func(*OnBoardUnit) error) (*OnBoardUnit, error) {
+	idObu, err := ctx.GetStub().CreateCompositeKey(obuIndex, []string{id, spz, country})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	obuJSON, err := ctx.GetStub().GetState(idObu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if obuJSON == nil {
+		return nil, fmt.Errorf("the obu %s does not exist", idObu)
+	}
+	var obu OnBoardUnit
+	err = json.Unmarshal(obuJSON, &obu)
+	if err != nil {
+		return nil, err
+	}
+	err = update(&obu)
+	if err != nil {
+		return nil, err
+	}
+	obuJSON, err = json.Marshal(obu)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.GetStub().PutState(idObu, obuJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &obu, nil
+}
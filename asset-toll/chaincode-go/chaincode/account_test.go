@@ -0,0 +1,116 @@
+package chaincode
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestAccounts(t *testing.T) {
+	s, ctx := initLedger(t)
+	id, spz, country := obu2[0], obu2[1], obu2[2]
+
+	// prepaid
+	if _, err := charge(s, ctx.next(), id, spz, country, 50, ""); err == nil {
+		t.Errorf("expected an error of insufficient credit 40 for 50")
+	}
+	if obu, err := charge(s, ctx.next(), id, spz, country, 30, ""); err != nil || obu.Credit != 10 {
+		t.Errorf("expected credit 10 left, but got %v, %v", obu, err)
+	}
+	if obu, err := s.TopUpCredit(ctx.next(), id, spz, country, 100); err != nil || obu.Credit != 110 {
+		t.Errorf("expected credit 110 after the top up, but got %v, %v", obu, err)
+	}
+	if _, err := s.SettleInvoice(ctx.next(), id, spz, country, 100); err == nil {
+		t.Errorf("expected an error settling an invoice of a prepaid account")
+	}
+	if _, err := s.SetAccount(ctx.next(), id, spz, country, AccountPostpaid); err == nil {
+		t.Errorf("expected an error switching an account with credit")
+	}
+
+	// postpaid
+	id, spz, country = obu1[0], obu1[1], obu1[2]
+	if obu, err := charge(s, ctx.next(), id, spz, country, 50, ""); err != nil || obu.Credit != 50 {
+		t.Errorf("expected debt 50, but got %v, %v", obu, err)
+	}
+	if _, err := s.TopUpCredit(ctx.next(), id, spz, country, 100); err == nil {
+		t.Errorf("expected an error topping up a postpaid account")
+	}
+	if _, err := s.SettleInvoice(ctx.next(), id, spz, country, 60); err == nil {
+		t.Errorf("expected an error settling more than the debt")
+	}
+	if obu, err := s.SettleInvoice(ctx.next(), id, spz, country, 50); err != nil || obu.Credit != 0 {
+		t.Errorf("expected the debt settled, but got %v, %v", obu, err)
+	}
+	if obu, err := s.SetAccount(ctx.next(), id, spz, country, AccountPrepaid); err != nil || obu.Account != AccountPrepaid {
+		t.Errorf("expected a prepaid account, but got %v, %v", obu, err)
+	}
+	if _, err := s.SetAccount(ctx.next(), id, spz, country, "credit card"); err == nil {
+		t.Errorf("expected an error of an unknown account")
+	}
+	for _, sum := range []float64{-1, math.NaN(), math.Inf(1)} {
+		if _, err := charge(s, ctx.next(), id, spz, country, sum, ""); err == nil {
+			t.Errorf("expected an error of the toll %v", sum)
+		}
+		if _, err := s.TopUpCredit(ctx.next(), id, spz, country, sum); err == nil {
+			t.Errorf("expected an error of the top up %v", sum)
+		}
+	}
+	if obu, err := s.ReadObu(ctx, id, spz, country); err != nil || obu.Credit != 0 {
+		t.Errorf("expected credit 0, but got %v, %v", obu, err)
+	}
+}
+
+func TestOperatorOnly(t *testing.T) {
+	s, ctx := initLedger(t)
+	ctx.as("Org2MSP")
+	id, spz, country := obu2[0], obu2[1], obu2[2]
+
+	calls := map[string]func() error{
+		"TopUpCredit": func() error {
+			_, err := s.TopUpCredit(ctx.next(), id, spz, country, 100)
+			return err
+		},
+		"SettleInvoice": func() error {
+			_, err := s.SettleInvoice(ctx.next(), obu1[0], obu1[1], obu1[2], 1)
+			return err
+		},
+		"SetAccount": func() error {
+			_, err := s.SetAccount(ctx.next(), id, spz, country, AccountPostpaid)
+			return err
+		},
+		"CreateObu": func() error {
+			return s.CreateObu(ctx.next(), "new", spz, country, "CZK", "6", "N", 3500, 2, AccountPrepaid)
+		},
+		"UpdateObu": func() error {
+			return s.UpdateObu(ctx.next(), id, spz, country, "6", 3500, 2)
+		},
+		"DeleteObu": func() error {
+			return s.DeleteObu(ctx.next(), obu1[0], obu1[1], obu1[2])
+		},
+		"ChargeTrip": func() error {
+			_, err := s.ChargeTrip(ctx.next(), id, spz, country, `{"Segments": []}`)
+			return err
+		},
+		"SetNullCredit": func() error {
+			return s.SetNullCredit(ctx.next(), id, spz, country)
+		},
+	}
+	for name, call := range calls {
+		if err := call(); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("%s by Org2MSP: expected an error of a caller not allowed, but got %v", name, err)
+		}
+	}
+	obu, err := s.ReadObu(ctx, id, spz, country)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obu.Credit != 40 || obu.Account != AccountPrepaid || obu.Weight != 12500 || obu.Axles != 5 {
+		t.Errorf("expected the OBU unchanged, but got %+v", obu)
+	}
+	if exists, err := s.ObuExists(ctx, obu1[0], obu1[1], obu1[2]); err != nil || !exists {
+		t.Errorf("expected the postpaid OBU kept, but got %v, %v", exists, err)
+	}
+	if exists, err := s.ObuExists(ctx, "new", spz, country); err != nil || exists {
+		t.Errorf("expected no new OBU, but got %v, %v", exists, err)
+	}
+}
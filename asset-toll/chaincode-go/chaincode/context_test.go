@@ -0,0 +1,102 @@
+package chaincode
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+)
+
+// mockContext is the transaction context of the contract on an in-memory
+// world state, called by a client of the organization msp.
+type mockContext struct {
+	stub *shimtest.MockStub
+	msp  string
+	txs  int
+}
+
+func newContext(t *testing.T, msp string) *mockContext {
+	t.Helper()
+	c := &mockContext{stub: shimtest.NewMockStub("toll", nil), msp: msp}
+	c.next()
+	return c
+}
+
+// next begins a new transaction.
+func (c *mockContext) next() *mockContext {
+	c.txs++
+	c.stub.MockTransactionStart(fmt.Sprintf("tx%d", c.txs))
+	return c
+}
+
+// as switches the caller to a client of the organization msp.
+func (c *mockContext) as(msp string) *mockContext {
+	c.msp = msp
+	return c
+}
+
+func (c *mockContext) GetStub() shim.ChaincodeStubInterface {
+	return c.stub
+}
+
+func (c *mockContext) GetClientIdentity() cid.ClientIdentity {
+	return mockIdentity{c.msp}
+}
+
+type mockIdentity struct {
+	msp string
+}
+
+func (m mockIdentity) GetID() (string, error) {
+	return "x509::CN=User1@" + m.msp, nil
+}
+
+func (m mockIdentity) GetMSPID() (string, error) {
+	return m.msp, nil
+}
+
+func (m mockIdentity) GetAttributeValue(string) (string, bool, error) {
+	return "", false, nil
+}
+
+func (m mockIdentity) AssertAttributeValue(name, value string) error {
+	return fmt.Errorf("attribute %s is not %s", name, value)
+}
+
+func (m mockIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
+
+var (
+	obu1 = []string{"2c9fa1aa-4403-4cc9-96f4-09a05638bcad", "1SA1234", "CZ"} // postpaid
+	obu2 = []string{"7873527e-4d58-4e94-a71c-8ad908f59e00", "1S15244", "CZ"} // prepaid, 40 CZK
+)
+
+// initLedger returns the context of a ledger with the OBUs of InitLedger.
+func initLedger(t *testing.T) (*SmartContract, *mockContext) {
+	t.Helper()
+	s := &SmartContract{}
+	ctx := newContext(t, "Org1MSP")
+	if err := s.InitLedger(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return s, ctx.next()
+}
+
+// charge charges the OBU by sum and records the trip as ChargeTrip does, only
+// the sum is not priced by the tariff.
+func charge(s *SmartContract, ctx *mockContext, id, spz, country string, sum float64, trip string) (*OnBoardUnit, error) {
+	obu, err := s.updateAccount(ctx, id, spz, country, func(obu *OnBoardUnit) error {
+		return chargeObu(obu, sum)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.putTollTransaction(ctx, obu, sum, trip); err != nil {
+		return nil, err
+	}
+	return obu, nil
+}
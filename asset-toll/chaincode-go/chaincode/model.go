@@ -0,0 +1,288 @@
+package chaincode
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// The geographic model of the toll roads is published by the tariff
+// authority. A trip names the model by its checksum and the points of its
+// road sections the OBU drove, the distances and the road classes charged
+// are taken from the model on the ledger.
+const modelIndex = "model~checksum"
+
+const earthRadius = 6371000 // Radius of the Earth in meters
+
+// reversalTolerance is how many meters the vehicle has to go back along a
+// section to have turned, a shorter step back is the error of the positions.
+const reversalTolerance = 50
+
+// Modes of charging the trips.
+const (
+	ChargeByDistance = "distance" // the distance driven along the road sections
+	ChargeBySection  = "section"  // the official length of the charging sections passed
+)
+
+// Directions a charging section is charged in, by the order of the points of
+// its road section.
+const (
+	DirectionBoth     = "both"
+	DirectionForward  = "forward"
+	DirectionBackward = "backward"
+)
+
+// RoadSection is a road section of the geographic model. It mirrors
+// WptRecords of the server, so its JSON and the checksum are the same.
+type RoadSection struct {
+	LatRad    []float64         `json:"latRad"`
+	LonRad    []float64         `json:"lonRad"`
+	Distances []float64         `json:"distances"`
+	Version   string            `json:"version"`
+	Len       int               `json:"len"`
+	Name      string            `json:"name"`
+	Class     string            `json:"class"` // road class of the tariff
+	Checksum  string            `json:"checksum"`
+	Sections  []ChargingSection `json:"sections,omitempty"`
+
+	chainage []float64 // meters along the section to its points
+}
+
+// ChargingSection is a toll section of a road between two gantries. A
+// vehicle passing its virtual gantry is charged its official length.
+type ChargingSection struct {
+	Name       string  `json:"name"`
+	FromGantry string  `json:"fromGantry"`
+	ToGantry   string  `json:"toGantry"`
+	Length     float64 `json:"length"` // official meters
+	Class      string  `json:"class"`  // road class of the tariff
+	Direction  string  `json:"direction"`
+	Start      int     `json:"start"`  // first point of the road in the section
+	End        int     `json:"end"`    // last point of the road in the section
+	Gantry     int     `json:"gantry"` // point of the virtual gantry
+}
+
+// Polygon is the check-points of a trip: the road section of the model, its
+// point and the time the OBU drove through it.
+type Polygon struct {
+	I    []int    `json:"i"`
+	J    []int    `json:"j"`
+	Time []string `json:"time"`
+}
+
+// passage is the drive along a road section between its check-points.
+type passage struct {
+	entry     float64 // meters along the section where the vehicle entered it
+	exit      float64 // and where it left it
+	distance  float64 // meters driven along the section
+	reversals int     // turns to the opposite direction
+}
+
+// gantryPass is a passage through the virtual gantry of a charging section
+// between the check-points from and to.
+type gantryPass struct {
+	section *ChargingSection
+	from    int
+	to      int
+	forward bool // in the order of the points of the road
+}
+
+// PublishModel stores the geographic model, a JSON list of road sections,
+// and returns its checksum the trips refer to it by.
+func (s *SmartContract) PublishModel(ctx contractapi.TransactionContextInterface, modelJSON string) (string, error) {
+	err := requireOrg(ctx, TariffAuthorityMSP, "publish geographic models")
+	if err != nil {
+		return "", err
+	}
+	var roads []RoadSection
+	err = json.Unmarshal([]byte(modelJSON), &roads)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the geographic model: %v", err)
+	}
+	err = validateModel(roads)
+	if err != nil {
+		return "", fmt.Errorf("invalid geographic model: %v", err)
+	}
+	data, err := json.Marshal(roads)
+	if err != nil {
+		return "", err
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+	key, err := ctx.GetStub().CreateCompositeKey(modelIndex, []string{checksum})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to put to world state. %v", err)
+	}
+	return checksum, nil
+}
+
+// ReadModel returns the road sections of the geographic model of the
+// checksum.
+func (s *SmartContract) ReadModel(ctx contractapi.TransactionContextInterface, checksum string) ([]RoadSection, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(modelIndex, []string{checksum})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	data, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("the geographic model %s does not exist", checksum)
+	}
+	var roads []RoadSection
+	err = json.Unmarshal(data, &roads)
+	if err != nil {
+		return nil, err
+	}
+	for i := range roads {
+		roads[i].chainage = chainage(roads[i].LatRad, roads[i].LonRad)
+	}
+	return roads, nil
+}
+
+// validateModel checks the road sections as the server does when it loads
+// them.
+func validateModel(roads []RoadSection) error {
+	if len(roads) == 0 {
+		return fmt.Errorf("no road section")
+	}
+	names := map[string]bool{}
+	sections := map[string]bool{}
+	for _, r := range roads {
+		switch {
+		case r.Name == "" || r.Version == "":
+			return fmt.Errorf("road section without a name or a version")
+		case names[r.Name]:
+			return fmt.Errorf("repeated road section %s", r.Name)
+		case r.Class == "":
+			return fmt.Errorf("%s: missing road class", r.Name)
+		case r.Len == 0 || len(r.LatRad) != r.Len || len(r.LonRad) != r.Len:
+			return fmt.Errorf("%s: invalid points", r.Name)
+		}
+		names[r.Name] = true
+		for _, s := range r.Sections {
+			switch {
+			case s.Name == "" || sections[s.Name]:
+				return fmt.Errorf("%s: charging section '%s' is empty or repeated", r.Name, s.Name)
+			case s.Length <= 0:
+				return fmt.Errorf("section %s: length has to be positive", s.Name)
+			case s.Class == "":
+				return fmt.Errorf("section %s: missing road class", s.Name)
+			case s.Start < 0 || s.End >= r.Len || s.Start >= s.End:
+				return fmt.Errorf("section %s: invalid points %d-%d of %d", s.Name, s.Start, s.End, r.Len)
+			case s.Gantry < s.Start || s.Gantry > s.End:
+				return fmt.Errorf("section %s: gantry %d out of the section", s.Name, s.Gantry)
+			case s.Direction != DirectionBoth && s.Direction != DirectionForward && s.Direction != DirectionBackward:
+				return fmt.Errorf("section %s: unknown direction '%s'", s.Name, s.Direction)
+			}
+			sections[s.Name] = true
+		}
+	}
+	return nil
+}
+
+// checkPoints rejects check-points which do not fit the geographic model.
+func checkPoints(p Polygon, roads []RoadSection) error {
+	if len(p.I) == 0 {
+		return fmt.Errorf("the trip has no check-points")
+	}
+	if len(p.J) != len(p.I) || len(p.Time) != len(p.I) {
+		return fmt.Errorf("the check-points have %d roads, %d points and %d times", len(p.I), len(p.J), len(p.Time))
+	}
+	for k := range p.I {
+		if p.I[k] < 0 || p.I[k] >= len(roads) || p.J[k] < 0 || p.J[k] >= roads[p.I[k]].Len {
+			return fmt.Errorf("the check-point %d, %d is not in the geographic model", p.I[k], p.J[k])
+		}
+	}
+	return nil
+}
+
+// chainage returns the distance along the polyline to each of its points.
+func chainage(latRad, lonRad []float64) []float64 {
+	c := make([]float64, len(latRad))
+	for j := 1; j < len(c); j++ {
+		c[j] = c[j-1] + haversine(latRad[j-1], lonRad[j-1], latRad[j], lonRad[j])
+	}
+	return c
+}
+
+// drive returns the passage through the points of the section in the order
+// they were driven, measured along the section. A vehicle turning back is
+// charged for both directions.
+func (r *RoadSection) drive(points []int) passage {
+	if len(points) == 0 {
+		return passage{}
+	}
+	c := r.chainage
+	var p passage
+	p.entry = c[points[0]]
+	// from start the vehicle drove in the direction dir up to extreme
+	start, extreme, dir := p.entry, p.entry, 0.0
+	for _, j := range points[1:] {
+		x := c[j]
+		switch {
+		case dir == 0 || (x-extreme)*dir > 0:
+			if x != extreme {
+				dir = math.Copysign(1, x-start)
+			}
+			extreme = x
+		case math.Abs(x-extreme) > reversalTolerance:
+			p.distance += math.Abs(extreme - start)
+			p.reversals++
+			start, extreme, dir = extreme, x, -dir
+		}
+	}
+	p.distance += math.Abs(extreme - start)
+	p.exit = c[points[len(points)-1]]
+	return p
+}
+
+// passes returns the virtual gantries passed between the points of the road
+// in the order they were driven, in the directions their sections are
+// charged in. A point right at a gantry is beyond it in the order of the
+// road.
+func (r *RoadSection) passes(points []int) []gantryPass {
+	var passes []gantryPass
+	for k := 1; k < len(points); k++ {
+		a, b := r.chainage[points[k-1]], r.chainage[points[k]]
+		step := len(passes)
+		for i := range r.Sections {
+			s := &r.Sections[i]
+			g := r.chainage[s.Gantry]
+			switch {
+			case a < g && b >= g && s.Direction != DirectionBackward:
+				passes = append(passes, gantryPass{section: s, from: k - 1, to: k, forward: true})
+			case a >= g && b < g && s.Direction != DirectionForward:
+				passes = append(passes, gantryPass{section: s, from: k - 1, to: k})
+			}
+		}
+		// more gantries between two check-points in the order they were passed
+		p := passes[step:]
+		sort.SliceStable(p, func(i, j int) bool {
+			gi, gj := r.chainage[p[i].section.Gantry], r.chainage[p[j].section.Gantry]
+			if b > a {
+				return gi < gj
+			}
+			return gi > gj
+		})
+	}
+	return passes
+}
+
+// haversine calculates the distance between two coordinates in radians.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	dlat := lat2 - lat1
+	dlon := lon2 - lon1
+
+	a := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+	return earthRadius * c
+}
@@ -13,7 +13,10 @@ type SmartContract struct {
 
 const obuIndex = "id~spz~country"
 
+// OnBoardUnit is a vehicle registered for tolling. The Credit of a prepaid
+// account is its balance, of a postpaid account its debt.
 type OnBoardUnit struct {
+	Account         string  `json:"Account"`
 	Axles 	        int     `json:"Axles"`
 	Country	        string  `json:"Country"`
 	Credit		float64 `json:"Credit"`
@@ -30,7 +33,7 @@ func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface)
 		{ID: "2c9fa1aa-4403-4cc9-96f4-09a05638bcad", Country: "CZ", SPZ: "1SA1234", Credit: 0.0, 
 		Currency: "CZK", Weight: 8500, Emission: "6", Category: "N", Axles: 4 },
 		{ID: "7873527e-4d58-4e94-a71c-8ad908f59e00", Country: "CZ", SPZ: "1S15244", Credit: 40.0, 
-		Currency: "CZK", Weight: 12500, Emission: "2", Category: "N", Axles: 5 },
+		Currency: "CZK", Weight: 12500, Emission: "2", Category: "N", Axles: 5, Account: AccountPrepaid },
 	}
 
 	for _, obu := range obuList {
@@ -51,7 +54,16 @@ func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface)
 
 	return nil
 }
-func (s *SmartContract) CreateObu(ctx contractapi.TransactionContextInterface, id, spz, country, currency, emission, category string, weight, axles int) error {
+func (s *SmartContract) CreateObu(ctx contractapi.TransactionContextInterface, id, spz, country, currency, emission, category string, weight, axles int, account string) error {
+	if err := requireOrg(ctx, TollOperatorMSP, "register OBUs"); err != nil {
+		return err
+	}
+	if account == "" {
+		account = AccountPostpaid
+	}
+	if !validAccount(account) {
+		return fmt.Errorf("unknown account %s", account)
+	}
 	exists, err := s.ObuExists(ctx, id, spz, country)
 	if err != nil {
 		return err
@@ -72,6 +84,8 @@ func (s *SmartContract) CreateObu(ctx contractapi.TransactionContextInterface, i
 		Credit:         0.0,
 		Currency: 	currency,
 		Emission:	emission,
+		Category:	category,
+		Account:	account,
 		Weight:		weight,
 		Axles:		axles,
 	}
@@ -82,37 +96,11 @@ func (s *SmartContract) CreateObu(ctx contractapi.TransactionContextInterface, i
 
 	return ctx.GetStub().PutState(idObu, obuJSON)
 }
-func (s *SmartContract) TollRoadObu(ctx contractapi.TransactionContextInterface, id, spz, country string, sum float64) (*OnBoardUnit, error) {
-	idObu, err := ctx.GetStub().CreateCompositeKey(obuIndex, []string{id, spz, country})	
-	if err != nil {
-		return nil, fmt.Errorf("failed to create composite key: %v", err)
-	} 
-	obuJSON, err := ctx.GetStub().GetState(idObu)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from world state: %v", err)
-	}
-	if obuJSON == nil {
-		return nil, fmt.Errorf("the obu %s does not exist", idObu)
-	}
-	var obu OnBoardUnit
-	err = json.Unmarshal(obuJSON, &obu)
-	if err != nil {
-		return nil, err
-	}
-	obu.Credit += sum
-
-	obuJSON, err = json.Marshal(obu)
-	if err != nil {
-		return nil, err
-	}
-	err = ctx.GetStub().PutState(idObu, obuJSON)
-	if err != nil {
-		return nil, err
-	}
-	return &obu, nil
-}
 
 func (s *SmartContract) UpdateObu(ctx contractapi.TransactionContextInterface, id, spz, country, newEmission string, newWeight, newAxles int) error {
+	if err := requireOrg(ctx, TollOperatorMSP, "update OBUs"); err != nil {
+		return err
+	}
 	idObu, err := ctx.GetStub().CreateCompositeKey(obuIndex, []string{id, spz, country})	
 	if err != nil {
 		return fmt.Errorf("failed to create composite key: %v", err)
@@ -163,6 +151,9 @@ func (s *SmartContract) ReadObu(ctx contractapi.TransactionContextInterface, id,
 }
 
 func (s *SmartContract) DeleteObu(ctx contractapi.TransactionContextInterface, id, spz, country string) error {
+	if err := requireOrg(ctx, TollOperatorMSP, "delete OBUs"); err != nil {
+		return err
+	}
 	exists, err := s.ObuExists(ctx, id, spz, country)
 	if err != nil {
 		return err
@@ -180,6 +171,9 @@ func (s *SmartContract) DeleteObu(ctx contractapi.TransactionContextInterface, i
 }
 
 func (s *SmartContract) SetNullCredit(ctx contractapi.TransactionContextInterface, id, spz, country string) error {
+	if err := requireOrg(ctx, TollOperatorMSP, "reset credit"); err != nil {
+		return err
+	}
 	idObu, err := ctx.GetStub().CreateCompositeKey(obuIndex, []string{id, spz, country})	
 	if err != nil {
 		return fmt.Errorf("failed to create composite key: %v", err)
@@ -0,0 +1,685 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const tariffIndex = "tariff~version"
+
+// TariffAuthorityMSP is the only organization allowed to publish tariffs.
+// It is a part of the contract, a peer cannot change it.
+const TariffAuthorityMSP = "Org2MSP"
+
+// Tariff is a tariff document of the regulator, the same the server loads
+// from its sazba directory. It is in force from ValidFrom up to, but not
+// including, ValidTo. Its time bands are by the clock of TimeZone.
+type Tariff struct {
+	Version     string          `json:"version"`
+	ValidFrom   string          `json:"validFrom"` // RFC3339
+	ValidTo     string          `json:"validTo"`   // RFC3339, empty if open ended
+	Currency    string          `json:"currency"`
+	TimeZone    string          `json:"timeZone"` // IANA name, e.g. Europe/Prague
+	Ratio       float64         `json:"ratio"`    // meters charged by a rate
+	RoadClasses []RoadClass     `json:"roadClasses"`
+	TimeBands   []TimeBandRule  `json:"timeBands"`
+	Categories  []Category      `json:"categories"`
+	Emissions   []EmissionClass `json:"emissions"`
+	Weights     []WeightBand    `json:"weights"`
+	Rates       []Rate          `json:"rates"`
+}
+
+// RoadClass is a class of the roads charged by the same rates. A road section
+// of the model names its class.
+type RoadClass struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// TimeBandRule is a part of the day from From up to To, HH:MM in the time
+// zone of the tariff. A band with To before From goes over midnight.
+type TimeBandRule struct {
+	ID   string `json:"id"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type Category struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases"`
+	MinAxles int      `json:"minAxles"`
+	MaxAxles int      `json:"maxAxles"`
+}
+
+type EmissionClass struct {
+	ID      string   `json:"id"`
+	Aliases []string `json:"aliases"`
+}
+
+// WeightBand covers weights in kilograms from Min up to, but not including,
+// Max. Max 0 has no upper limit.
+type WeightBand struct {
+	ID  string `json:"id"`
+	Min int    `json:"min"`
+	Max int    `json:"max"`
+}
+
+type Rate struct {
+	Road     string  `json:"road"`
+	Time     string  `json:"time"`
+	Category string  `json:"category"`
+	Emission string  `json:"emission"`
+	Weight   string  `json:"weight"`
+	Axles    int     `json:"axles"`
+	Rate     float64 `json:"rate"`
+}
+
+// ChargeResult is the OBU after a charge and the recorded trip.
+type ChargeResult struct {
+	Obu         *OnBoardUnit     `json:"Obu"`
+	Transaction *TollTransaction `json:"Transaction"`
+}
+
+// PublishTariff stores a new tariff version. An open ended tariff in force
+// before it is closed at its beginning, which must not be in the past.
+func (s *SmartContract) PublishTariff(ctx contractapi.TransactionContextInterface, tariffJSON string) error {
+	err := requireOrg(ctx, TariffAuthorityMSP, "publish tariffs")
+	if err != nil {
+		return err
+	}
+
+	var t Tariff
+	err = json.Unmarshal([]byte(tariffJSON), &t)
+	if err != nil {
+		return fmt.Errorf("failed to parse the tariff: %v", err)
+	}
+	err = t.validate()
+	if err != nil {
+		return fmt.Errorf("invalid tariff %s: %v", t.Version, err)
+	}
+	from, _ := time.Parse(time.RFC3339, t.ValidFrom)
+	to, _ := time.Parse(time.RFC3339, t.ValidTo)
+
+	tariffs, err := s.GetAllTariffs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, old := range tariffs {
+		if old.Version == t.Version {
+			return fmt.Errorf("the tariff %s already exists", t.Version)
+		}
+		oldFrom, _ := time.Parse(time.RFC3339, old.ValidFrom)
+		if old.ValidTo == "" && oldFrom.Before(from) {
+			ts, err := ctx.GetStub().GetTxTimestamp()
+			if err != nil {
+				return fmt.Errorf("failed to get transaction timestamp: %v", err)
+			}
+			if from.Before(ts.AsTime()) {
+				return fmt.Errorf("the tariff %s would change the tariff %s in the past", t.Version, old.Version)
+			}
+			old.ValidTo = t.ValidFrom
+			err = putTariff(ctx, old)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		oldTo, _ := time.Parse(time.RFC3339, old.ValidTo)
+		if (old.ValidTo == "" || from.Before(oldTo)) && (t.ValidTo == "" || oldFrom.Before(to)) {
+			return fmt.Errorf("the tariff %s overlaps the tariff %s", t.Version, old.Version)
+		}
+	}
+	return putTariff(ctx, &t)
+}
+
+func putTariff(ctx contractapi.TransactionContextInterface, t *Tariff) error {
+	key, err := ctx.GetStub().CreateCompositeKey(tariffIndex, []string{t.Version})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+	tariffJSON, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, tariffJSON)
+}
+
+func (s *SmartContract) ReadTariff(ctx contractapi.TransactionContextInterface, version string) (*Tariff, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(tariffIndex, []string{version})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	tariffJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if tariffJSON == nil {
+		return nil, fmt.Errorf("the tariff %s does not exist", version)
+	}
+	var t Tariff
+	err = json.Unmarshal(tariffJSON, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *SmartContract) GetAllTariffs(ctx contractapi.TransactionContextInterface) ([]*Tariff, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(tariffIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var tariffs []*Tariff
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var t Tariff
+		err = json.Unmarshal(queryResponse.Value, &t)
+		if err != nil {
+			return nil, err
+		}
+		tariffs = append(tariffs, &t)
+	}
+	return tariffs, nil
+}
+
+// ComputeToll prices the trip of the OBU by the tariffs on the ledger
+// without charging it. The trip is a JSON encoded TollTransaction with the
+// check-points driven on a geographic model on the ledger, its segments are
+// derived from them.
+func (s *SmartContract) ComputeToll(ctx contractapi.TransactionContextInterface, id, spz, country, trip string) (*TollTransaction, error) {
+	obu, err := s.ReadObu(ctx, id, spz, country)
+	if err != nil {
+		return nil, err
+	}
+	return s.computeToll(ctx, obu, trip)
+}
+
+// ChargeTrip prices the trip as ComputeToll does, charges the OBU by the
+// result and records the trip in the same transaction.
+func (s *SmartContract) ChargeTrip(ctx contractapi.TransactionContextInterface, id, spz, country, trip string) (*ChargeResult, error) {
+	err := requireOrg(ctx, TollOperatorMSP, "charge trips")
+	if err != nil {
+		return nil, err
+	}
+	var tx *TollTransaction
+	obu, err := s.updateAccount(ctx, id, spz, country, func(obu *OnBoardUnit) error {
+		var err error
+		tx, err = s.computeToll(ctx, obu, trip)
+		if err != nil {
+			return err
+		}
+		return chargeObu(obu, tx.Amount)
+	})
+	if err != nil {
+		return nil, err
+	}
+	tripJSON, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err = s.putTollTransaction(ctx, obu, tx.Amount, string(tripJSON))
+	if err != nil {
+		return nil, err
+	}
+	return &ChargeResult{Obu: obu, Transaction: tx}, nil
+}
+
+func (s *SmartContract) computeToll(ctx contractapi.TransactionContextInterface, obu *OnBoardUnit, trip string) (*TollTransaction, error) {
+	var tx TollTransaction
+	err := json.Unmarshal([]byte(trip), &tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the trip: %v", err)
+	}
+	if tx.Model == "" || tx.CheckPoints == nil {
+		return nil, fmt.Errorf("the trip has no check-points of a geographic model")
+	}
+	if tx.Charging != ChargeByDistance && tx.Charging != ChargeBySection {
+		return nil, fmt.Errorf("unknown charging mode '%s'", tx.Charging)
+	}
+	roads, err := s.ReadModel(ctx, tx.Model)
+	if err != nil {
+		return nil, err
+	}
+	p := *tx.CheckPoints
+	err = checkPoints(p, roads)
+	if err != nil {
+		return nil, err
+	}
+	tariffs, err := s.GetAllTariffs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the segments of one road section, one time band and one tariff, as
+	// the server splits them
+	tx.Time = p.Time[0]
+	tx.Segments = nil
+	start := 0
+	for i := range p.I {
+		if i+1 < len(p.I) && p.I[i] == p.I[i+1] && sameTariff(tariffs, p.Time[i], p.Time[i+1]) {
+			continue
+		}
+		road := &roads[p.I[i]]
+		if tx.Charging == ChargeBySection {
+			segments, err := chargeSections(tariffs, obu, road, p, start, i)
+			if err != nil {
+				return nil, err
+			}
+			tx.Segments = append(tx.Segments, segments...)
+		} else {
+			segment, err := chargeSegment(tariffs, obu, road, p, start, i)
+			if err != nil {
+				return nil, err
+			}
+			tx.Segments = append(tx.Segments, segment)
+		}
+		start = i + 1
+	}
+
+	var versions []string
+	tx.Amount = 0
+	for _, seg := range tx.Segments {
+		tx.Amount += seg.Amount
+		if len(versions) == 0 || versions[len(versions)-1] != seg.TariffVersion {
+			versions = append(versions, seg.TariffVersion)
+		}
+	}
+	tx.TariffVersion = strings.Join(versions, ",")
+	return &tx, nil
+}
+
+// sameTariff reports whether both times are charged by the same rates.
+func sameTariff(tariffs []*Tariff, time1, time2 string) bool {
+	t1, err1 := tariffAt(tariffs, time1)
+	t2, err2 := tariffAt(tariffs, time2)
+	if err1 != nil || err2 != nil {
+		return err1 != nil && err2 != nil
+	}
+	if t1 != t2 {
+		return false
+	}
+	band1, _ := t1.timeBand(time1)
+	band2, _ := t1.timeBand(time2)
+	return band1 == band2
+}
+
+// continued returns the check-point the segment from start goes on from, the
+// last one of the previous segment if it was split from it by the time band
+// or the tariff.
+func continued(p Polygon, start int) int {
+	if start > 0 && p.I[start-1] == p.I[start] {
+		return start - 1
+	}
+	return start
+}
+
+// price charges distance meters of the road class by the tariff in force at
+// timedate.
+func price(tariffs []*Tariff, obu *OnBoardUnit, class string, distance float64, timedate string) (*Tariff, string, float64, error) {
+	t, err := tariffAt(tariffs, timedate)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	band, err := t.timeBand(timedate)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	amount, err := t.charge(obu, class, band, distance)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return t, band, amount, nil
+}
+
+// chargeSegment charges the distance driven along the road section between
+// the check-points start and end.
+func chargeSegment(tariffs []*Tariff, obu *OnBoardUnit, road *RoadSection, p Polygon, start, end int) (TollSegment, error) {
+	from := continued(p, start)
+	drive := road.drive(p.J[from : end+1])
+	timestamp := p.Time[end]
+	t, band, amount, err := price(tariffs, obu, road.Class, drive.distance, timestamp)
+	if err != nil {
+		return TollSegment{}, err
+	}
+	return TollSegment{
+		Road:          road.Name,
+		Class:         road.Class,
+		TimeBand:      band,
+		TariffVersion: t.Version,
+		From:          p.Time[start],
+		To:            timestamp,
+		Entry:         drive.entry,
+		Exit:          drive.exit,
+		Reversals:     drive.reversals,
+		Distance:      drive.distance,
+		Amount:        amount,
+	}, nil
+}
+
+// chargeSections charges the official length of each charging section whose
+// virtual gantry was passed between the check-points start and end, by the
+// tariff at the check-point behind the gantry.
+func chargeSections(tariffs []*Tariff, obu *OnBoardUnit, road *RoadSection, p Polygon, start, end int) ([]TollSegment, error) {
+	from := continued(p, start)
+	var segments []TollSegment
+	for _, pass := range road.passes(p.J[from : end+1]) {
+		sec := pass.section
+		timestamp := p.Time[from+pass.to]
+		t, band, amount, err := price(tariffs, obu, sec.Class, sec.Length, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		entry, exit := road.chainage[sec.Start], road.chainage[sec.End]
+		if !pass.forward {
+			entry, exit = exit, entry
+		}
+		segments = append(segments, TollSegment{
+			Road:          road.Name,
+			Section:       sec.Name,
+			Class:         sec.Class,
+			TimeBand:      band,
+			TariffVersion: t.Version,
+			From:          p.Time[from+pass.from],
+			To:            timestamp,
+			Entry:         entry,
+			Exit:          exit,
+			Distance:      sec.Length,
+			Amount:        amount,
+		})
+	}
+	return segments, nil
+}
+
+func tariffAt(tariffs []*Tariff, timedate string) (*Tariff, error) {
+	tm, err := time.Parse(time.RFC3339, timedate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %s: %v", timedate, err)
+	}
+	for _, t := range tariffs {
+		from, _ := time.Parse(time.RFC3339, t.ValidFrom)
+		to, _ := time.Parse(time.RFC3339, t.ValidTo)
+		if !tm.Before(from) && (t.ValidTo == "" || tm.Before(to)) {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("no tariff is in force at %s", timedate)
+}
+
+// charge prices distance meters driven by the OBU on a road of the class in
+// the time band.
+func (t *Tariff) charge(obu *OnBoardUnit, class, band string, distance float64) (float64, error) {
+	road, err := t.roadClass(class)
+	if err != nil {
+		return 0, err
+	}
+	category, err := t.category(obu.Category)
+	if err != nil {
+		return 0, err
+	}
+	emission, err := t.emission(obu.Emission)
+	if err != nil {
+		return 0, err
+	}
+	weight, err := t.weight(obu.Weight)
+	if err != nil {
+		return 0, err
+	}
+	axles := obu.Axles
+	if axles > category.MaxAxles {
+		axles = category.MaxAxles
+	}
+	// a dimension the tariff cannot price fails even a distance too short
+	// to be charged
+	ratio := t.Ratio
+	if ratio <= 0 {
+		ratio = 100
+	}
+	for _, r := range t.Rates {
+		if r.Road == road && r.Time == band && r.Category == category.ID &&
+			r.Emission == emission && r.Weight == weight && r.Axles == axles {
+			if distance < ratio {
+				return 0, nil
+			}
+			return r.Rate * distance / ratio, nil
+		}
+	}
+	return 0, fmt.Errorf("the tariff %s has no rate for %d axles", t.Version, obu.Axles)
+}
+
+func (t *Tariff) roadClass(class string) (string, error) {
+	for _, r := range t.RoadClasses {
+		if r.ID == class {
+			return r.ID, nil
+		}
+	}
+	return "", fmt.Errorf("the tariff %s has no road class '%s'", t.Version, class)
+}
+
+func (t *Tariff) timeBand(timedate string) (string, error) {
+	tm, err := time.Parse(time.RFC3339, timedate)
+	if err != nil {
+		return "", fmt.Errorf("invalid time %s: %v", timedate, err)
+	}
+	location, err := loadLocation(t.TimeZone)
+	if err != nil {
+		return "", fmt.Errorf("the tariff %s has an invalid time zone: %v", t.Version, err)
+	}
+	tm = tm.In(location)
+	minute := tm.Hour()*60 + tm.Minute()
+	for _, b := range t.TimeBands {
+		if b.contains(minute) {
+			return b.ID, nil
+		}
+	}
+	return "", fmt.Errorf("the time %s is in no time band", timedate)
+}
+
+func (t *Tariff) category(category string) (*Category, error) {
+	for i, c := range t.Categories {
+		for _, a := range c.Aliases {
+			if a == category {
+				return &t.Categories[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("the category %s does not exist", category)
+}
+
+func (t *Tariff) emission(emission string) (string, error) {
+	for _, e := range t.Emissions {
+		for _, a := range e.Aliases {
+			if a == emission {
+				return e.ID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("the emission %s does not exist", emission)
+}
+
+func (t *Tariff) weight(weightKilo int) (string, error) {
+	for _, w := range t.Weights {
+		if weightKilo >= w.Min && (w.Max == 0 || weightKilo < w.Max) {
+			return w.ID, nil
+		}
+	}
+	return "", fmt.Errorf("the weight %d does not belong to any weight band", weightKilo)
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether the minute of the day is in the band, the clocks
+// of a validated tariff are valid.
+func (b TimeBandRule) contains(minute int) bool {
+	from, _ := parseClock(b.From)
+	to, _ := parseClock(b.To)
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// validate checks the references between the lists and that a rate exists
+// for every combination of the dimensions. It makes the same checks as the
+// server does when it loads a tariff.
+func (t *Tariff) validate() error {
+	if t.Version == "" {
+		return fmt.Errorf("missing version")
+	}
+	if t.Ratio < 0 {
+		return fmt.Errorf("negative ratio")
+	}
+	if t.TimeZone == "" || t.TimeZone == "Local" {
+		return fmt.Errorf("missing time zone")
+	}
+	if _, err := loadLocation(t.TimeZone); err != nil {
+		return fmt.Errorf("timeZone: %v", err)
+	}
+	from, err := time.Parse(time.RFC3339, t.ValidFrom)
+	if err != nil {
+		return fmt.Errorf("validFrom: %v", err)
+	}
+	if t.ValidTo != "" {
+		to, err := time.Parse(time.RFC3339, t.ValidTo)
+		if err != nil {
+			return fmt.Errorf("validTo: %v", err)
+		}
+		if !to.After(from) {
+			return fmt.Errorf("validTo is not after validFrom")
+		}
+	}
+	if len(t.RoadClasses) == 0 || len(t.TimeBands) == 0 || len(t.Categories) == 0 ||
+		len(t.Emissions) == 0 || len(t.Weights) == 0 {
+		return fmt.Errorf("every dimension needs at least one entry")
+	}
+
+	roads := map[string]bool{}
+	for _, r := range t.RoadClasses {
+		if r.ID == "" || roads[r.ID] {
+			return fmt.Errorf("road class '%s' is empty or repeated", r.ID)
+		}
+		roads[r.ID] = true
+	}
+
+	bands := map[string]bool{}
+	for _, b := range t.TimeBands {
+		if b.ID == "" || bands[b.ID] {
+			return fmt.Errorf("time band '%s' is empty or repeated", b.ID)
+		}
+		bands[b.ID] = true
+		if _, err := parseClock(b.From); err != nil {
+			return fmt.Errorf("time band %s: %v", b.ID, err)
+		}
+		if _, err := parseClock(b.To); err != nil {
+			return fmt.Errorf("time band %s: %v", b.ID, err)
+		}
+	}
+	for minute := 0; minute < 24*60; minute++ {
+		n := 0
+		for _, b := range t.TimeBands {
+			if b.contains(minute) {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("time %02d:%02d is in %d time bands", minute/60, minute%60, n)
+		}
+	}
+
+	categories := map[string]bool{}
+	aliases := map[string]bool{}
+	for _, c := range t.Categories {
+		if c.ID == "" || categories[c.ID] {
+			return fmt.Errorf("category '%s' is empty or repeated", c.ID)
+		}
+		categories[c.ID] = true
+		if c.MinAxles < 1 || c.MaxAxles < c.MinAxles {
+			return fmt.Errorf("category %s: invalid axles %d-%d", c.ID, c.MinAxles, c.MaxAxles)
+		}
+		for _, a := range c.Aliases {
+			if aliases[a] {
+				return fmt.Errorf("category alias '%s' is repeated", a)
+			}
+			aliases[a] = true
+		}
+	}
+
+	emissions := map[string]bool{}
+	aliases = map[string]bool{}
+	for _, e := range t.Emissions {
+		if e.ID == "" || emissions[e.ID] {
+			return fmt.Errorf("emission class '%s' is empty or repeated", e.ID)
+		}
+		emissions[e.ID] = true
+		for _, a := range e.Aliases {
+			if aliases[a] {
+				return fmt.Errorf("emission alias '%s' is repeated", a)
+			}
+			aliases[a] = true
+		}
+	}
+
+	weights := map[string]bool{}
+	for i, w := range t.Weights {
+		if w.ID == "" || weights[w.ID] {
+			return fmt.Errorf("weight band '%s' is empty or repeated", w.ID)
+		}
+		weights[w.ID] = true
+		if w.Max != 0 && w.Max <= w.Min {
+			return fmt.Errorf("weight band %s: invalid range %d-%d", w.ID, w.Min, w.Max)
+		}
+		for _, o := range t.Weights[i+1:] {
+			if (w.Max == 0 || o.Min < w.Max) && (o.Max == 0 || w.Min < o.Max) {
+				return fmt.Errorf("weight bands %s and %s overlap", w.ID, o.ID)
+			}
+		}
+	}
+
+	rates := map[Rate]bool{}
+	for _, r := range t.Rates {
+		if !roads[r.Road] || !bands[r.Time] || !categories[r.Category] ||
+			!emissions[r.Emission] || !weights[r.Weight] {
+			return fmt.Errorf("rate %+v refers to an unknown entry", r)
+		}
+		if r.Rate < 0 {
+			return fmt.Errorf("rate %+v is negative", r)
+		}
+		key := r
+		key.Rate = 0
+		if rates[key] {
+			return fmt.Errorf("rate %+v is repeated", r)
+		}
+		rates[key] = true
+	}
+	for _, r := range t.RoadClasses {
+		for _, b := range t.TimeBands {
+			for _, c := range t.Categories {
+				for _, e := range t.Emissions {
+					for _, w := range t.Weights {
+						for a := c.MinAxles; a <= c.MaxAxles; a++ {
+							if !rates[Rate{Road: r.ID, Time: b.ID, Category: c.ID, Emission: e.ID, Weight: w.ID, Axles: a}] {
+								return fmt.Errorf("missing rate for %s, %s, %s, %s, %s, %d axles",
+									r.ID, b.ID, c.ID, e.ID, w.ID, a)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
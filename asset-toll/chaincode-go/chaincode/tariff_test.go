@@ -0,0 +1,158 @@
+package chaincode
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// tariffFile is the tariff of the server, the one published on the ledger.
+const tariffFile = "../../../server/sazba/tariff-2023.json"
+
+// tariffFixtures are the valid and invalid tariffs shared with the tests of
+// the server.
+const tariffFixtures = "../../../testdata/tariffs.json"
+
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPublishTariff(t *testing.T) {
+	s, ctx := initLedger(t)
+	tariff := readFile(t, tariffFile)
+
+	err := s.PublishTariff(ctx.next().as("Org1MSP"), tariff)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Org1MSP: expected an error of a caller not allowed, but got %v", err)
+	}
+	if err := s.PublishTariff(ctx.next().as(TariffAuthorityMSP), tariff); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PublishTariff(ctx.next(), tariff); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expected an error of a repeated version, but got %v", err)
+	}
+	if got, err := s.ReadTariff(ctx, "2023.1"); err != nil || got.Currency != "CZK" {
+		t.Errorf("expected the tariff 2023.1 in CZK, but got %v, %v", got, err)
+	}
+}
+
+// TestTariffFixtures validates the tariffs shared with the tests of the
+// server, both have to accept and refuse the same tariffs.
+func TestTariffFixtures(t *testing.T) {
+	var fixtures []struct {
+		Name   string `json:"name"`
+		Error  string `json:"error"`
+		Tariff Tariff `json:"tariff"`
+	}
+	if err := json.Unmarshal([]byte(readFile(t, tariffFixtures)), &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		err := f.Tariff.validate()
+		if f.Error == "" && err != nil {
+			t.Errorf("%s: expected no error, but got %v", f.Name, err)
+		} else if f.Error != "" && (err == nil || !strings.Contains(err.Error(), f.Error)) {
+			t.Errorf("%s: expected error '%s', but got %v", f.Name, f.Error, err)
+		}
+	}
+}
+
+// TestChargeTrip charges the trips shared with the tests of the server on
+// the same model and tariff, the amounts have to be the same.
+func TestChargeTrip(t *testing.T) {
+	s, ctx := initLedger(t)
+	model := readFile(t, "../../../testdata/model.json")
+	if err := s.PublishTariff(ctx.as(TariffAuthorityMSP), readFile(t, tariffFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PublishModel(ctx.next().as("Org1MSP"), model); err == nil {
+		t.Errorf("Org1MSP: expected an error of a caller not allowed to publish a model")
+	}
+	checksum, err := s.PublishModel(ctx.next().as(TariffAuthorityMSP), model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := fmt.Sprintf("%x", sha256.Sum256([]byte(model))); checksum != exp {
+		t.Errorf("expected the checksum %s of the model, but got %s", exp, checksum)
+	}
+	ctx.as(TollOperatorMSP)
+
+	var trips []struct {
+		Name     string      `json:"name"`
+		Charging string      `json:"charging"`
+		Obu      OnBoardUnit `json:"obu"`
+		Polygon  Polygon     `json:"polygon"`
+		Amount   float64     `json:"amount"`
+		Segments int         `json:"segments"`
+	}
+	if err := json.Unmarshal([]byte(readFile(t, "../../../testdata/trips.json")), &trips); err != nil {
+		t.Fatal(err)
+	}
+	for i, trip := range trips {
+		o := trip.Obu
+		id := fmt.Sprintf("trip%d", i)
+		err := s.CreateObu(ctx.next(), id, "1AB", "CZ", "CZK", o.Emission, o.Category, o.Weight, o.Axles, AccountPostpaid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// segments sent by the server are not charged, they are derived
+		tripJSON, _ := json.Marshal(TollTransaction{TicketID: trip.Name, Model: checksum, Charging: trip.Charging,
+			CheckPoints: &trip.Polygon, Segments: []TollSegment{{Distance: 1e6, Class: "D"}}})
+		result, err := s.ChargeTrip(ctx.next(), id, "1AB", "CZ", string(tripJSON))
+		if err != nil {
+			t.Fatalf("%s: %v", trip.Name, err)
+		}
+		tx := result.Transaction
+		if math.Abs(tx.Amount-trip.Amount) > 1e-9 || len(tx.Segments) != trip.Segments || result.Obu.Credit != tx.Amount {
+			t.Errorf("%s: expected %v in %d segments, but got %v in %d", trip.Name, trip.Amount, trip.Segments,
+				tx.Amount, len(tx.Segments))
+		}
+	}
+
+	valid := trips[0].Polygon
+	outside := Polygon{I: []int{1, 1}, J: []int{0, 100}, Time: valid.Time[:2]}
+	invalid := []TollTransaction{
+		{Model: checksum, Charging: ChargeByDistance},
+		{Model: "unknown", Charging: ChargeByDistance, CheckPoints: &valid},
+		{Model: checksum, Charging: "zone", CheckPoints: &valid},
+		{Model: checksum, Charging: ChargeByDistance, CheckPoints: &outside},
+	}
+	for _, tx := range invalid {
+		tripJSON, _ := json.Marshal(tx)
+		if _, err := s.ComputeToll(ctx.next(), "trip0", "1AB", "CZ", string(tripJSON)); err == nil {
+			t.Errorf("at input %s expected an error", tripJSON)
+		}
+	}
+}
+
+// TestTimeBand prices by the clock of the time zone of the tariff, whatever
+// the offset of the check-point.
+func TestTimeBand(t *testing.T) {
+	var tariff Tariff
+	if err := json.Unmarshal([]byte(readFile(t, tariffFile)), &tariff); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		timedate string
+		exp      string
+	}{
+		{"2023-05-02T22:30:00+02:00", "night"},
+		{"2023-05-02T20:30:00Z", "night"},
+		{"2023-05-02T16:30:00-04:00", "night"},
+		{"2023-01-02T04:30:00Z", "day"},
+	}
+	for _, test := range tests {
+		if got, err := tariff.timeBand(test.timedate); err != nil || got != test.exp {
+			t.Errorf("at input %s expected %s, but got %s, %v", test.timedate, test.exp, got, err)
+		}
+	}
+}
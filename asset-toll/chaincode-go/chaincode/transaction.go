@@ -0,0 +1,244 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Toll transactions are kept under the key of their OBU, so all trips of
+// one OBU can be listed by a partial composite key in the order of travel.
+const tollTxIndex = "tx~id~spz~country~time~txid"
+
+// A processed ticket points to the key of its toll transaction. Ticket IDs
+// are chosen by the OBUs, so a ticket is kept under the key of its OBU.
+const ticketIndex = "ticket~id~spz~country~ticketid"
+
+// txTimePrefix keys the toll transactions of all OBUs by the UTC time of the
+// trip, so an interval of time is a range query. It is a simple key, range
+// queries do not take composite keys; the value is the key of the trip.
+const txTimePrefix = "tx~time~"
+
+func txTimeKey(tripTime, txID string) string {
+	return txTimePrefix + tripTime + "~" + txID
+}
+
+// TollSegment is a part of a trip driven on one road section within one
+// time band of one tariff.
+type TollSegment struct {
+	Road          string  `json:"Road"`
+	Section       string  `json:"Section,omitempty"` // charging section passed, if charged by sections
+	Class         string  `json:"Class"`             // road class of the tariff
+	TimeBand      string  `json:"TimeBand"`
+	TariffVersion string  `json:"TariffVersion"`
+	From          string  `json:"From"`
+	To            string  `json:"To"`
+	Entry         float64 `json:"Entry"`     // meters along the road section where it was entered
+	Exit          float64 `json:"Exit"`      // and left
+	Reversals     int     `json:"Reversals"` // turns back on the road section
+	Distance      float64 `json:"Distance"`  // meters along the road section
+	Amount        float64 `json:"Amount"`
+}
+
+// TollTransaction records one charged trip of an OBU.
+type TollTransaction struct {
+	TxID          string        `json:"TxID"`
+	ObuID         string        `json:"ObuID"`
+	SPZ           string        `json:"SPZ"`
+	Country       string        `json:"Country"`
+	Time          string        `json:"Time"` // beginning of the trip, RFC3339
+	Segments      []TollSegment `json:"Segments"`
+	TariffVersion string        `json:"TariffVersion"` // versions of the segments
+	Amount        float64       `json:"Amount"`
+	Currency      string        `json:"Currency"`
+	TicketID      string        `json:"TicketID"`
+	TicketHash    string        `json:"TicketHash"`
+	Timestamp     string        `json:"Timestamp"`             // time of the ledger transaction
+	Model         string        `json:"Model,omitempty"`       // checksum of the geographic model of the check-points
+	Charging      string        `json:"Charging,omitempty"`    // mode the trip is charged by
+	CheckPoints   *Polygon      `json:"CheckPoints,omitempty"` // as driven by the OBU
+}
+
+// putTollTransaction completes the trip with the details of the current
+// ledger transaction and stores it. A ticket can be recorded only once.
+func (s *SmartContract) putTollTransaction(ctx contractapi.TransactionContextInterface, obu *OnBoardUnit, sum float64, trip string) (*TollTransaction, error) {
+	var tx TollTransaction
+	if trip != "" {
+		err := json.Unmarshal([]byte(trip), &tx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the trip: %v", err)
+		}
+	}
+	var idTicket string
+	if tx.TicketID != "" {
+		exists, err := s.TicketExists(ctx, obu.ID, obu.SPZ, obu.Country, tx.TicketID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, fmt.Errorf("the ticket %s has already been processed", tx.TicketID)
+		}
+		idTicket, err = ctx.GetStub().CreateCompositeKey(ticketIndex, []string{obu.ID, obu.SPZ, obu.Country, tx.TicketID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key: %v", err)
+		}
+	}
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	tx.TxID = ctx.GetStub().GetTxID()
+	tx.ObuID = obu.ID
+	tx.SPZ = obu.SPZ
+	tx.Country = obu.Country
+	tx.Amount = sum
+	tx.Currency = obu.Currency
+	tx.Timestamp = ts.AsTime().UTC().Format(time.RFC3339)
+	if tx.Time == "" {
+		tx.Time = tx.Timestamp
+	} else {
+		// UTC keeps the keys of one OBU in the order of travel
+		t, err := time.Parse(time.RFC3339, tx.Time)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time of the trip %s: %v", tx.Time, err)
+		}
+		tx.Time = t.UTC().Format(time.RFC3339)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(tollTxIndex, []string{obu.ID, obu.SPZ, obu.Country, tx.Time, tx.TxID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	txJSON, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.GetStub().PutState(key, txJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put to world state. %v", err)
+	}
+	if tx.TicketID != "" {
+		err = ctx.GetStub().PutState(idTicket, []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to put to world state. %v", err)
+		}
+	}
+	err = ctx.GetStub().PutState(txTimeKey(tx.Time, tx.TxID), []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to put to world state. %v", err)
+	}
+	return &tx, nil
+}
+
+// TicketExists reports whether the ticket of the OBU has already been charged.
+func (s *SmartContract) TicketExists(ctx contractapi.TransactionContextInterface, id, spz, country, ticketID string) (bool, error) {
+	idTicket, err := ctx.GetStub().CreateCompositeKey(ticketIndex, []string{id, spz, country, ticketID})
+	if err != nil {
+		return false, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	key, err := ctx.GetStub().GetState(idTicket)
+	if err != nil {
+		return false, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	return key != nil, nil
+}
+
+// ReadTicket returns the toll transaction which charged the ticket of the
+// OBU.
+func (s *SmartContract) ReadTicket(ctx contractapi.TransactionContextInterface, id, spz, country, ticketID string) (*TollTransaction, error) {
+	idTicket, err := ctx.GetStub().CreateCompositeKey(ticketIndex, []string{id, spz, country, ticketID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+	key, err := ctx.GetStub().GetState(idTicket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("the ticket %s does not exist", ticketID)
+	}
+	txJSON, err := ctx.GetStub().GetState(string(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if txJSON == nil {
+		return nil, fmt.Errorf("the toll transaction of the ticket %s does not exist", ticketID)
+	}
+	var tx TollTransaction
+	err = json.Unmarshal(txJSON, &tx)
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// GetObuTransactions returns all trips of the OBU ordered by time.
+func (s *SmartContract) GetObuTransactions(ctx contractapi.TransactionContextInterface, id, spz, country string) ([]*TollTransaction, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(tollTxIndex, []string{id, spz, country})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var txList []*TollTransaction
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var tx TollTransaction
+		err = json.Unmarshal(queryResponse.Value, &tx)
+		if err != nil {
+			return nil, err
+		}
+		txList = append(txList, &tx)
+	}
+
+	return txList, nil
+}
+
+// GetTransactionsByTime returns trips of all OBUs which began within the
+// interval [from, to) ordered by time. Times are in RFC3339.
+func (s *SmartContract) GetTransactionsByTime(ctx contractapi.TransactionContextInterface, from, to string) ([]*TollTransaction, error) {
+	fromTime, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %s: %v", from, err)
+	}
+	toTime, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %s: %v", to, err)
+	}
+	// a key of a trip at to is after the bare time, so it is left out
+	resultsIterator, err := ctx.GetStub().GetStateByRange(
+		txTimePrefix+fromTime.UTC().Format(time.RFC3339), txTimePrefix+toTime.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var txList []*TollTransaction
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		txJSON, err := ctx.GetStub().GetState(string(queryResponse.Value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if txJSON == nil {
+			return nil, fmt.Errorf("the toll transaction %s does not exist", queryResponse.Value)
+		}
+		var tx TollTransaction
+		err = json.Unmarshal(txJSON, &tx)
+		if err != nil {
+			return nil, err
+		}
+		txList = append(txList, &tx)
+	}
+
+	return txList, nil
+}
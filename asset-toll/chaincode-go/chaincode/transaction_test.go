@@ -0,0 +1,125 @@
+package chaincode
+
+import (
+	"testing"
+)
+
+func TestTollTransactions(t *testing.T) {
+	s, ctx := initLedger(t)
+	trips := []struct {
+		obu  []string
+		time string
+		sum  float64
+	}{
+		{obu1, "2023-05-02T12:00:00+02:00", 10},
+		{obu2, "2023-05-02T08:00:00Z", 5},
+		{obu1, "2023-05-01T10:00:00Z", 20},
+		{obu1, "2023-05-03T00:00:00Z", 30},
+	}
+	for _, trip := range trips {
+		_, err := charge(s, ctx.next(), trip.obu[0], trip.obu[1], trip.obu[2], trip.sum,
+			`{"Time": "`+trip.time+`"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	txList, err := s.GetObuTransactions(ctx, obu1[0], obu1[1], obu1[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txList) != 3 || txList[0].Amount != 20 || txList[1].Amount != 10 || txList[2].Amount != 30 {
+		t.Errorf("expected the trips of 20, 10 and 30 in the order of travel, but got %d", len(txList))
+	}
+	if len(txList) > 1 && (txList[1].Time != "2023-05-02T10:00:00Z" || txList[1].Currency != "CZK") {
+		t.Errorf("expected the time in UTC and the currency of the OBU, but got %+v", txList[1])
+	}
+
+	tests := []struct {
+		from, to string
+		amounts  []float64
+	}{
+		{"2023-05-02T00:00:00Z", "2023-05-03T00:00:00Z", []float64{5, 10}},
+		{"2023-05-02T10:00:00Z", "2023-05-03T00:00:01Z", []float64{10, 30}},
+		{"2023-05-02T10:00:00+02:00", "2023-05-02T08:00:00Z", nil},
+		{"2023-01-01T00:00:00Z", "2024-01-01T00:00:00Z", []float64{20, 5, 10, 30}},
+	}
+	for _, test := range tests {
+		txList, err := s.GetTransactionsByTime(ctx, test.from, test.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var amounts []float64
+		for _, tx := range txList {
+			amounts = append(amounts, tx.Amount)
+		}
+		if !equalAmounts(amounts, test.amounts) {
+			t.Errorf("at input [%s, %s) expected %v, but got %v", test.from, test.to, test.amounts, amounts)
+		}
+	}
+	if _, err := s.GetTransactionsByTime(ctx, "yesterday", "2023-05-03T00:00:00Z"); err == nil {
+		t.Errorf("expected an error of an invalid time")
+	}
+}
+
+func TestTicketReplay(t *testing.T) {
+	s, ctx := initLedger(t)
+	tests := []struct {
+		obu    []string
+		ticket string
+		sum    float64
+		err    bool
+	}{
+		{obu1, "t1", 10, false},
+		{obu1, "t1", 10, true},  // replayed ticket
+		{obu2, "t1", 5, false},  // the same ID of another OBU
+		{obu2, "t1", 5, true},   // replayed by the other OBU
+		{obu1, "t2", 20, false}, // next ticket
+	}
+	for i, test := range tests {
+		_, err := charge(s, ctx.next(), test.obu[0], test.obu[1], test.obu[2], test.sum,
+			`{"TicketID": "`+test.ticket+`"}`)
+		if (err != nil) != test.err {
+			t.Errorf("at input %d of ticket %s expected an error %v, but got %v", i, test.ticket, test.err, err)
+		}
+	}
+
+	reads := []struct {
+		obu    []string
+		ticket string
+		sum    float64
+	}{
+		{obu1, "t1", 10},
+		{obu2, "t1", 5},
+		{obu1, "t2", 20},
+	}
+	for _, read := range reads {
+		tx, err := s.ReadTicket(ctx, read.obu[0], read.obu[1], read.obu[2], read.ticket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx.ObuID != read.obu[0] || tx.Amount != read.sum {
+			t.Errorf("at input %s of %s expected the trip of %.2f, but got %.2f of %s", read.ticket, read.obu[0],
+				read.sum, tx.Amount, tx.ObuID)
+		}
+	}
+	exists, err := s.TicketExists(ctx, obu2[0], obu2[1], obu2[2], "t2")
+	if err != nil || exists {
+		t.Errorf("expected the ticket t2 not to be charged to %s, but got %v %v", obu2[0], exists, err)
+	}
+	if _, err := s.ReadTicket(ctx, obu2[0], obu2[1], obu2[2], "t2"); err == nil {
+		t.Errorf("expected an error of the ticket t2 of %s", obu2[0])
+	}
+}
+
+func equalAmounts(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package chaincode
+
+import (
+	"archive/zip"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// zoneinfo is the time zone database of the chaincode, tzdata 2026c as
+// distributed with Go. The time zones of the tariffs are read only from it,
+// not from the zoneinfo of the peer, so every peer prices the time bands
+// alike.
+//
+//go:embed zoneinfo.zip
+var zoneinfo []byte
+
+var locations sync.Map
+
+// loadLocation returns the time zone name of zoneinfo.
+func loadLocation(name string) (*time.Location, error) {
+	if l, ok := locations.Load(name); ok {
+		return l.(*time.Location), nil
+	}
+	r, err := zip.NewReader(bytes.NewReader(zoneinfo), int64(len(zoneinfo)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		l, err := time.LoadLocationFromTZData(name, data)
+		if err != nil {
+			return nil, err
+		}
+		locations.Store(name, l)
+		return l, nil
+	}
+	return nil, fmt.Errorf("unknown time zone %s", name)
+}
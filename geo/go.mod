@@ -0,0 +1,5 @@
+module github.com/Solamil/bp23/geo
+
+go 1.19
+
+require github.com/beevik/etree v1.1.0
@@ -0,0 +1,188 @@
+// Package gpx reads the GPX files of the geographic model and of the driven
+// routes. Waypoints, routes and tracks of all their segments are read, with
+// the elevation and the time of the points where they are given.
+package gpx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// Point is a point of a GPX file, the coordinates in degrees.
+type Point struct {
+	Lat  float64
+	Lon  float64
+	Ele  float64   // meters, 0 if missing
+	Time time.Time // zero if missing
+}
+
+// Route is a <rte> of the file.
+type Route struct {
+	Name   string
+	Points []Point
+}
+
+// Track is a <trk> of the file, its points are in segments.
+type Track struct {
+	Name     string
+	Segments [][]Point
+}
+
+// Extension is an element of the <extensions> of the file.
+type Extension struct {
+	Tag   string
+	Attrs map[string]string
+	Text  string
+}
+
+// File is the content of a GPX file. Title and Version are the root
+// elements the road sections of the geographic model are named and
+// versioned by.
+type File struct {
+	Title      string
+	Version    string
+	Waypoints  []Point
+	Routes     []Route
+	Tracks     []Track
+	Extensions []Extension
+}
+
+// Read reads the GPX file.
+func Read(filename string) (*File, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("error: %s: %w", filename, err)
+	}
+	return g, nil
+}
+
+// Parse reads GPX from r. A point without valid coordinates or with a time
+// which is not RFC3339 is an error, an elevation which cannot be read is
+// left out.
+func Parse(r io.Reader) (*File, error) {
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	root := doc.SelectElement("gpx")
+	if root == nil {
+		return nil, errors.New("not a GPX file")
+	}
+	var g File
+	g.Title = text(root, "title")
+	g.Version = text(root, "version")
+
+	var err error
+	if g.Waypoints, err = points(root.SelectElements("wpt")); err != nil {
+		return nil, err
+	}
+	for _, rte := range root.SelectElements("rte") {
+		route := Route{Name: text(rte, "name")}
+		if route.Points, err = points(rte.SelectElements("rtept")); err != nil {
+			return nil, err
+		}
+		g.Routes = append(g.Routes, route)
+	}
+	for _, trk := range root.SelectElements("trk") {
+		track := Track{Name: text(trk, "name")}
+		for _, seg := range trk.SelectElements("trkseg") {
+			p, err := points(seg.SelectElements("trkpt"))
+			if err != nil {
+				return nil, err
+			}
+			track.Segments = append(track.Segments, p)
+		}
+		g.Tracks = append(g.Tracks, track)
+	}
+	if ext := root.SelectElement("extensions"); ext != nil {
+		for _, e := range ext.ChildElements() {
+			x := Extension{Tag: e.Tag, Attrs: make(map[string]string), Text: strings.TrimSpace(e.Text())}
+			for _, a := range e.Attr {
+				x.Attrs[a.Key] = a.Value
+			}
+			g.Extensions = append(g.Extensions, x)
+		}
+	}
+	return &g, nil
+}
+
+// Segments returns the polylines of the file: the waypoints, each route and
+// each segment of the tracks, in this order. The gap between two segments was
+// not driven, so they are matched and measured each on its own.
+func (g *File) Segments() [][]Point {
+	var segments [][]Point
+	if len(g.Waypoints) > 0 {
+		segments = append(segments, g.Waypoints)
+	}
+	for _, r := range g.Routes {
+		if len(r.Points) > 0 {
+			segments = append(segments, r.Points)
+		}
+	}
+	for _, t := range g.Tracks {
+		for _, seg := range t.Segments {
+			if len(seg) > 0 {
+				segments = append(segments, seg)
+			}
+		}
+	}
+	return segments
+}
+
+func points(elements []*etree.Element) ([]Point, error) {
+	var points []Point
+	for k, e := range elements {
+		var p Point
+		var err error
+		if p.Lat, err = coordinate(e, k, "lat", 90); err != nil {
+			return nil, err
+		}
+		if p.Lon, err = coordinate(e, k, "lon", 180); err != nil {
+			return nil, err
+		}
+		if ele := text(e, "ele"); ele != "" {
+			p.Ele, _ = strconv.ParseFloat(ele, 64)
+		}
+		if t := text(e, "time"); t != "" {
+			if p.Time, err = time.Parse(time.RFC3339, t); err != nil {
+				return nil, fmt.Errorf("<%s> %d: invalid time '%s'", e.Tag, k+1, t)
+			}
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// coordinate reads the attribute of the k-th point, within -max and max
+// degrees.
+func coordinate(e *etree.Element, k int, name string, max float64) (float64, error) {
+	attr := e.SelectAttr(name)
+	if attr == nil {
+		return 0, fmt.Errorf("<%s> %d: missing %s", e.Tag, k+1, name)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(attr.Value), 64)
+	if err != nil || math.IsNaN(v) || v < -max || v > max {
+		return 0, fmt.Errorf("<%s> %d: invalid %s '%s'", e.Tag, k+1, name, attr.Value)
+	}
+	return v, nil
+}
+
+func text(e *etree.Element, tag string) string {
+	if c := e.SelectElement(tag); c != nil {
+		return strings.TrimSpace(c.Text())
+	}
+	return ""
+}
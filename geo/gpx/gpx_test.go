@@ -0,0 +1,94 @@
+package gpx
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const track = `<?xml version="1.0" encoding="utf-8"?>
+<gpx xmlns="http://www.topografix.com/GPX/1/1" version="1.1">
+	<title>D10</title>
+	<version>0.2</version>
+	<wpt lat="50.0" lon="15.0"><name>start</name></wpt>
+	<rte>
+		<name>planned</name>
+		<rtept lat="50.1" lon="15.1"/>
+	</rte>
+	<trk>
+		<name>driven</name>
+		<trkseg>
+			<trkpt lat="50.2" lon="15.2"><ele>310.5</ele><time>2023-05-02T08:00:00Z</time></trkpt>
+			<trkpt lat="50.3" lon="15.3"><time>2023-05-02T08:00:10Z</time></trkpt>
+		</trkseg>
+		<trkseg>
+			<trkpt lat="50.4" lon="-15.4"></trkpt>
+		</trkseg>
+	</trk>
+	<extensions>
+		<section name="D10-1" length="1850"/>
+	</extensions>
+</gpx>`
+
+func TestParse(t *testing.T) {
+	g, err := Parse(strings.NewReader(track))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Title != "D10" || g.Version != "0.2" {
+		t.Errorf("expected D10 0.2, but got %s %s", g.Title, g.Version)
+	}
+	if len(g.Waypoints) != 1 || len(g.Routes) != 1 || g.Routes[0].Name != "planned" ||
+		len(g.Tracks) != 1 || len(g.Tracks[0].Segments) != 2 || g.Tracks[0].Name != "driven" {
+		t.Fatalf("expected a waypoint, a route and a track of two segments, but got %+v", g)
+	}
+
+	segments := g.Segments()
+	lat := [][]float64{{50.0}, {50.1}, {50.2, 50.3}, {50.4}}
+	if len(segments) != len(lat) {
+		t.Fatalf("expected %d segments, but got %d", len(lat), len(segments))
+	}
+	var points []Point
+	for i, seg := range segments {
+		if len(seg) != len(lat[i]) {
+			t.Fatalf("at segment %d expected %d points, but got %d", i, len(lat[i]), len(seg))
+		}
+		for k, p := range seg {
+			if p.Lat != lat[i][k] {
+				t.Errorf("at point %d of segment %d expected latitude %.1f, but got %.1f", k, i, lat[i][k], p.Lat)
+			}
+		}
+		points = append(points, seg...)
+	}
+	start := time.Date(2023, 5, 2, 8, 0, 0, 0, time.UTC)
+	if p := points[2]; p.Ele != 310.5 || !p.Time.Equal(start) {
+		t.Errorf("expected 310.5 m at %s, but got %+v", start, p)
+	}
+	if p := points[3]; p.Ele != 0 || !p.Time.Equal(start.Add(10*time.Second)) {
+		t.Errorf("expected no elevation at %s, but got %+v", start.Add(10*time.Second), p)
+	}
+	if p := points[4]; p.Lon != -15.4 || !p.Time.IsZero() {
+		t.Errorf("expected no time, but got %+v", p)
+	}
+	if len(g.Extensions) != 1 || g.Extensions[0].Tag != "section" || g.Extensions[0].Attrs["length"] != "1850" {
+		t.Errorf("expected the section of the extensions, but got %+v", g.Extensions)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []string{
+		`<gpx><wpt lat="50.0"/></gpx>`,
+		`<gpx><wpt lat="north" lon="15.0"/></gpx>`,
+		`<gpx><trk><trkseg><trkpt lat="50.0" lon="15,2"/></trkseg></trk></gpx>`,
+		`<gpx><rte><rtept lat="91" lon="15.0"/></rte></gpx>`,
+		`<gpx><wpt lat="NaN" lon="15.0"/></gpx>`,
+		`<gpx><wpt lat="50.0" lon="nan"/></gpx>`,
+		`<gpx><trk><trkseg><trkpt lat="50.0" lon="15.0"><time>not a time</time></trkpt></trkseg></trk></gpx>`,
+		`<kml></kml>`,
+	}
+	for _, test := range tests {
+		if _, err := Parse(strings.NewReader(test)); err == nil {
+			t.Errorf("at input %s expected an error", test)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package matching matches a sequence of GPS fixes to the roads of the
+// geographic model. Each fix is projected on the road segments near it and
+// the most likely sequence of roads is chosen by a hidden Markov model, so a
+// single fix close to a road does not put the vehicle on it when the fixes
+// around it are elsewhere, and a fix crossing a road is not taken for one
+// driving along it.
+package matching
+
+import (
+	"math"
+
+	"github.com/Solamil/bp23/geo/spatial"
+)
+
+// Fix is a GPS position in radians.
+type Fix struct {
+	LatRad float64
+	LonRad float64
+}
+
+// Options tune the model, distances are in meters, penalties in the natural
+// logarithm of the probability.
+type Options struct {
+	Radius  float64 // roads are looked for within it of a fix
+	OnRoad  float64 // a fix farther from a road is more likely off it
+	Sigma   float64 // standard deviation of the GPS error
+	Beta    float64 // tolerance of the distance along the road to the distance of the fixes
+	Switch  float64 // penalty of entering, leaving or changing a road
+	Heading float64 // penalty of driving across a road
+}
+
+// DefaultOptions suit a fix every few seconds on the toll roads.
+func DefaultOptions() Options {
+	return Options{Radius: 40, OnRoad: 20, Sigma: 10, Beta: 30, Switch: 4, Heading: 4}
+}
+
+// Result is the match of a fix. Match is valid only on a road.
+type Result struct {
+	spatial.Match
+	OnRoad bool
+}
+
+// Matcher matches the fixes to the roads of the index. It can be shared by
+// goroutines.
+type Matcher struct {
+	index    *spatial.Index
+	chainage [][]float64 // meters along each road to its points
+	opts     Options
+}
+
+// New prepares the matching on the roads of the index.
+func New(index *spatial.Index, opts Options) *Matcher {
+	m := &Matcher{index: index, opts: opts}
+	for _, r := range index.Roads() {
+		c := make([]float64, len(r.LatRad))
+		for j := 1; j < len(c); j++ {
+			c[j] = c[j-1] + spatial.Haversine(r.LatRad[j-1], r.LonRad[j-1], r.LatRad[j], r.LonRad[j])
+		}
+		m.chainage = append(m.chainage, c)
+	}
+	return m
+}
+
+// Chainage is the distance in meters along the road from its first point to
+// the match.
+func (m *Matcher) Chainage(match spatial.Match) float64 {
+	c := m.chainage[match.Road]
+	if match.Segment+1 >= len(c) {
+		return c[match.Segment]
+	}
+	return c[match.Segment] + match.Fraction*(c[match.Segment+1]-c[match.Segment])
+}
+
+// state is a candidate of a fix, the last one of each fix is off the roads.
+type state struct {
+	match spatial.Match
+	on    bool
+	score float64
+	prev  int
+}
+
+// Match returns the most likely match of each fix by the Viterbi algorithm.
+func (m *Matcher) Match(fixes []Fix) []Result {
+	if len(fixes) == 0 {
+		return nil
+	}
+	steps := make([][]state, len(fixes))
+	for t, f := range fixes {
+		for _, c := range m.index.Within(f.LatRad, f.LonRad, m.opts.Radius) {
+			s := state{match: c, on: true, score: m.emission(c.Distance)}
+			if t > 0 {
+				s.score += m.heading(fixes[t-1], f, c)
+			}
+			steps[t] = append(steps[t], s)
+		}
+		steps[t] = append(steps[t], state{score: m.emission(m.opts.OnRoad)})
+		if t == 0 {
+			continue
+		}
+		moved := spatial.Haversine(fixes[t-1].LatRad, fixes[t-1].LonRad, f.LatRad, f.LonRad)
+		for k := range steps[t] {
+			best, prev := math.Inf(-1), 0
+			for l, p := range steps[t-1] {
+				if s := p.score + m.transition(p, steps[t][k], moved); s > best {
+					best, prev = s, l
+				}
+			}
+			steps[t][k].score += best
+			steps[t][k].prev = prev
+		}
+	}
+
+	last := steps[len(steps)-1]
+	k := 0
+	for l := range last {
+		if last[l].score > last[k].score {
+			k = l
+		}
+	}
+	results := make([]Result, len(fixes))
+	for t := len(steps) - 1; t >= 0; t-- {
+		s := steps[t][k]
+		if s.on {
+			results[t] = Result{Match: s.match, OnRoad: true}
+		}
+		k = s.prev
+	}
+	return results
+}
+
+// emission is the likelihood of a fix at the distance from the road.
+func (m *Matcher) emission(distance float64) float64 {
+	d := distance / m.opts.Sigma
+	return -0.5 * d * d
+}
+
+// transition is the likelihood of moving between the candidates of two
+// consecutive fixes the distance apart. Along a road the distance of the
+// fixes is close to the distance along the road.
+func (m *Matcher) transition(from, to state, moved float64) float64 {
+	switch {
+	case !from.on && !to.on:
+		return 0
+	case !from.on || !to.on || from.match.Road != to.match.Road:
+		return -m.opts.Switch
+	}
+	along := math.Abs(m.Chainage(to.match) - m.Chainage(from.match))
+	return -math.Abs(along-moved) / m.opts.Beta
+}
+
+// heading penalizes the candidate by the angle between the road and the
+// movement of the vehicle, nothing along the road in either direction and the
+// most across it. A movement within the GPS error has no heading.
+func (m *Matcher) heading(from, to Fix, c spatial.Match) float64 {
+	if spatial.Haversine(from.LatRad, from.LonRad, to.LatRad, to.LonRad) < 2*m.opts.Sigma {
+		return 0
+	}
+	r := m.index.Roads()[c.Road]
+	k := c.Segment + 1
+	if k >= len(r.LatRad) {
+		return 0
+	}
+	cos := math.Cos(to.LatRad)
+	mx, my := (to.LonRad-from.LonRad)*cos, to.LatRad-from.LatRad
+	rx, ry := (r.LonRad[k]-r.LonRad[c.Segment])*cos, r.LatRad[k]-r.LatRad[c.Segment]
+	norm := math.Hypot(mx, my) * math.Hypot(rx, ry)
+	if norm == 0 {
+		return 0
+	}
+	return -m.opts.Heading * (1 - math.Abs(mx*rx+my*ry)/norm)
+}
@@ -0,0 +1,171 @@
+package matching
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Solamil/bp23/geo/gpx"
+	"github.com/Solamil/bp23/geo/spatial"
+)
+
+const lat0, lon0 = 0.88, 0.26
+
+// at is the position the meters north and east of lat0, lon0.
+func at(north, east float64) Fix {
+	return Fix{
+		LatRad: lat0 + north/spatial.EarthRadius,
+		LonRad: lon0 + east/spatial.EarthRadius/math.Cos(lat0),
+	}
+}
+
+// straight is a road of the points 100 m apart to the east, length meters
+// long.
+func straight(north, length float64) spatial.Road {
+	var r spatial.Road
+	for east := 0.0; east <= length; east += 100 {
+		f := at(north, east)
+		r.LatRad = append(r.LatRad, f.LatRad)
+		r.LonRad = append(r.LonRad, f.LonRad)
+	}
+	return r
+}
+
+func onRoad(results []Result) []bool {
+	on := make([]bool, len(results))
+	for k, r := range results {
+		on[k] = r.OnRoad
+	}
+	return on
+}
+
+func TestMatch(t *testing.T) {
+	m := New(spatial.New([]spatial.Road{straight(0, 1000)}, 0), DefaultOptions())
+	tests := []struct {
+		name  string
+		fixes []Fix
+		on    []bool
+	}{
+		{
+			// between the points of the road, far from any of them
+			"along the road",
+			[]Fix{at(5, 50), at(-5, 150), at(5, 250), at(-5, 350)},
+			[]bool{true, true, true, true},
+		},
+		{
+			"a fix farther than the threshold between fixes on the road",
+			[]Fix{at(2, 100), at(3, 200), at(30, 300), at(2, 400), at(-2, 500)},
+			[]bool{true, true, true, true, true},
+		},
+		{
+			// a local road touching the toll road for a single fix
+			"a local road close to the road once",
+			[]Fix{at(100, 0), at(60, 100), at(15, 200), at(60, 300), at(100, 400)},
+			[]bool{false, false, false, false, false},
+		},
+		{
+			"across the road",
+			[]Fix{at(-60, 500), at(-30, 500), at(-5, 500), at(20, 500), at(45, 500)},
+			[]bool{false, false, false, false, false},
+		},
+		{
+			"entering the road",
+			[]Fix{at(120, -100), at(60, -50), at(10, 0), at(2, 100), at(0, 200), at(-1, 300)},
+			[]bool{false, false, true, true, true, true},
+		},
+	}
+	for _, test := range tests {
+		if on := onRoad(m.Match(test.fixes)); !equal(on, test.on) {
+			t.Errorf("%s: expected %v, but got %v", test.name, test.on, on)
+		}
+	}
+}
+
+func TestMatchParallel(t *testing.T) {
+	// the toll road and a road parallel to it 40 m north
+	m := New(spatial.New([]spatial.Road{straight(0, 1000), straight(40, 1000)}, 0), DefaultOptions())
+	var fixes []Fix
+	for east := 50.0; east < 1000; east += 100 {
+		// closer to the toll road at times
+		fixes = append(fixes, at(28+4*math.Sin(east), east))
+	}
+	for k, r := range m.Match(fixes) {
+		if !r.OnRoad || r.Road != 1 {
+			t.Errorf("at fix %d expected the parallel road, but got %+v", k, r)
+		}
+	}
+}
+
+func TestChainage(t *testing.T) {
+	ix := spatial.New([]spatial.Road{straight(0, 1000)}, 0)
+	m := New(ix, DefaultOptions())
+	f := at(5, 250)
+	match, _ := ix.Nearest(f.LatRad, f.LonRad, 20)
+	if c := m.Chainage(match); math.Abs(c-250) > 0.5 {
+		t.Errorf("expected 250 m, but got %.2f", c)
+	}
+}
+
+// The OBU route of obu/obu1.gpx drives the whole of both sections of the
+// model in server/model.
+func TestMatchModel(t *testing.T) {
+	var roads []spatial.Road
+	for _, f := range []string{"../../server/model/i35.gpx", "../../server/model/d10.gpx"} {
+		roads = append(roads, read(t, f))
+	}
+	m := New(spatial.New(roads, 0), DefaultOptions())
+
+	tests := []struct {
+		file     string
+		vertices []int // matched points of each road
+	}{
+		{"../../obu/obu1.gpx", []int{10, 10}},
+		{"../../obu/test-data/obu1.gpx", []int{0, 0}},
+	}
+	for _, test := range tests {
+		route := read(t, test.file)
+		var fixes []Fix
+		for k := range route.LatRad {
+			fixes = append(fixes, Fix{LatRad: route.LatRad[k], LonRad: route.LonRad[k]})
+		}
+		seen := make([]map[int]bool, len(roads))
+		for i := range seen {
+			seen[i] = make(map[int]bool)
+		}
+		for _, r := range m.Match(fixes) {
+			if r.OnRoad {
+				seen[r.Road][r.Vertex] = true
+			}
+		}
+		for i := range roads {
+			if len(seen[i]) != test.vertices[i] {
+				t.Errorf("%s: expected %d points of road %d, but got %d", test.file, test.vertices[i], i, len(seen[i]))
+			}
+		}
+	}
+}
+
+func read(t *testing.T, filename string) spatial.Road {
+	t.Helper()
+	g, err := gpx.Read(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r spatial.Road
+	for _, p := range g.Segments()[0] {
+		r.LatRad = append(r.LatRad, p.Lat*math.Pi/180)
+		r.LonRad = append(r.LonRad, p.Lon*math.Pi/180)
+	}
+	return r
+}
+
+func equal(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+// Package spatial indexes the road geometry of the geographic model for the
+// map matching. The segments between the consecutive points of the roads are
+// kept in a grid of square cells, so a query looks at the few segments near
+// the position instead of the whole model.
+package spatial
+
+import "math"
+
+// EarthRadius is the radius of the Earth in meters.
+const EarthRadius = 6371000.0
+
+// DefaultCellSize is the side of a cell of the grid in meters.
+const DefaultCellSize = 250
+
+// Road is the polyline of a road section, the coordinates in radians.
+type Road struct {
+	LatRad []float64
+	LonRad []float64
+}
+
+// Match is a segment of a road near a position.
+type Match struct {
+	Road     int     // index of the road
+	Segment  int     // the segment from the point Segment to Segment+1 of the road
+	Vertex   int     // the point of the segment nearer to the position
+	Fraction float64 // of the segment from its start to the projection of the position
+	Distance float64 // from the position to the segment in meters
+	LatRad   float64 // projection of the position on the segment
+	LonRad   float64
+}
+
+type cell struct{ y, x int32 }
+
+type segment struct{ road, j int32 }
+
+// Index is a grid of the road segments. It is not modified by the queries and
+// can be shared by goroutines.
+type Index struct {
+	roads []Road
+	size  float64 // of a cell in meters
+	cos   float64 // of the latitude the width of the cells is computed by
+	cells map[cell][]segment
+}
+
+// New indexes the roads in cells of the size in meters, DefaultCellSize if
+// it is not positive. A road of a single point is indexed as a segment of
+// zero length.
+func New(roads []Road, size float64) *Index {
+	if size <= 0 {
+		size = DefaultCellSize
+	}
+	ix := &Index{roads: roads, size: size, cos: 1, cells: make(map[cell][]segment)}
+	// the cells are at least size wide up to the northernmost point
+	for _, r := range roads {
+		for _, lat := range r.LatRad {
+			if c := math.Cos(lat); c < ix.cos {
+				ix.cos = math.Max(c, 0.01)
+			}
+		}
+	}
+	for i, r := range roads {
+		for j := 0; j < len(r.LatRad); j++ {
+			k := j + 1
+			if k == len(r.LatRad) {
+				if j > 0 {
+					break
+				}
+				k = j
+			}
+			lo, hi := ix.cell(r.LatRad[j], r.LonRad[j]), ix.cell(r.LatRad[k], r.LonRad[k])
+			for y := min32(lo.y, hi.y); y <= max32(lo.y, hi.y); y++ {
+				for x := min32(lo.x, hi.x); x <= max32(lo.x, hi.x); x++ {
+					c := cell{y, x}
+					ix.cells[c] = append(ix.cells[c], segment{int32(i), int32(j)})
+				}
+			}
+		}
+	}
+	return ix
+}
+
+// Roads returns the indexed roads.
+func (ix *Index) Roads() []Road {
+	return ix.roads
+}
+
+// Nearest returns the segment nearest to the position within the radius in
+// meters.
+func (ix *Index) Nearest(latRad, lonRad, radius float64) (Match, bool) {
+	var best Match
+	found := false
+	ix.visit(latRad, lonRad, radius, func(s segment) {
+		m := ix.project(s, latRad, lonRad)
+		if m.Distance <= radius && (!found || m.Distance < best.Distance) {
+			best, found = m, true
+		}
+	})
+	return best, found
+}
+
+// Within returns the segments within the radius in meters of the position,
+// the nearest of each road only, ordered by the distance.
+func (ix *Index) Within(latRad, lonRad, radius float64) []Match {
+	nearest := make(map[int]Match)
+	ix.visit(latRad, lonRad, radius, func(s segment) {
+		m := ix.project(s, latRad, lonRad)
+		if old, ok := nearest[m.Road]; m.Distance <= radius && (!ok || m.Distance < old.Distance) {
+			nearest[m.Road] = m
+		}
+	})
+	matches := make([]Match, 0, len(nearest))
+	for _, m := range nearest {
+		matches = append(matches, m)
+	}
+	// few roads meet at a place, an insertion sort is enough
+	for i := 1; i < len(matches); i++ {
+		for k := i; k > 0 && less(matches[k], matches[k-1]); k-- {
+			matches[k], matches[k-1] = matches[k-1], matches[k]
+		}
+	}
+	return matches
+}
+
+func less(a, b Match) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	return a.Road < b.Road
+}
+
+// visit calls f for the segments of the cells within the radius of the
+// position, a segment of more cells may be visited more times.
+func (ix *Index) visit(latRad, lonRad, radius float64, f func(segment)) {
+	dLat := radius / EarthRadius
+	dLon := radius / (EarthRadius * ix.cos)
+	lo, hi := ix.cell(latRad-dLat, lonRad-dLon), ix.cell(latRad+dLat, lonRad+dLon)
+	for y := lo.y; y <= hi.y; y++ {
+		for x := lo.x; x <= hi.x; x++ {
+			for _, s := range ix.cells[cell{y, x}] {
+				f(s)
+			}
+		}
+	}
+}
+
+func (ix *Index) cell(latRad, lonRad float64) cell {
+	return cell{
+		y: int32(math.Floor(latRad * EarthRadius / ix.size)),
+		x: int32(math.Floor(lonRad * EarthRadius * ix.cos / ix.size)),
+	}
+}
+
+// project projects the position on the segment in the plane tangent at the
+// position, which is precise enough within the few hundred meters of a cell.
+func (ix *Index) project(s segment, latRad, lonRad float64) Match {
+	r := ix.roads[s.road]
+	j := int(s.j)
+	k := j + 1
+	if k == len(r.LatRad) {
+		k = j
+	}
+	cos := math.Cos(latRad)
+	ax, ay := (r.LonRad[j]-lonRad)*cos, r.LatRad[j]-latRad
+	bx, by := (r.LonRad[k]-lonRad)*cos, r.LatRad[k]-latRad
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+	}
+	m := Match{Road: int(s.road), Segment: j, Vertex: j, Fraction: t}
+	if t > 0.5 {
+		m.Vertex = k
+	}
+	m.LatRad = r.LatRad[j] + t*(r.LatRad[k]-r.LatRad[j])
+	m.LonRad = r.LonRad[j] + t*(r.LonRad[k]-r.LonRad[j])
+	m.Distance = Haversine(latRad, lonRad, m.LatRad, m.LonRad)
+	return m
+}
+
+// Haversine is the distance in meters between the points in radians.
+func Haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	dlat := lat2 - lat1
+	dlon := lon2 - lon1
+	a := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
+	return EarthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func min32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
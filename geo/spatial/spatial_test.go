@@ -0,0 +1,157 @@
+package spatial
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// network has roads of n points 100 m apart, wavy and crossing each other,
+// around 50°N 15°E.
+func network(roads, n int) []Road {
+	rnd := rand.New(rand.NewSource(1))
+	step := 100.0 / EarthRadius
+	var rs []Road
+	for i := 0; i < roads; i++ {
+		lat := 50*math.Pi/180 + rnd.Float64()*0.02
+		lon := 15*math.Pi/180 + rnd.Float64()*0.03
+		heading := rnd.Float64() * 2 * math.Pi
+		var r Road
+		for j := 0; j < n; j++ {
+			r.LatRad = append(r.LatRad, lat)
+			r.LonRad = append(r.LonRad, lon)
+			heading += (rnd.Float64() - 0.5) * 0.2
+			lat += step * math.Cos(heading)
+			lon += step * math.Sin(heading) / math.Cos(lat)
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// linearNearest is the nearest point of all the roads, as the OBU found it
+// before the index.
+func linearNearest(roads []Road, latRad, lonRad float64) (int, int, float64) {
+	bi, bj, best := 0, 0, math.Inf(1)
+	for i, r := range roads {
+		for j := range r.LatRad {
+			if d := Haversine(latRad, lonRad, r.LatRad[j], r.LonRad[j]); d < best {
+				bi, bj, best = i, j, d
+			}
+		}
+	}
+	return bi, bj, best
+}
+
+func TestNearest(t *testing.T) {
+	// a road of three points 100 m apart to the east
+	step := 100.0 / EarthRadius
+	lat, lon := 0.88, 0.26
+	road := Road{
+		LatRad: []float64{lat, lat, lat},
+		LonRad: []float64{lon, lon + step/math.Cos(lat), lon + 2*step/math.Cos(lat)},
+	}
+	ix := New([]Road{road}, 50)
+	tests := []struct {
+		north, east float64 // meters from the first point
+		segment     int
+		vertex      int
+		distance    float64
+		ok          bool
+	}{
+		{0, 0, 0, 0, 0, true},
+		{15, 40, 0, 0, 15, true},
+		{-15, 60, 0, 1, 15, true},
+		{5, 170, 1, 2, 5, true},
+		{0, 230, 1, 2, 30, false},
+		{0, -10, 0, 0, 10, true},
+		{25, 100, 0, 1, 25, false},
+	}
+	for _, test := range tests {
+		pLat := lat + test.north/EarthRadius
+		pLon := lon + test.east/EarthRadius/math.Cos(lat)
+		m, ok := ix.Nearest(pLat, pLon, 20)
+		if ok != test.ok {
+			t.Errorf("at %.0f m N %.0f m E expected %v, but got %v", test.north, test.east, test.ok, ok)
+			continue
+		}
+		if ok && (m.Segment != test.segment || m.Vertex != test.vertex || math.Abs(m.Distance-test.distance) > 0.1) {
+			t.Errorf("at %.0f m N %.0f m E expected segment %d vertex %d at %.1f m, but got %+v",
+				test.north, test.east, test.segment, test.vertex, test.distance, m)
+		}
+	}
+}
+
+func TestNearestLinear(t *testing.T) {
+	roads := network(20, 200)
+	ix := New(roads, 0)
+	rnd := rand.New(rand.NewSource(2))
+	for k := 0; k < 2000; k++ {
+		r := roads[rnd.Intn(len(roads))]
+		j := rnd.Intn(len(r.LatRad))
+		lat := r.LatRad[j] + (rnd.Float64()-0.5)*60/EarthRadius
+		lon := r.LonRad[j] + (rnd.Float64()-0.5)*60/EarthRadius
+		_, _, vertex := linearNearest(roads, lat, lon)
+		m, ok := ix.Nearest(lat, lon, 1000)
+		if !ok {
+			t.Fatalf("expected a segment near %.6f, %.6f", lat, lon)
+		}
+		// a segment is never farther than its nearest vertex
+		if m.Distance > vertex+1e-6 {
+			t.Errorf("expected at most %.3f m, but got %+v", vertex, m)
+		}
+		if within := ix.Within(lat, lon, 1000); len(within) == 0 || within[0].Distance != m.Distance {
+			t.Errorf("expected the nearest first, but got %+v and %+v", m, within)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	// two parallel roads 30 m apart
+	step := 100.0 / EarthRadius
+	var roads []Road
+	for i := 0; i < 2; i++ {
+		lat := 0.88 + float64(i)*30/EarthRadius
+		roads = append(roads, Road{LatRad: []float64{lat, lat}, LonRad: []float64{0.26, 0.26 + step}})
+	}
+	ix := New(roads, 0)
+	lat := 0.88 + 10/EarthRadius
+	m := ix.Within(lat, 0.26+step/2, 25)
+	if len(m) != 2 || m[0].Road != 0 || m[1].Road != 1 {
+		t.Errorf("expected both roads, the first nearer, but got %+v", m)
+	}
+	if m := ix.Within(lat, 0.26+step/2, 15); len(m) != 1 || m[0].Road != 0 {
+		t.Errorf("expected the first road only, but got %+v", m)
+	}
+}
+
+func benchmarkQueries(roads []Road, n int) [][2]float64 {
+	rnd := rand.New(rand.NewSource(3))
+	q := make([][2]float64, n)
+	for k := range q {
+		r := roads[rnd.Intn(len(roads))]
+		j := rnd.Intn(len(r.LatRad))
+		q[k] = [2]float64{r.LatRad[j] + (rnd.Float64()-0.5)*60/EarthRadius, r.LonRad[j] + (rnd.Float64()-0.5)*60/EarthRadius}
+	}
+	return q
+}
+
+// 100 roads of 2000 points, 200 000 points in all
+func BenchmarkNearest(b *testing.B) {
+	roads := network(100, 2000)
+	ix := New(roads, 0)
+	q := benchmarkQueries(roads, 1024)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		p := q[n%len(q)]
+		ix.Nearest(p[0], p[1], 20)
+	}
+}
+
+func BenchmarkNew(b *testing.B) {
+	roads := network(100, 2000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		New(roads, 0)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// config of the OBU, read from a JSON file and overridden by the flags.
+type config struct {
+	Server         string   `json:"server"`
+	CacheDir       string   `json:"cacheDir"`
+	Threshold      float64  `json:"threshold"`      // meters to a toll road to be on it
+	Timeout        duration `json:"timeout"`        // of a whole request to the server
+	ConnectTimeout duration `json:"connectTimeout"` // of connecting to the server
+	PollInterval   duration `json:"pollInterval"`   // between status requests of an accepted ticket
+	PollTimeout    duration `json:"pollTimeout"`    // of waiting for the ticket to be charged
+	RetryDelay     duration `json:"retryDelay"`     // of the first retry of an unsent ticket
+	MaxRetryDelay  duration `json:"maxRetryDelay"`  // the delay doubles by every retry up to it
+	Identity       string   `json:"identity"`       // JSON file of the OBU
+	Gpx            string   `json:"gpx"`            // driven route
+	Mode           string   `json:"mode"`           // "once" for one ticket of the GPX, "stream" for a running OBU
+	Source         string   `json:"source"`         // of the positions in stream mode, see SOURCES
+	Speed          float64  `json:"speed"`          // of the replayed GPX, 1 is real time
+	ClockStart     string   `json:"clockStart"`     // RFC3339 start of the simulated clock, now if empty
+	VehicleSpeed   float64  `json:"vehicleSpeed"`   // km/h of the simulated clock
+	TicketInterval duration `json:"ticketInterval"` // a ticket is sent at least this often on a toll road
+	LeaveAfter     int      `json:"leaveAfter"`     // positions off a road section to have left it
+	MatchWindow    int      `json:"matchWindow"`    // positions a position of the stream is matched with
+}
+
+// Modes of the OBU.
+const (
+	MODE_ONCE   = "once"
+	MODE_STREAM = "stream"
+)
+
+// SOURCES are the sources of the positions in stream mode, besides
+// udp://host:port and tcp://host:port receiving NMEA sentences.
+const (
+	SOURCE_GPX  = "gpx"  // the GPX replayed
+	SOURCE_NMEA = "nmea" // NMEA sentences on the standard input
+)
+
+// duration is a time.Duration written as "2s" in JSON and flags.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+const CONFIG_FILE = "config.json"
+
+func defaultConfig() config {
+	return config{
+		Server:         URL_SERVER,
+		CacheDir:       CACHE_DIR,
+		Threshold:      THRESHOLD,
+		Timeout:        duration(10 * time.Second),
+		ConnectTimeout: duration(2 * time.Second),
+		PollInterval:   duration(time.Second),
+		PollTimeout:    duration(30 * time.Second),
+		RetryDelay:     duration(5 * time.Second),
+		MaxRetryDelay:  duration(time.Hour),
+		Mode:           MODE_ONCE,
+		Source:         SOURCE_GPX,
+		Speed:          1,
+		VehicleSpeed:   80,
+		TicketInterval: duration(5 * time.Minute),
+		LeaveAfter:     3,
+		MatchWindow:    5,
+	}
+}
+
+// loadConfig reads the file given by -config, a missing default file is not
+// an error. The identity and the route are <name>.json and <name>.gpx unless
+// they are given.
+func loadConfig(args []string) (config, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("obu", flag.ContinueOnError)
+	configFile := fs.String("config", CONFIG_FILE, "Configuration file.")
+	obuName := fs.String("name", OBU_NAME, "OBU name")
+	var flags config
+	fs.StringVar(&flags.Server, "server", "", "URL of the server.")
+	fs.StringVar(&flags.CacheDir, "cache", "", "Directory of the cached geographic model.")
+	fs.Float64Var(&flags.Threshold, "threshold", 0, "Distance in meters to a toll road to be on it.")
+	fs.Var(&flags.Timeout, "timeout", "Timeout of a request to the server, e.g. 10s.")
+	fs.Var(&flags.ConnectTimeout, "connect-timeout", "Timeout of connecting to the server.")
+	fs.Var(&flags.PollInterval, "poll-interval", "Interval of asking for the status of a sent ticket.")
+	fs.Var(&flags.PollTimeout, "poll-timeout", "How long to wait for a sent ticket to be charged.")
+	fs.Var(&flags.RetryDelay, "retry-delay", "Delay of the first retry of an unsent ticket.")
+	fs.Var(&flags.MaxRetryDelay, "max-retry-delay", "Longest delay between retries of an unsent ticket.")
+	fs.StringVar(&flags.Identity, "identity", "", "JSON file of the OBU, <name>.json by default.")
+	fs.StringVar(&flags.Gpx, "gpx", "", "GPX file of the driven route, <name>.gpx by default.")
+	fs.StringVar(&flags.Mode, "mode", "", "\"once\" sends one ticket of the GPX, \"stream\" runs on a stream of positions.")
+	fs.StringVar(&flags.Source, "source", "", "Positions in stream mode, \"gpx\", \"nmea\" on stdin, udp://host:port or tcp://host:port.")
+	fs.Float64Var(&flags.Speed, "speed", 0, "Speed of the replayed GPX, e.g. 10 for ten times the real time.")
+	fs.StringVar(&flags.ClockStart, "clock-start", "", "Time of the first GPX point without <time>, RFC3339, now by default.")
+	fs.Float64Var(&flags.VehicleSpeed, "vehicle-speed", 0, "Speed in km/h of the simulated clock for GPX points without <time>.")
+	fs.Var(&flags.TicketInterval, "ticket-interval", "A ticket is sent at least this often on a toll road.")
+	fs.IntVar(&flags.LeaveAfter, "leave-after", 0, "Number of positions off a road section to have left it.")
+	fs.IntVar(&flags.MatchWindow, "match-window", 0, "Number of positions of the stream matched together, a position is decided by those after it.")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	data, err := os.ReadFile(*configFile)
+	if err != nil && !(os.IsNotExist(err) && *configFile == CONFIG_FILE) {
+		return c, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("error: %s: %v", *configFile, err)
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			c.Server = flags.Server
+		case "cache":
+			c.CacheDir = flags.CacheDir
+		case "threshold":
+			c.Threshold = flags.Threshold
+		case "timeout":
+			c.Timeout = flags.Timeout
+		case "connect-timeout":
+			c.ConnectTimeout = flags.ConnectTimeout
+		case "poll-interval":
+			c.PollInterval = flags.PollInterval
+		case "poll-timeout":
+			c.PollTimeout = flags.PollTimeout
+		case "retry-delay":
+			c.RetryDelay = flags.RetryDelay
+		case "max-retry-delay":
+			c.MaxRetryDelay = flags.MaxRetryDelay
+		case "identity":
+			c.Identity = flags.Identity
+		case "gpx":
+			c.Gpx = flags.Gpx
+		case "mode":
+			c.Mode = flags.Mode
+		case "source":
+			c.Source = flags.Source
+		case "speed":
+			c.Speed = flags.Speed
+		case "clock-start":
+			c.ClockStart = flags.ClockStart
+		case "vehicle-speed":
+			c.VehicleSpeed = flags.VehicleSpeed
+		case "ticket-interval":
+			c.TicketInterval = flags.TicketInterval
+		case "leave-after":
+			c.LeaveAfter = flags.LeaveAfter
+		case "match-window":
+			c.MatchWindow = flags.MatchWindow
+		}
+	})
+	if c.Identity == "" {
+		c.Identity = fmt.Sprintf("%s.json", *obuName)
+	}
+	if c.Gpx == "" {
+		c.Gpx = fmt.Sprintf("%s.gpx", *obuName)
+	}
+	return c, c.validate()
+}
+
+// clockStart is the time of the simulated clock at the first point of a
+// GPX without times.
+func (c *config) clockStart() time.Time {
+	if t, err := time.Parse(time.RFC3339, c.ClockStart); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+func (c *config) validate() error {
+	var problems []string
+	if u, err := url.Parse(c.Server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("invalid server URL '%s'", c.Server))
+	}
+	c.Server = strings.TrimSuffix(c.Server, "/")
+	if c.CacheDir == "" {
+		problems = append(problems, "missing cache directory")
+	}
+	if c.Threshold <= 0 {
+		problems = append(problems, "threshold has to be positive")
+	}
+	if c.Timeout <= 0 || c.ConnectTimeout <= 0 || c.PollInterval <= 0 || c.PollTimeout < 0 {
+		problems = append(problems, "timeouts have to be positive")
+	}
+	if c.RetryDelay <= 0 || c.MaxRetryDelay < c.RetryDelay {
+		problems = append(problems, "invalid retry delays")
+	}
+	if c.Mode != MODE_ONCE && c.Mode != MODE_STREAM {
+		problems = append(problems, fmt.Sprintf("unknown mode '%s'", c.Mode))
+	}
+	if c.Source != SOURCE_GPX && c.Source != SOURCE_NMEA && !strings.HasPrefix(c.Source, "udp://") && !strings.HasPrefix(c.Source, "tcp://") {
+		problems = append(problems, fmt.Sprintf("unknown source '%s'", c.Source))
+	}
+	if c.Speed <= 0 || c.VehicleSpeed <= 0 || c.TicketInterval <= 0 || c.LeaveAfter < 1 || c.MatchWindow < 1 {
+		problems = append(problems, "speeds, ticket interval, leave-after and match-window have to be positive")
+	}
+	if _, err := time.Parse(time.RFC3339, c.ClockStart); c.ClockStart != "" && err != nil {
+		problems = append(problems, fmt.Sprintf("invalid clock start: %v", err))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("error: invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ module github.com/Solamil/bp23
 
 go 1.19
 
-require (
-	github.com/beevik/etree v1.1.0
-)
+require github.com/Solamil/bp23/geo v0.0.0
+
+require github.com/beevik/etree v1.1.0 // indirect
+
+replace github.com/Solamil/bp23/geo => ../geo
@@ -4,20 +4,26 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/beevik/etree"
+	"github.com/Solamil/bp23/geo/gpx"
+	"github.com/Solamil/bp23/geo/matching"
+	"github.com/Solamil/bp23/geo/spatial"
 )
 
 type onBoardUnit struct {
@@ -33,13 +39,31 @@ type onBoardUnit struct {
 }
 
 type wptRecords struct {
-	LatRad    []float64 `json:"latRad"`
-	LonRad    []float64 `json:"lonRad"`
-	Distances []float64 `json:"distances"`
-	Version   string    `json:"version"`
-	Len       int       `json:"len"`
-	Name      string    `json:"name"`
-	Checksum  string    `json:"checksum"`
+	LatRad    []float64         `json:"latRad"`
+	LonRad    []float64         `json:"lonRad"`
+	Distances []float64         `json:"distances"`
+	Version   string            `json:"version"`
+	Len       int               `json:"len"`
+	Name      string            `json:"name"`
+	Class     string            `json:"class"`
+	Checksum  string            `json:"checksum"`
+	Time      []time.Time       `json:"-"` // of the points of a driven route
+	Starts    []int             `json:"-"` // first points of its segments
+	Sections  []chargingSection `json:"sections,omitempty"`
+}
+
+// chargingSection is a toll section of the road between two gantries, see
+// the server.
+type chargingSection struct {
+	Name       string  `json:"name"`
+	FromGantry string  `json:"fromGantry"`
+	ToGantry   string  `json:"toGantry"`
+	Length     float64 `json:"length"`
+	Class      string  `json:"class"`
+	Direction  string  `json:"direction"`
+	Start      int     `json:"start"`
+	End        int     `json:"end"`
+	Gantry     int     `json:"gantry"`
 }
 
 type polygon struct {
@@ -48,11 +72,66 @@ type polygon struct {
 	Time []string `json:"time"`
 }
 
+// repeats reports whether the point j of the road i is the last check-point.
+// A slow vehicle stays at one point for several fixes, a point driven again
+// after a U-turn is a new check-point.
+func (p *polygon) repeats(i, j int) bool {
+	n := len(p.I)
+	return n > 0 && p.I[n-1] == i && p.J[n-1] == j
+}
+
 type ticket struct {
+	Id          string      `json:"id"` // nonce, a resent ticket is charged only once
 	Obu         onBoardUnit `json:"obu"`
 	CheckPoints polygon     `json:"polygon"`
+	Model       string      `json:"model"` // checksum of the geographic model of the check-points
 }
 
+// response is the envelope of every answer of the server, Code is set for
+// an error and Data for a success.
+type response struct {
+	Status  int             `json:"status"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// serverError is an error answered by the server.
+type serverError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("server answered %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// ticketResult is the status of a ticket, the server charges an accepted
+// ticket in the background.
+type ticketResult struct {
+	TicketID    string      `json:"ticketId"`
+	State       string      `json:"state"` // pending, charged, held or failed
+	Obu         onBoardUnit `json:"obu"`
+	Transaction struct {
+		TxID     string  `json:"TxID"`
+		Amount   float64 `json:"Amount"`
+		Currency string  `json:"Currency"`
+	} `json:"transaction"`
+	Duplicate bool   `json:"duplicate"`
+	Attempts  int    `json:"attempts"`
+	Code      string `json:"code"`
+	Error     string `json:"error"`
+}
+
+// States of a ticket.
+const (
+	TICKET_PENDING = "pending"
+	TICKET_CHARGED = "charged"
+	TICKET_HELD    = "held"
+	TICKET_FAILED  = "failed"
+)
+
 const CACHE_DIR = "cache"
 const URL_SERVER = "http://localhost:8905"
 const EARTH_RADIUS = 6371000 // Radius of the Earth in meters
@@ -60,89 +139,181 @@ const THRESHOLD = 20         // Threshold for algorithm in meters
 const OBU_NAME = "obu1"
 
 var model []wptRecords
+
+// modelChecksum identifies the model in use to the server, which charges a
+// ticket only by the model its check-points refer to.
+var modelChecksum string
+var index = spatial.New(nil, spatial.DefaultCellSize)
+var matcher = matching.New(index, matching.DefaultOptions())
 var route wptRecords
 var obu onBoardUnit
+var cfg = defaultConfig()
+var client = newClient(cfg)
 
 func main() {
-	obuName := flag.String("name", OBU_NAME, "OBU name")
-	flag.Parse()
-
-	err := readJson(fmt.Sprintf("%s.json", *obuName), &obu)
+	var err error
+	cfg, err = loadConfig(os.Args[1:])
 	if err != nil {
-		return
+		if err != flag.ErrHelp {
+			fmt.Println(err)
+		}
+		os.Exit(2)
 	}
-	err = initObu(URL_SERVER, &obu)
+	client = newClient(cfg)
+
+	err = readJson(cfg.Identity, &obu)
 	if err != nil {
-		fmt.Printf("Cannot initialized OBU with the server %s\n%v", URL_SERVER, err)
 		return
 	}
+	// tickets left unsent by the last run are tried again at once
+	reportBacklog()
+	flushOutbox(cfg.Server, time.Now(), true, true)
 
-	err = readGpx(fmt.Sprintf("%s.gpx", *obuName), &route)
+	err = initObu(cfg.Server, &obu)
 	if err != nil {
-		fmt.Printf("%v", err)
+		fmt.Printf("Cannot initialized OBU with the server %s, using %s\n%v\n", cfg.Server, cfg.Identity, err)
+	}
+
+	var m []wptRecords
+	getGeoModel(cfg.Server, &m)
+	if len(m) == 0 {
+		fmt.Printf("Model is not loaded either from cache nor %s", cfg.Server)
 		return
 	}
-	getGeoModel(URL_SERVER, &model)
-	if len(model) == 0 {
-		fmt.Printf("Model is not loaded either from cache nor %s", URL_SERVER)
+	setModel(m)
+	if cfg.Mode == MODE_STREAM {
+		if err := runStream(); err != nil {
+			fmt.Println(err)
+		}
 		return
 	}
 
+	err = readGpx(cfg.Gpx, &route)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	var checkPoints polygon
 	driveAlgorithm(route, &checkPoints)
 	if len(checkPoints.Time) == 0 {
 		fmt.Println("No toll road detected")
 		return
 	}
-	sendTicket(URL_SERVER, checkPoints, obu)
+	emitTicket(checkPoints, true)
+	reportBacklog()
 	// fmt.Println(model[0].LatRad)
 }
 
-func driveAlgorithm(route wptRecords, checkPoints *polygon) {
-	//	var distance float64
-	var nearest_i int
-	var nearest_j int
-
-	for i := 0; i < route.Len; i++ {
-		t := time.Now()
-		calcDistanceToModel(route.LatRad[i], route.LonRad[i])
-
-		shortestDistanceInModel(&nearest_i, &nearest_j)
-
-		if findPair(checkPoints.I, checkPoints.J, nearest_i, nearest_j) == -1 && model[nearest_i].Distances[nearest_j] <= THRESHOLD { // Check if point is not already in array
-			// Check if distance is within THRESHOLD to be evaluated as paid road
-			checkPoints.I = append(checkPoints.I, nearest_i) // Road section
-			checkPoints.J = append(checkPoints.J, nearest_j) // Point of the road
-			checkPoints.Time = append(checkPoints.Time, t.Format(time.RFC3339))
+// emitTicket stores a new ticket of the check-points in the outbox and sends
+// it, by wait it waits for the ticket to be charged.
+func emitTicket(checkPoints polygon, wait bool) {
+	id, err := newTicketId()
+	if err != nil {
+		fmt.Printf("Cannot create ticket id %v", err)
+		return
+	}
+	t := ticket{Id: id, Obu: obu, CheckPoints: checkPoints, Model: modelChecksum}
+	if err := queueTicket(t); err != nil {
+		// sent anyway, only it is not retried when it fails
+		fmt.Printf("Cannot store ticket %s in the outbox: %v\n", id, err)
+		result, err := sendTicket(cfg.Server, t)
+		if wait && err == nil && result.State == TICKET_PENDING {
+			result, err = pollTicket(cfg.Server, t)
 		}
-		//		fmt.Println(nearest_i, nearest_j)
-		//		fmt.Println(model[nearest_i].Distances[nearest_j])
+		if err != nil {
+			reportTicketError(id, err)
+			return
+		}
+		reportTicket(id, result)
+		return
 	}
-	fmt.Println(*checkPoints)
+	flushOutbox(cfg.Server, time.Now(), false, wait)
 }
 
-// Calculate distance from current latRad and lonRad, return point in Threshold and shortest distance
-func calcDistanceToModel(latRad float64, lonRad float64) {
-	for i, v := range model {
-		for j := 0; j < v.Len; j++ {
-			distance := haversine(latRad, lonRad, v.LatRad[j], v.LonRad[j])
-			model[i].Distances[j] = distance
+// reportTicket tells the status of the ticket answered by the server.
+func reportTicket(id string, result *ticketResult) {
+	switch result.State {
+	case TICKET_PENDING:
+		fmt.Printf("Ticket %s is accepted and will be charged later, see %s\n", id, ticketUrl(cfg.Server, id, obu))
+		if result.Code != "" {
+			fmt.Printf("Last attempt failed (%s): %s\n", result.Code, result.Error)
+		}
+	case TICKET_FAILED:
+		fmt.Printf("Ticket %s is refused (%s): %s\n", id, result.Code, result.Error)
+	case TICKET_HELD:
+		fmt.Printf("Ticket %s is held for manual review (%s): %s\n", id, result.Code, result.Error)
+	default:
+		if result.Duplicate {
+			fmt.Printf("Ticket %s has already been charged.\n", id)
 		}
+		fmt.Printf("Ticket %s charged %.2f %s, credit %.2f %s\n", id, result.Transaction.Amount,
+			result.Transaction.Currency, result.Obu.Credit, result.Obu.Currency)
 	}
 }
 
-func shortestDistanceInModel(index_i, index_j *int) {
-	result := model[0].Distances[0]
-	for i, v := range model {
-		for j := 0; j < v.Len; j++ {
-			if result > v.Distances[j] {
-				result = v.Distances[j]
-				*index_i = i
-				*index_j = j
+// reportTicketError explains why the server did not charge the ticket.
+func reportTicketError(id string, err error) {
+	var e *serverError
+	if !errors.As(err, &e) {
+		fmt.Printf("Cannot send ticket %s: %v\n", id, err)
+		return
+	}
+	switch e.Status {
+	case http.StatusUnprocessableEntity:
+		fmt.Printf("Ticket %s is held for manual review (%s): %s\n", id, e.Code, e.Message)
+	case http.StatusNotFound:
+		fmt.Printf("OBU is not registered: %s\n", e.Message)
+	case http.StatusConflict:
+		fmt.Printf("Ticket %s is refused (%s): %s\n", id, e.Code, e.Message)
+	case http.StatusServiceUnavailable:
+		fmt.Printf("Server is unavailable, ticket %s has to be sent again later: %s\n", id, e.Message)
+	default:
+		fmt.Printf("Ticket %s failed: %v\n", id, e)
+	}
+}
+
+func driveAlgorithm(route wptRecords, checkPoints *polygon) {
+	fixes := make([]matching.Fix, route.Len)
+	for i := 0; i < route.Len; i++ {
+		fixes[i] = matching.Fix{LatRad: route.LatRad[i], LonRad: route.LonRad[i]}
+	}
+	// the fixes matched on a toll road by the whole segment, the gap between
+	// the segments was not driven
+	starts := route.Starts
+	if len(starts) == 0 {
+		starts = []int{0}
+	}
+	for s, start := range starts {
+		end := route.Len
+		if s+1 < len(starts) {
+			end = starts[s+1]
+		}
+		for k, m := range matcher.Match(fixes[start:end]) {
+			i := start + k
+			if m.OnRoad && !checkPoints.repeats(m.Road, m.Vertex) {
+				checkPoints.I = append(checkPoints.I, m.Road)   // Road section
+				checkPoints.J = append(checkPoints.J, m.Vertex) // Point of the road
+				checkPoints.Time = append(checkPoints.Time, checkPointTime(route.Time[i]))
 			}
 		}
-
 	}
+	fmt.Println(*checkPoints)
+}
+
+// setModel replaces the geographic model, its checksum, its spatial index and
+// the map matching on it.
+func setModel(m []wptRecords) {
+	roads := make([]spatial.Road, len(m))
+	for i, r := range m {
+		roads[i] = spatial.Road{LatRad: r.LatRad, LonRad: r.LonRad}
+	}
+	model = m
+	modelChecksum = checksum(m)
+	index = spatial.New(roads, spatial.DefaultCellSize)
+	opts := matching.DefaultOptions()
+	opts.OnRoad = cfg.Threshold
+	opts.Radius = 2 * cfg.Threshold
+	matcher = matching.New(index, opts)
 }
 
 func readJson(filename string, v any) error {
@@ -163,46 +334,51 @@ func readJson(filename string, v any) error {
 }
 
 func readGpx(filename string, route *wptRecords) error {
-	result, err := os.Open(filename)
-	if os.IsNotExist(err) {
-		fmt.Printf("error: File %s does not exist.", filename)
-		return err
-	}
+	g, err := gpx.Read(filename)
 	if err != nil {
-		fmt.Printf("error %s", err)
 		return err
 	}
-	defer result.Close()
-
-	doc := etree.NewDocument()
-	if err := doc.ReadFromFile(filename); err != nil {
-		fmt.Println(err)
-		return err
+	for _, seg := range g.Segments() {
+		route.Starts = append(route.Starts, len(route.LatRad))
+		for _, p := range seg {
+			route.LatRad = append(route.LatRad, degreesToRadians(p.Lat))
+			route.LonRad = append(route.LonRad, degreesToRadians(p.Lon))
+			// a point without a time gets one of the simulated clock
+			route.Time = append(route.Time, p.Time)
+		}
 	}
-	root := doc.SelectElement("gpx")
-	for _, e := range root.SelectElements("wpt") {
-		latStr := e.SelectAttrValue("lat", "0.0")
-		latDeg, _ := strconv.ParseFloat(latStr, 64)
-		latRad := degreesToRadians(latDeg)
-		route.LatRad = append(route.LatRad, latRad)
+	route.Len = len(route.LatRad)
+	simulateClock(route, cfg.clockStart(), cfg.VehicleSpeed)
+	return nil
+}
 
-		lonStr := e.SelectAttrValue("lon", "0.0")
-		lonDeg, _ := strconv.ParseFloat(lonStr, 64)
-		lonRad := degreesToRadians(lonDeg)
-		route.LonRad = append(route.LonRad, lonRad)
-	}
-	if len(route.LatRad) == len(route.LonRad) {
-		route.Len = len(route.LatRad)
-	} else {
-		return fmt.Errorf("error: inconsistency length of arrays LatRad and LonRad")
+// simulateClock gives the points of the route without a time the time they
+// would be reached at the speed in km/h, from the previous point or from
+// start.
+func simulateClock(route *wptRecords, start time.Time, speed float64) {
+	for k := range route.Time {
+		if !route.Time[k].IsZero() {
+			continue
+		}
+		if k == 0 {
+			route.Time[k] = start
+			continue
+		}
+		distance := haversine(route.LatRad[k-1], route.LonRad[k-1], route.LatRad[k], route.LonRad[k])
+		route.Time[k] = route.Time[k-1].Add(time.Duration(distance / (speed / 3.6) * float64(time.Second)))
 	}
-	return err
+}
+
+// checkPointTime formats the time of a check-point in UTC, the day and night
+// are by the time zone of the tariff on the server.
+func checkPointTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
 }
 
 func getGeoModel(urlServer string, model *[]wptRecords) {
 	url := fmt.Sprintf("%s/geomodel", urlServer)
 	var filename string = "model.json"
-	if uptodate(filepath.Join(CACHE_DIR, filename), url, model) {
+	if uptodate(filepath.Join(cfg.CacheDir, filename), url, model) {
 		return
 	}
 
@@ -211,13 +387,13 @@ func getGeoModel(urlServer string, model *[]wptRecords) {
 		fmt.Printf("Error: output is empty")
 		return
 	}
-	byteResult := []byte(result)
-	if json.Valid(byteResult) {
-		json.Unmarshal(byteResult, model)
-		writeFile(CACHE_DIR, filename, result)
-	} else {
-		fmt.Printf("Error: Model from %s is not valid json", url)
+	var data json.RawMessage
+	if err := readResponse([]byte(result), &data); err != nil {
+		fmt.Printf("Error: Model from %s: %v", url, err)
+		return
 	}
+	json.Unmarshal(data, model)
+	writeFile(cfg.CacheDir, filename, string(data))
 }
 
 func uptodate(filename, url string, model *[]wptRecords) bool {
@@ -233,11 +409,18 @@ func uptodate(filename, url string, model *[]wptRecords) bool {
 	if result == "" {
 		return false
 	}
-	json.Unmarshal([]byte(result), &versions)
+	if err := readResponse([]byte(result), &versions); err != nil {
+		fmt.Printf("error %s", err)
+		return false
+	}
+	if len(versions) != len(*model) {
+		return false
+	}
 
 	for i := 0; i < len(versions); i++ {
-		d := fmt.Sprintf("%+v", (*model)[i])
-		h := hash([]byte(d))
+		// of the JSON of the section as the server sent it
+		d, _ := json.Marshal((*model)[i])
+		h := hash(d)
 
 		if versions[i].Version != (*model)[i].Version ||
 			versions[i].Checksum != h {
@@ -255,53 +438,112 @@ func initObu(urlServer string, obu *onBoardUnit) error {
 	url := fmt.Sprintf("%s/obu", urlServer)
 	req, _ := http.NewRequest("POST", url, payload)
 	req.Header.Set("Content-Type", "application/json")
-	content, err := http.DefaultClient.Do(req)
+	content, err := client.Do(req)
 	if err != nil {
 		return err
 	}
-	value, _ := io.ReadAll(content.Body)
-	err = json.Unmarshal(value, obu)
+	defer content.Body.Close()
+	value, err := io.ReadAll(content.Body)
 	if err != nil {
 		return err
 	}
-	return nil
+	return readResponse(value, obu)
 }
 
-func sendTicket(urlServer string, checkPoints polygon, obu onBoardUnit) {
+func sendTicket(urlServer string, t ticket) (*ticketResult, error) {
 	url := fmt.Sprintf("%s/ticket", urlServer)
-	var t ticket
-	t.CheckPoints = checkPoints
-	t.Obu = obu
-
 	byteResult, _ := json.Marshal(t)
 	// fmt.Printf("%s", string(byteResult))
 	payload := strings.NewReader(string(byteResult))
 	req, _ := http.NewRequest("POST", url, payload)
 	req.Header.Set("Content-Type", "application/json")
-	content, err := http.DefaultClient.Do(req)
-	if err == nil {
-		fmt.Println("Ticket sent.")
-		value, _ := io.ReadAll(content.Body)
-		fmt.Println(string(value))
+	content, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Body.Close()
+	fmt.Println("Ticket sent.")
+	value, err := io.ReadAll(content.Body)
+	if err != nil {
+		return nil, err
+	}
+	var result ticketResult
+	if err := readResponse(value, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ticketUrl is the status of the ticket of the OBU, the server tells it
+// only to the OBU which sent the ticket.
+func ticketUrl(urlServer, id string, o onBoardUnit) string {
+	query := url.Values{"obu": {o.Id}, "spz": {o.Spz}, "country": {o.Country}}
+	return fmt.Sprintf("%s/ticket/%s?%s", urlServer, url.PathEscape(id), query.Encode())
+}
+
+// pollTicket asks the server for the status of the ticket until it is no
+// longer pending or the poll timeout passes.
+func pollTicket(urlServer string, t ticket) (*ticketResult, error) {
+	deadline := time.Now().Add(time.Duration(cfg.PollTimeout))
+	for {
+		time.Sleep(time.Duration(cfg.PollInterval))
+		result, err := getTicket(urlServer, t)
+		if err != nil {
+			return nil, err
+		}
+		if result.State != TICKET_PENDING || !time.Now().Before(deadline) {
+			return result, nil
+		}
+	}
+}
+
+// getTicket asks the server once for the state of the sent ticket.
+func getTicket(urlServer string, t ticket) (*ticketResult, error) {
+	content, err := client.Get(ticketUrl(urlServer, t.Id, t.Obu))
+	if err != nil {
+		return nil, err
+	}
+	value, err := io.ReadAll(content.Body)
+	content.Body.Close()
+	if err != nil {
+		return nil, err
 	}
+	var result ticketResult
+	if err := readResponse(value, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
 
+// readResponse unpacks the data of the server's answer into v, an error
+// answer is returned as *serverError.
+func readResponse(body []byte, v any) error {
+	var r response
+	if err := json.Unmarshal(body, &r); err != nil {
+		return fmt.Errorf("invalid answer of the server: %v", err)
+	}
+	if r.Status >= 400 || r.Code != "" {
+		return &serverError{Status: r.Status, Code: r.Code, Message: r.Message}
+	}
+	if r.Message != "" {
+		fmt.Println(r.Message)
+	}
+	if len(r.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+func newTicketId() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
 }
 
 func newRequest(url string) string {
 	var answer string = ""
-	//	t := time.Now().Add(2 * time.Second)
-	//	ctx, cancel := context.WithCancel(context.TODO())
-	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   2 * time.Second,
-				KeepAlive: 2 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout:   2 * time.Second,
-			ResponseHeaderTimeout: 2 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
-	}
 	reqm, _ := http.NewRequest("GET", url, nil)
 	reqm.Header.Set("User-Agent", "Mozilla")
 	reqm.Header.Set("Content-Type", "text/html")
@@ -325,6 +567,23 @@ func newRequest(url string) string {
 	return answer
 }
 
+// newClient limits the requests to the server by the timeouts of c.
+func newClient(c config) *http.Client {
+	connect := time.Duration(c.ConnectTimeout)
+	return &http.Client{
+		Timeout: time.Duration(c.Timeout),
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{
+				Timeout:   connect,
+				KeepAlive: connect,
+			}).Dial,
+			TLSHandshakeTimeout:   connect,
+			ResponseHeaderTimeout: time.Duration(c.Timeout),
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
 func writeFile(dir, filename, value string) {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		err = os.Mkdir(dir, 0755)
@@ -338,29 +597,6 @@ func writeFile(dir, filename, value string) {
 	}
 }
 
-func findPair(array1, array2 []int, value1, value2 int) int {
-	var index int = -1
-	if len(array1) != len(array2) {
-		fmt.Printf("error: Array1 and Array2 dont have the same length.")
-		return index
-	}
-	var i = findValue(array1, value1)
-	if i == findValue(array2, value2) {
-		index = i
-	}
-	return index
-}
-
-func findValue(array []int, value1 int) int {
-	var index int = -1
-	for i := 0; i < len(array); i++ {
-		if array[i] == value1 {
-			index = i
-		}
-	}
-	return index
-}
-
 // Haversine calculates the distance between two GPS coordinates using the Haversine formula.
 func haversine(lat1, lon1, lat2, lon2 float64) float64 {
 
@@ -382,3 +618,10 @@ func degreesToRadians(degrees float64) float64 {
 func hash(data []byte) string {
 	return fmt.Sprintf("%x", md5.Sum(data))
 }
+
+// checksum is the SHA-256 of the JSON of the model as the server sent it, the
+// server computes it the same way.
+func checksum(m []wptRecords) string {
+	data, _ := json.Marshal(m)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestFindPair(t *testing.T) {
@@ -76,3 +86,525 @@ func TestDegreesToRadians(t *testing.T) {
 		}
 	}
 }
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		body   string
+		status int
+		exp    float64
+	}{
+		{`{"status":200,"data":{"credit":12.5}}`, 0, 12.5},
+		{`{"status":404,"code":"obu_not_found","message":"obu does not exist"}`, 404, 0},
+		{`{"status":422,"code":"unknown_weight","data":{"ticketId":"x"}}`, 422, 0},
+	}
+	for _, test := range tests {
+		var o onBoardUnit
+		err := readResponse([]byte(test.body), &o)
+		var e *serverError
+		if test.status == 0 && (err != nil || o.Credit != test.exp) {
+			t.Errorf("at input %s expected credit %.2f, but got %.2f, %v", test.body, test.exp, o.Credit, err)
+		} else if test.status != 0 && (!errors.As(err, &e) || e.Status != test.status) {
+			t.Errorf("at input %s expected status %d, but got %v", test.body, test.status, err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{"server": "http://localhost:7905/", "threshold": 30, "timeout": "5s"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig([]string{"-config", file, "-threshold", "25", "-name", "obu2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server != "http://localhost:7905" || c.Threshold != 25 || c.Timeout != duration(5*time.Second) ||
+		c.CacheDir != CACHE_DIR || c.Identity != "obu2.json" || c.Gpx != "obu2.gpx" {
+		t.Errorf("expected the file overridden by the flags, but got %+v", c)
+	}
+
+	tests := [][]string{
+		{"-config", file, "-server", "localhost:8905"},
+		{"-config", file, "-threshold", "0"},
+		{"-config", file, "-timeout", "0s"},
+		{"-config", file, "-clock-start", "yesterday"},
+		{"-config", file, "-vehicle-speed", "0"},
+		{"-config", filepath.Join(t.TempDir(), "none.json")},
+	}
+	for _, args := range tests {
+		if _, err := loadConfig(args); err == nil {
+			t.Errorf("at input %v expected an error", args)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = defaultConfig()
+	cfg.CacheDir = t.TempDir()
+
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tk ticket
+		json.NewDecoder(r.Body).Decode(&tk)
+		sent = append(sent, tk.Id)
+		fmt.Fprintf(w, `{"status":200,"data":{"ticketId":"%s","state":"charged"}}`, tk.Id)
+	}))
+	defer srv.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":503,"code":"ledger_unavailable"}`))
+	}))
+	defer down.Close()
+
+	if err := queueTicket(ticket{Id: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	flushOutbox(down.URL, now, false, false)
+	tickets, err := readOutbox()
+	if err != nil || len(tickets) != 1 || tickets[0].Attempts != 1 || !tickets[0].NextAttempt.After(now) {
+		t.Fatalf("expected the ticket kept for a retry, but got %+v %v", tickets, err)
+	}
+	// not due yet
+	flushOutbox(srv.URL, now, false, false)
+	if len(sent) != 0 {
+		t.Errorf("expected no ticket sent before the retry, but got %v", sent)
+	}
+	flushOutbox(srv.URL, now.Add(time.Hour), false, false)
+	if tickets, _ := readOutbox(); len(tickets) != 0 || len(sent) != 1 || sent[0] != "t1" {
+		t.Errorf("expected the ticket sent once and removed, but got %v and %+v", sent, tickets)
+	}
+}
+
+func TestOutboxHeld(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = defaultConfig()
+	cfg.CacheDir = t.TempDir()
+
+	posted, state := 0, TICKET_HELD
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			posted++
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status":422,"code":"unknown_weight","message":"no rate","data":{"ticketId":"t1"}}`))
+			return
+		}
+		fmt.Fprintf(w, `{"status":200,"data":{"ticketId":"t1","state":"%s"}}`, state)
+	}))
+	defer srv.Close()
+
+	if err := queueTicket(ticket{Id: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 1; i <= 2; i++ {
+		now = now.Add(time.Hour)
+		flushOutbox(srv.URL, now, false, false)
+		tickets, err := readOutbox()
+		if err != nil || len(tickets) != 1 || !tickets[0].Held || !tickets[0].NextAttempt.After(now) {
+			t.Fatalf("check %d: expected the held ticket kept, but got %+v %v", i, tickets, err)
+		}
+	}
+	if posted != 1 {
+		t.Errorf("expected the held ticket posted once, but got %d", posted)
+	}
+	// charged by the operator
+	state = TICKET_CHARGED
+	flushOutbox(srv.URL, now.Add(time.Hour), false, false)
+	if tickets, _ := readOutbox(); len(tickets) != 0 || posted != 1 {
+		t.Errorf("expected the charged ticket removed, but got %+v posted %d times", tickets, posted)
+	}
+}
+
+func TestSendTickets(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = defaultConfig()
+	cfg.CacheDir = t.TempDir()
+	// a ticket waited for would hold up the stream
+	cfg.PollInterval = duration(time.Hour)
+
+	var sent int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":202,"data":{"state":"pending"}}`))
+	}))
+	defer srv.Close()
+	cfg.Server = srv.URL
+
+	tickets := make(chan polygon, TICKET_BUFFER)
+	done := make(chan struct{})
+	go sendTickets(tickets, done)
+	for k := 0; k < 3; k++ {
+		tickets <- polygon{I: []int{0}, J: []int{k}, Time: []string{"2023-05-02T10:00:00Z"}}
+	}
+	close(tickets)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the tickets sent without waiting for them to be charged")
+	}
+	if queued, _ := readOutbox(); sent != 3 || len(queued) != 0 {
+		t.Errorf("expected 3 tickets sent and the outbox empty, but got %d and %+v", sent, queued)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.RetryDelay = duration(time.Second)
+	cfg.MaxRetryDelay = duration(5 * time.Second)
+	tests := []struct {
+		attempts int
+		exp      time.Duration
+	}{
+		{1, time.Second}, {2, 2 * time.Second}, {3, 4 * time.Second}, {4, 5 * time.Second}, {20, 5 * time.Second},
+	}
+	for _, test := range tests {
+		if got := retryDelay(test.attempts); got != test.exp {
+			t.Errorf("at input %d expected %v, but got %v", test.attempts, test.exp, got)
+		}
+	}
+}
+
+func TestReadGpxTime(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "route.gpx")
+	gpx := `<?xml version="1.0"?>
+<gpx version="1.1"><trk><trkseg>
+<trkpt lat="50.0" lon="14.0"><time>2023-05-02T08:00:00Z</time></trkpt>
+<trkpt lat="50.0" lon="14.01"><time>2023-05-02T08:00:30Z</time></trkpt>
+</trkseg><trkseg>
+<trkpt lat="50.0" lon="14.02"></trkpt>
+</trkseg></trk></gpx>`
+	if err := os.WriteFile(file, []byte(gpx), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg = defaultConfig()
+	cfg.VehicleSpeed = 72
+	var r wptRecords
+	if err := readGpx(file, &r); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, 5, 2, 8, 0, 0, 0, time.UTC)
+	// the last point is 715 m behind at 20 m/s
+	exp := []time.Time{start, start.Add(30 * time.Second), start.Add(30*time.Second + 35747*time.Millisecond)}
+	if r.Len != 3 || len(r.Time) != 3 || len(r.Starts) != 2 || r.Starts[1] != 2 {
+		t.Fatalf("expected 3 points in segments from 0 and 2, but got %d from %v", r.Len, r.Starts)
+	}
+	for k := range exp {
+		if d := r.Time[k].Sub(exp[k]); d < -time.Second || d > time.Second {
+			t.Errorf("at point %d expected %s, but got %s", k, exp[k], r.Time[k])
+		}
+	}
+
+	r = wptRecords{LatRad: r.LatRad, LonRad: r.LonRad, Time: make([]time.Time, 3)}
+	simulateClock(&r, start, 72)
+	if r.Time[0] != start || r.Time[1].Sub(start).Round(time.Second) != 36*time.Second {
+		t.Errorf("expected the simulated clock from %s, but got %v", start, r.Time)
+	}
+}
+
+func TestParseNmea(t *testing.T) {
+	tests := []struct {
+		line string
+		lat  float64
+		lon  float64
+		time string
+		ok   bool
+	}{
+		{"$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A", 48.1173, 11.516667, "1994-03-23T12:35:19Z", true},
+		// dated by the RMC before
+		{"$GNGGA,092750.000,5321.6802,N,00630.3372,W,1,8,1.03,61.7,M,55.2,M,,*68", 53.361337, -6.505620, "1994-03-23T09:27:50Z", true},
+		{"$GPRMC,123519,V,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*7D", 0, 0, "", false},
+		{"$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*00", 0, 0, "", false},
+		{"$GPGSV,3,1,11,03,03,111,00,04,15,270,00,06,01,010,00,13,06,292,00*74", 0, 0, "", false},
+		{"garbage", 0, 0, "", false},
+	}
+	var n nmeaReader
+	for _, test := range tests {
+		p, ok := n.parse(test.line)
+		if ok != test.ok {
+			t.Errorf("at input %s expected %v, but got %v", test.line, test.ok, ok)
+			continue
+		}
+		if ok && (math.Abs(p.LatRad-degreesToRadians(test.lat)) > 1e-7 || math.Abs(p.LonRad-degreesToRadians(test.lon)) > 1e-7) {
+			t.Errorf("at input %s expected %.6f, %.6f, but got %.6f, %.6f", test.line, test.lat, test.lon,
+				p.LatRad*180/math.Pi, p.LonRad*180/math.Pi)
+		}
+		if ok && p.Time.Format(time.RFC3339) != test.time {
+			t.Errorf("at input %s expected time %s, but got %s", test.line, test.time, p.Time.Format(time.RFC3339))
+		}
+	}
+}
+
+// testModel has two parallel roads of five points 100 m apart.
+func testModel() []wptRecords {
+	step := 100.0 / EARTH_RADIUS
+	var m []wptRecords
+	for i := 0; i < 2; i++ {
+		r := wptRecords{Len: 5, Name: fmt.Sprintf("R%d", i), Distances: make([]float64, 5)}
+		for j := 0; j < 5; j++ {
+			r.LatRad = append(r.LatRad, 0.88+float64(i)*10*step)
+			r.LonRad = append(r.LonRad, 0.26+float64(j)*step)
+		}
+		m = append(m, r)
+	}
+	return m
+}
+
+func TestDriveAlgorithm(t *testing.T) {
+	saved, savedModel, savedIndex := cfg, model, index
+	defer func() { cfg, model, index = saved, savedModel, savedIndex }()
+	cfg = defaultConfig()
+	setModel(testModel())
+
+	// halfway between the points of the first road, 10 m aside, and far off
+	// the second one
+	step := 100.0 / EARTH_RADIUS
+	var r wptRecords
+	for k := 0; k < 8; k++ {
+		r.LatRad = append(r.LatRad, 0.88+10.0/EARTH_RADIUS)
+		r.LonRad = append(r.LonRad, 0.26+(float64(k)/2+0.25)*step)
+		r.Time = append(r.Time, time.Date(2023, 5, 2, 10, 0, k, 0, time.UTC))
+	}
+	r.LatRad = append(r.LatRad, 0.88+5*step)
+	r.LonRad = append(r.LonRad, 0.26)
+	r.Time = append(r.Time, time.Date(2023, 5, 2, 10, 1, 0, 0, time.UTC))
+	r.Len = len(r.LatRad)
+
+	var checkPoints polygon
+	driveAlgorithm(r, &checkPoints)
+	if fmt.Sprint(checkPoints.I, checkPoints.J) != "[0 0 0 0 0] [0 1 2 3 4]" {
+		t.Errorf("expected the points of the first road, but got %v %v", checkPoints.I, checkPoints.J)
+	}
+}
+
+// TestUTurn drives ../testdata/uturn.gpx, the road there and back after a
+// U-turn, the check-points driven again are recorded. The server charges the
+// same check-points of the fixture on the same model in its tests.
+func TestUTurn(t *testing.T) {
+	saved, savedModel, savedIndex, savedMatcher := cfg, model, index, matcher
+	defer func() { cfg, model, index, matcher = saved, savedModel, savedIndex, savedMatcher }()
+	cfg = defaultConfig()
+	var m []wptRecords
+	if err := readJson("../testdata/model.json", &m); err != nil {
+		t.Fatal(err)
+	}
+	setModel(m)
+	// the server charges the tickets of the model of its checksum
+	data, err := os.ReadFile("../testdata/model.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := fmt.Sprintf("%x", sha256.Sum256(data)); modelChecksum != exp {
+		t.Errorf("expected the checksum %s of the model, but got %s", exp, modelChecksum)
+	}
+
+	data, err = os.ReadFile("../testdata/uturn.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trip struct {
+		Gpx     string  `json:"gpx"`
+		Polygon polygon `json:"polygon"`
+	}
+	if err := json.Unmarshal(data, &trip); err != nil {
+		t.Fatal(err)
+	}
+	var r wptRecords
+	if err := readGpx(filepath.Join("../testdata", trip.Gpx), &r); err != nil {
+		t.Fatal(err)
+	}
+	var checkPoints polygon
+	driveAlgorithm(r, &checkPoints)
+	if got, exp := fmt.Sprint(checkPoints), fmt.Sprint(trip.Polygon); got != exp {
+		t.Errorf("expected the check-points %s, but got %s", exp, got)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	saved, savedModel, savedIndex := cfg, model, index
+	defer func() { cfg, model, index = saved, savedModel, savedIndex }()
+	cfg = defaultConfig()
+	cfg.TicketInterval = duration(time.Hour)
+	setModel(testModel())
+
+	start := time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC)
+	var positions []position
+	on := func(i, j int) {
+		positions = append(positions, position{model[i].LatRad[j], model[i].LonRad[j],
+			start.Add(time.Duration(len(positions)) * time.Second)})
+	}
+	for j := 0; j < 5; j++ {
+		on(0, j)
+	}
+	// a fix 30 m aside, beyond the threshold, is on the road by the fixes
+	// around it
+	positions = append(positions, position{model[0].LatRad[4] + 30/EARTH_RADIUS, model[0].LonRad[4], start})
+	on(0, 4)
+	for k := 0; k < cfg.LeaveAfter; k++ {
+		positions = append(positions, position{0.88 + 5*100.0/EARTH_RADIUS, 0.26, start})
+	}
+	for j := 0; j < 5; j++ {
+		on(1, j)
+	}
+
+	tr := newTracker()
+	var tickets []polygon
+	for _, p := range positions {
+		if c, ok := tr.add(p); ok {
+			tickets = append(tickets, c)
+		}
+	}
+	tickets = append(tickets, tr.finish()...)
+	if len(tickets) != 2 || len(tickets[0].J) != 5 || tickets[0].I[0] != 0 || len(tickets[1].J) != 5 || tickets[1].I[0] != 1 {
+		t.Fatalf("expected tickets of 5 points of R0 and 5 points of R1, but got %+v", tickets)
+	}
+
+	// a long drive is split, the next ticket goes on from the last check-point
+	cfg.TicketInterval = duration(2 * time.Second)
+	tr = newTracker()
+	tickets = nil
+	for _, p := range positions[:5] {
+		if c, ok := tr.add(p); ok {
+			tickets = append(tickets, c)
+		}
+	}
+	tickets = append(tickets, tr.finish()...)
+	if len(tickets) != 4 {
+		t.Fatalf("expected 4 tickets of 2 s, but got %+v", tickets)
+	}
+	for k := 1; k < len(tickets); k++ {
+		if prev := tickets[k-1]; tickets[k].J[0] != prev.J[len(prev.J)-1] {
+			t.Errorf("expected ticket %d to go on from the last check-point, but got %+v", k, tickets)
+		}
+	}
+}
+
+// benchmarkNetwork has roads of n points 100 m apart, wavy and crossing each
+// other, around 50°N 15°E, and a route of fixes driven along the first road
+// a few meters aside.
+func benchmarkNetwork(roads, n int) ([]wptRecords, wptRecords) {
+	rnd := rand.New(rand.NewSource(1))
+	step := 100.0 / EARTH_RADIUS
+	var m []wptRecords
+	for i := 0; i < roads; i++ {
+		lat := 50*math.Pi/180 + rnd.Float64()*0.02
+		lon := 15*math.Pi/180 + rnd.Float64()*0.03
+		heading := rnd.Float64() * 2 * math.Pi
+		r := wptRecords{Len: n, Name: fmt.Sprintf("R%d", i), Distances: make([]float64, n)}
+		for j := 0; j < n; j++ {
+			r.LatRad = append(r.LatRad, lat)
+			r.LonRad = append(r.LonRad, lon)
+			heading += (rnd.Float64() - 0.5) * 0.2
+			lat += step * math.Cos(heading)
+			lon += step * math.Sin(heading) / math.Cos(lat)
+		}
+		m = append(m, r)
+	}
+	var route wptRecords
+	start := time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC)
+	for j := 0; j < n; j += 20 {
+		route.LatRad = append(route.LatRad, m[0].LatRad[j]+(rnd.Float64()-0.5)*10/EARTH_RADIUS)
+		route.LonRad = append(route.LonRad, m[0].LonRad[j])
+		route.Time = append(route.Time, start.Add(time.Duration(j)*time.Second))
+	}
+	route.Len = len(route.LatRad)
+	return m, route
+}
+
+// scanDriveAlgorithm is driveAlgorithm as it was before the spatial index
+// and the map matching: every fix is compared to every point of the model.
+func scanDriveAlgorithm(route wptRecords, checkPoints *polygon) {
+	for i := 0; i < route.Len; i++ {
+		var nearest_i, nearest_j int
+		calcDistanceToModel(route.LatRad[i], route.LonRad[i])
+		shortestDistanceInModel(&nearest_i, &nearest_j)
+		distance := model[nearest_i].Distances[nearest_j]
+		if findPair(checkPoints.I, checkPoints.J, nearest_i, nearest_j) == -1 && distance <= cfg.Threshold {
+			checkPoints.I = append(checkPoints.I, nearest_i)
+			checkPoints.J = append(checkPoints.J, nearest_j)
+			checkPoints.Time = append(checkPoints.Time, checkPointTime(route.Time[i]))
+		}
+	}
+}
+
+func calcDistanceToModel(latRad float64, lonRad float64) {
+	for i, v := range model {
+		for j := 0; j < v.Len; j++ {
+			model[i].Distances[j] = haversine(latRad, lonRad, v.LatRad[j], v.LonRad[j])
+		}
+	}
+}
+
+func shortestDistanceInModel(index_i, index_j *int) {
+	result := model[0].Distances[0]
+	for i, v := range model {
+		for j := 0; j < v.Len; j++ {
+			if result > v.Distances[j] {
+				result = v.Distances[j]
+				*index_i = i
+				*index_j = j
+			}
+		}
+	}
+}
+
+func findPair(array1, array2 []int, value1, value2 int) int {
+	var index int = -1
+	if len(array1) != len(array2) {
+		fmt.Printf("error: Array1 and Array2 dont have the same length.")
+		return index
+	}
+	var i = findValue(array1, value1)
+	if i == findValue(array2, value2) {
+		index = i
+	}
+	return index
+}
+
+func findValue(array []int, value1 int) int {
+	var index int = -1
+	for i := 0; i < len(array); i++ {
+		if array[i] == value1 {
+			index = i
+		}
+	}
+	return index
+}
+
+// benchmarkDrive runs drive on the route of the network of 100 roads of 2000
+// points, 200 000 points in all.
+func benchmarkDrive(b *testing.B, drive func(wptRecords, *polygon)) {
+	saved, savedModel, savedIndex, savedMatcher, stdout := cfg, model, index, matcher, os.Stdout
+	defer func() { cfg, model, index, matcher, os.Stdout = saved, savedModel, savedIndex, savedMatcher, stdout }()
+	cfg = defaultConfig()
+	m, route := benchmarkNetwork(100, 2000)
+	setModel(m)
+	// driveAlgorithm prints the check-points
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdout = devNull
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var checkPoints polygon
+		drive(route, &checkPoints)
+	}
+}
+
+// BenchmarkScanDriveAlgorithm is the former scan of all the points of the
+// model, to compare with BenchmarkDriveAlgorithm.
+func BenchmarkScanDriveAlgorithm(b *testing.B) {
+	benchmarkDrive(b, scanDriveAlgorithm)
+}
+
+func BenchmarkDriveAlgorithm(b *testing.B) {
+	benchmarkDrive(b, driveAlgorithm)
+}
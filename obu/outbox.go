@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OUTBOX_DIR is the directory of the unsent tickets in the cache, one JSON
+// file for each ticket.
+const OUTBOX_DIR = "outbox"
+
+// queuedTicket is a ticket waiting in the outbox until the server
+// acknowledges it. A ticket the server holds for manual review is not sent
+// again, its state is asked for until it leaves the review.
+type queuedTicket struct {
+	Ticket      ticket    `json:"ticket"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError"`
+	Held        bool      `json:"held"`
+}
+
+func outboxDir() string {
+	return filepath.Join(cfg.CacheDir, OUTBOX_DIR)
+}
+
+// queueTicket stores the ticket before it is sent, a ticket of the same ID
+// is replaced.
+func queueTicket(t ticket) error {
+	now := time.Now()
+	return saveQueued(queuedTicket{Ticket: t, Queued: now, NextAttempt: now})
+}
+
+func saveQueued(q queuedTicket) error {
+	data, err := json.MarshalIndent(q, "", "\t")
+	if err != nil {
+		return err
+	}
+	dir := outboxDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// written aside and renamed, so that a lost power leaves no half ticket
+	tmp := filepath.Join(dir, q.Ticket.Id+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, q.Ticket.Id+".json"))
+}
+
+func removeQueued(id string) error {
+	err := os.Remove(filepath.Join(outboxDir(), id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// readOutbox returns the unsent tickets, the oldest first.
+func readOutbox() ([]queuedTicket, error) {
+	files, err := os.ReadDir(outboxDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tickets []queuedTicket
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(outboxDir(), f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var q queuedTicket
+		if err := json.Unmarshal(data, &q); err != nil {
+			fmt.Printf("error: skipping %s of the outbox: %v\n", f.Name(), err)
+			continue
+		}
+		tickets = append(tickets, q)
+	}
+	sort.Slice(tickets, func(i, j int) bool { return tickets[i].Queued.Before(tickets[j].Queued) })
+	return tickets, nil
+}
+
+// reportBacklog tells how many tickets wait in the outbox.
+func reportBacklog() {
+	tickets, err := readOutbox()
+	if err != nil {
+		fmt.Printf("Cannot read the outbox: %v\n", err)
+		return
+	}
+	if len(tickets) == 0 {
+		return
+	}
+	fmt.Printf("%d unsent tickets in the outbox, the oldest from %s\n",
+		len(tickets), tickets[0].Queued.Format(time.RFC3339))
+}
+
+// flushOutbox sends the tickets of the outbox due at now, or all of them.
+// A ticket is removed once the server answers it, while the server cannot
+// be reached or is unavailable the ticket stays for a retry with a growing
+// delay. A held ticket stays as well until the operator charges or refuses
+// it. By wait the OBU waits for the accepted tickets to be charged.
+func flushOutbox(urlServer string, now time.Time, all, wait bool) {
+	tickets, err := readOutbox()
+	if err != nil {
+		fmt.Printf("Cannot read the outbox: %v\n", err)
+		return
+	}
+	for _, q := range tickets {
+		if !all && q.NextAttempt.After(now) {
+			continue
+		}
+		id := q.Ticket.Id
+		var result *ticketResult
+		var err error
+		if q.Held {
+			result, err = getTicket(urlServer, q.Ticket)
+		} else {
+			result, err = sendTicket(urlServer, q.Ticket)
+		}
+		if held(result, err) {
+			q.Attempts++
+			q.NextAttempt = now.Add(retryDelay(q.Attempts))
+			wasHeld := q.Held
+			q.Held = true
+			if err := saveQueued(q); err != nil {
+				fmt.Printf("Cannot keep ticket %s in the outbox: %v\n", id, err)
+			}
+			switch {
+			case wasHeld:
+				fmt.Printf("Ticket %s is still held for manual review, next check at %s\n", id,
+					q.NextAttempt.Format(time.RFC3339))
+			case err != nil:
+				reportTicketError(id, err)
+			default:
+				reportTicket(id, result)
+			}
+			continue
+		}
+		if retryable(err) {
+			q.Attempts++
+			q.NextAttempt = now.Add(retryDelay(q.Attempts))
+			q.LastError = err.Error()
+			if err := saveQueued(q); err != nil {
+				fmt.Printf("Cannot keep ticket %s in the outbox: %v\n", id, err)
+			}
+			fmt.Printf("Cannot send ticket %s, attempt %d, next at %s: %v\n", id, q.Attempts,
+				q.NextAttempt.Format(time.RFC3339), err)
+			continue
+		}
+		if err := removeQueued(id); err != nil {
+			fmt.Printf("Cannot remove ticket %s from the outbox: %v\n", id, err)
+		}
+		if wait && err == nil && result.State == TICKET_PENDING {
+			result, err = pollTicket(urlServer, q.Ticket)
+		}
+		if err != nil {
+			reportTicketError(id, err)
+			continue
+		}
+		reportTicket(id, result)
+	}
+}
+
+// held reports whether the server holds the ticket for manual review.
+func held(result *ticketResult, err error) bool {
+	var e *serverError
+	if errors.As(err, &e) {
+		return e.Status == http.StatusUnprocessableEntity
+	}
+	return err == nil && result.State == TICKET_HELD
+}
+
+// retryable reports whether the ticket has to be sent again, the server
+// was not reached or could not take it.
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var e *serverError
+	if errors.As(err, &e) {
+		return e.Status >= 500
+	}
+	return true
+}
+
+// retryDelay doubles the delay by every failed attempt up to the maximal
+// one.
+func retryDelay(attempts int) time.Duration {
+	delay := time.Duration(cfg.RetryDelay)
+	max := time.Duration(cfg.MaxRetryDelay)
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Solamil/bp23/geo/matching"
+)
+
+// TICKET_BUFFER is how many tickets of the stream may wait to be sent.
+const TICKET_BUFFER = 64
+
+// position is a fix of the vehicle.
+type position struct {
+	LatRad float64
+	LonRad float64
+	Time   time.Time
+}
+
+// runStream runs the OBU on the positions of the configured source until
+// the source ends or the OBU is interrupted. A ticket is sent whenever the
+// vehicle leaves a road section and at least every ticket interval.
+func runStream() error {
+	positions, err := openSource(cfg.Source)
+	if err != nil {
+		return err
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	// the positions are not held up by sending the tickets
+	tickets := make(chan polygon, TICKET_BUFFER)
+	done := make(chan struct{})
+	go sendTickets(tickets, done)
+	defer func() {
+		close(tickets)
+		<-done
+	}()
+
+	tr := newTracker()
+	for {
+		select {
+		case p, ok := <-positions:
+			if !ok {
+				for _, checkPoints := range tr.finish() {
+					tickets <- checkPoints
+				}
+				return nil
+			}
+			if checkPoints, ok := tr.add(p); ok {
+				tickets <- checkPoints
+			}
+		case <-interrupt:
+			fmt.Println("Interrupted, sending the last ticket")
+			for _, checkPoints := range tr.finish() {
+				tickets <- checkPoints
+			}
+			return nil
+		}
+	}
+}
+
+// sendTickets sends the tickets of the stream and retries the unsent ones
+// in the background until tickets is closed. It does not wait for the
+// tickets to be charged, the server charges them by its outbox.
+func sendTickets(tickets <-chan polygon, done chan<- struct{}) {
+	defer close(done)
+	retry := time.NewTicker(time.Duration(cfg.RetryDelay))
+	defer retry.Stop()
+	for {
+		select {
+		case checkPoints, ok := <-tickets:
+			if !ok {
+				flushOutbox(cfg.Server, time.Now(), false, false)
+				reportBacklog()
+				return
+			}
+			emitTicket(checkPoints, false)
+		case <-retry.C:
+			flushOutbox(cfg.Server, time.Now(), false, false)
+		}
+	}
+}
+
+// tracker collects the check-points of a stream of positions into tickets.
+// The positions are matched to the roads by the hidden Markov model over a
+// window of cfg.MatchWindow positions, a position is decided by the ones
+// after it once the window is full.
+type tracker struct {
+	checkPoints polygon
+	window      []position // positions not decided yet, the oldest first
+	road        int        // road section of the last position, -1 off the toll roads
+	off         int        // positions off the road section since the last one on it
+	started     time.Time  // of the first check-point of the ticket
+}
+
+func newTracker() *tracker {
+	return &tracker{road: -1}
+}
+
+// add records the position. It returns the check-points of a finished
+// ticket when the vehicle has left a road section or the ticket interval
+// has passed.
+func (t *tracker) add(p position) (polygon, bool) {
+	t.window = append(t.window, p)
+	if len(t.window) < cfg.MatchWindow {
+		return polygon{}, false
+	}
+	m := t.match()[0]
+	finished, ok := t.decide(t.window[0], m)
+	t.window = t.window[1:]
+	return finished, ok
+}
+
+// finish decides the positions left in the window at the end of the stream
+// and returns the check-points of the tickets not sent yet.
+func (t *tracker) finish() []polygon {
+	var tickets []polygon
+	for k, m := range t.match() {
+		if c, ok := t.decide(t.window[k], m); ok {
+			tickets = append(tickets, c)
+		}
+	}
+	t.window = nil
+	if c, ok := t.flush(false); ok {
+		tickets = append(tickets, c)
+	}
+	return tickets
+}
+
+// match returns the most likely roads of the positions of the window.
+func (t *tracker) match() []matching.Result {
+	fixes := make([]matching.Fix, len(t.window))
+	for k, p := range t.window {
+		fixes[k] = matching.Fix{LatRad: p.LatRad, LonRad: p.LonRad}
+	}
+	return matcher.Match(fixes)
+}
+
+// decide records the position matched to the road.
+func (t *tracker) decide(p position, m matching.Result) (polygon, bool) {
+	i, j, onRoad := m.Road, m.Vertex, m.OnRoad
+	var finished polygon
+	var ok bool
+	switch {
+	case t.road >= 0 && onRoad && i != t.road:
+		// straight onto another road section
+		finished, ok = t.flush(false)
+	case t.road >= 0 && !onRoad:
+		if t.off++; t.off >= cfg.LeaveAfter {
+			finished, ok = t.flush(false)
+			t.road = -1
+		}
+		return finished, ok
+	case len(t.checkPoints.Time) > 0 && p.Time.Sub(t.started) >= time.Duration(cfg.TicketInterval):
+		// the next ticket goes on from the last check-point
+		finished, ok = t.flush(true)
+	}
+	t.off = 0
+	if !onRoad {
+		return finished, ok
+	}
+	t.road = i
+	if !t.checkPoints.repeats(i, j) {
+		if len(t.checkPoints.Time) == 0 {
+			t.started = p.Time
+		}
+		t.checkPoints.I = append(t.checkPoints.I, i)
+		t.checkPoints.J = append(t.checkPoints.J, j)
+		t.checkPoints.Time = append(t.checkPoints.Time, checkPointTime(p.Time))
+	}
+	return finished, ok
+}
+
+// flush returns the collected check-points and starts a new ticket, by the
+// last check-point if the vehicle stays on the road.
+func (t *tracker) flush(stay bool) (polygon, bool) {
+	c := t.checkPoints
+	t.checkPoints = polygon{}
+	if len(c.Time) == 0 {
+		return c, false
+	}
+	if stay {
+		last := len(c.Time) - 1
+		t.checkPoints = polygon{I: []int{c.I[last]}, J: []int{c.J[last]}, Time: []string{c.Time[last]}}
+		t.started, _ = time.Parse(time.RFC3339, c.Time[last])
+	}
+	return c, true
+}
+
+// openSource starts reading the positions of the source, see SOURCES.
+func openSource(source string) (<-chan position, error) {
+	positions := make(chan position)
+	switch {
+	case source == SOURCE_GPX:
+		var r wptRecords
+		if err := readGpx(cfg.Gpx, &r); err != nil {
+			return nil, err
+		}
+		go replayGpx(r, positions)
+	case source == SOURCE_NMEA:
+		go func() {
+			readNmea(os.Stdin, positions)
+			close(positions)
+		}()
+	case strings.HasPrefix(source, "udp://"):
+		conn, err := net.ListenPacket("udp", strings.TrimPrefix(source, "udp://"))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Listening for NMEA on %s\n", source)
+		go receiveUdp(conn, positions)
+	case strings.HasPrefix(source, "tcp://"):
+		l, err := net.Listen("tcp", strings.TrimPrefix(source, "tcp://"))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Listening for NMEA on %s\n", source)
+		go acceptTcp(l, positions)
+	default:
+		return nil, fmt.Errorf("error: unknown source '%s'", source)
+	}
+	return positions, nil
+}
+
+// replayGpx sends the points of the route as they were driven by their
+// times, shortened by the speed of the replay.
+func replayGpx(r wptRecords, positions chan<- position) {
+	defer close(positions)
+	for k := 0; k < r.Len; k++ {
+		if k > 0 {
+			time.Sleep(time.Duration(float64(r.Time[k].Sub(r.Time[k-1])) / cfg.Speed))
+		}
+		positions <- position{LatRad: r.LatRad[k], LonRad: r.LonRad[k], Time: r.Time[k]}
+	}
+}
+
+// receiveUdp reads the sentences of the datagrams, the date of an RMC is
+// kept for the GGA of the following datagrams.
+func receiveUdp(conn net.PacketConn, positions chan<- position) {
+	var n nmeaReader
+	buf := make([]byte, 4096)
+	for {
+		k, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		n.read(strings.NewReader(string(buf[:k])), positions)
+	}
+}
+
+// acceptTcp reads the sentences of one connection after another.
+func acceptTcp(l net.Listener, positions chan<- position) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		readNmea(conn, positions)
+		conn.Close()
+	}
+}
+
+// readNmea sends the positions of the RMC and GGA sentences of r, other
+// sentences and fixes which are not valid are skipped.
+func readNmea(r io.Reader, positions chan<- position) {
+	var n nmeaReader
+	n.read(r, positions)
+}
+
+// nmeaReader dates the fixes of a stream of sentences. GGA has the time of
+// day only, it is dated by the last RMC.
+type nmeaReader struct {
+	date time.Time // UTC midnight of the last RMC
+}
+
+func (n *nmeaReader) read(r io.Reader, positions chan<- position) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if p, ok := n.parse(scanner.Text()); ok {
+			positions <- p
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// parse reads the position of a $--RMC or $--GGA sentence. A fix without
+// a time is taken at the time it is read.
+func (n *nmeaReader) parse(line string) (position, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$") {
+		return position{}, false
+	}
+	body := line[1:]
+	if k := strings.LastIndex(body, "*"); k >= 0 {
+		var sum byte
+		for _, c := range []byte(body[:k]) {
+			sum ^= c
+		}
+		if fmt.Sprintf("%02X", sum) != strings.ToUpper(body[k+1:]) {
+			return position{}, false
+		}
+		body = body[:k]
+	}
+	f := strings.Split(body, ",")
+	if len(f[0]) != 5 {
+		return position{}, false
+	}
+	var lat, latHemi, lon, lonHemi string
+	switch f[0][2:] {
+	case "RMC":
+		if len(f) < 7 || f[2] != "A" {
+			return position{}, false
+		}
+		lat, latHemi, lon, lonHemi = f[3], f[4], f[5], f[6]
+		if len(f) > 9 {
+			if date, err := time.Parse("020106", f[9]); err == nil {
+				n.date = date
+			}
+		}
+	case "GGA":
+		if len(f) < 7 || f[6] == "" || f[6] == "0" {
+			return position{}, false
+		}
+		lat, latHemi, lon, lonHemi = f[2], f[3], f[4], f[5]
+	default:
+		return position{}, false
+	}
+	latDeg, ok1 := nmeaDegrees(lat, latHemi, "N", "S", 2)
+	lonDeg, ok2 := nmeaDegrees(lon, lonHemi, "E", "W", 3)
+	if !ok1 || !ok2 {
+		return position{}, false
+	}
+	return position{LatRad: degreesToRadians(latDeg), LonRad: degreesToRadians(lonDeg), Time: n.time(f[1])}, true
+}
+
+// time dates the hhmmss.ss time of a fix, by today in UTC before the first
+// RMC.
+func (n *nmeaReader) time(hms string) time.Time {
+	day, err := time.Parse("150405", strings.SplitN(hms, ".", 2)[0])
+	if err != nil {
+		return time.Now()
+	}
+	date := n.date
+	if date.IsZero() {
+		date = time.Now().UTC().Truncate(24 * time.Hour)
+	}
+	h, m, sec := day.Clock()
+	t := date.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second)
+	if k := strings.Index(hms, "."); k >= 0 {
+		if frac, err := strconv.ParseFloat("0"+hms[k:], 64); err == nil {
+			t = t.Add(time.Duration(frac * float64(time.Second)))
+		}
+	}
+	return t
+}
+
+// nmeaDegrees converts the (d)ddmm.mmmm value of NMEA to degrees, negative
+// in the hemisphere neg.
+func nmeaDegrees(value, hemi, pos, neg string, digits int) (float64, bool) {
+	if len(value) < digits+2 || (hemi != pos && hemi != neg) {
+		return 0, false
+	}
+	deg, err1 := strconv.Atoi(value[:digits])
+	min, err2 := strconv.ParseFloat(value[digits:], 64)
+	if err1 != nil || err2 != nil || min >= 60 {
+		return 0, false
+	}
+	d := float64(deg) + min/60
+	if hemi == neg {
+		d = -d
+	}
+	return d, true
+}
@@ -2,11 +2,19 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Solamil/bp23/server"
 )
@@ -16,24 +24,96 @@ type geoUrlParams struct {
 }
 
 type ticket struct {
+	ID          string             `json:"id"` // nonce given by the OBU
 	Obu         server.OnBoardUnit `json:"obu"`
 	CheckPoints server.Polygon     `json:"polygon"`
+	Model       string             `json:"model"` // checksum of the geographic model of the check-points
 }
 
-const PORT = 8905
+// errModelChanged is the error of a ticket of another geographic model than
+// the one in use, its check-points may refer to other roads.
+var errModelChanged = errors.New("the ticket refers to another geographic model")
 
-var dbType string = "Blockchain"
+// ticketStatus answers a ticket and the requests of its status. Obu and
+// Transaction are set once the ticket is charged, a resubmitted ticket gets
+// the trip it was charged by the first time.
+type ticketStatus struct {
+	TicketID    string                  `json:"ticketId"`
+	State       string                  `json:"state"`
+	Obu         *server.OnBoardUnit     `json:"obu,omitempty"`
+	Transaction *server.TollTransaction `json:"transaction,omitempty"`
+	Duplicate   bool                    `json:"duplicate"`
+	Attempts    int                     `json:"attempts"`
+	Code        string                  `json:"code,omitempty"` // why the last attempt failed
+	Error       string                  `json:"error,omitempty"`
+}
+
+// stateHeld is the state of a ticket held for manual review.
+const stateHeld = "held"
+
+// ticketHeld is the data of a ticket the tariff cannot price, the code of
+// the response is the Reason of the server.TariffError.
+type ticketHeld struct {
+	TicketID string `json:"ticketId"`
+}
+
+// app holds the dependencies shared by the handlers.
+type app struct {
+	cfg    *server.Config
+	ledger server.Ledger
+	review *server.ReviewQueue
+	outbox *server.Outbox
+}
 
 func main() {
-	server.LoadSazba()
-	server.InitDb(dbType)
-	port := flag.Int("port", PORT, "Port for the server to listen on.")
+	cfg, err := server.LoadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server.Ratio = cfg.Ratio
+	server.Charging = cfg.Charging
+	if err := server.LoadSazba(cfg.SazbaDir); err != nil {
+		log.Fatalf("Failed to load tariff: %v", err)
+	}
+	if err := server.LoadModel(cfg.Model); err != nil {
+		log.Fatalf("Failed to load geographic model: %v", err)
+	}
+	log.Printf("Loaded geographic model %s", server.ModelChecksum(server.CurrentModel()))
+	go reloadModel(cfg.Model)
+	ledger, err := server.InitDb(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open database %s: %v", cfg.DbType, err)
+	}
+	defer ledger.Close()
+	review, err := server.NewReviewQueue(cfg.ReviewFile)
+	if err != nil {
+		log.Fatalf("Failed to open held tickets: %v", err)
+	}
+
+	outbox, err := server.NewOutbox(cfg.Outbox.Dir, time.Duration(cfg.Outbox.Retention))
+	if err != nil {
+		log.Fatalf("Failed to open outbox: %v", err)
+	}
+
+	a := &app{cfg: cfg, ledger: ledger, review: review, outbox: outbox}
+	a.startWorkers(nil)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), a.routes()))
+}
 
-	http.HandleFunc("/", index_handler)
-	http.HandleFunc("/obu", obu_handler)
-	http.HandleFunc("/ticket", ticket_handler)
-	http.HandleFunc("/geomodel", geo_handler)
-	http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
+func (a *app) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", index_handler)
+	mux.HandleFunc("/obu", a.obu_handler)
+	mux.HandleFunc("/ticket", a.ticket_handler)
+	mux.HandleFunc("/ticket/", a.ticket_status_handler)
+	mux.HandleFunc("/review", a.review_handler)
+	mux.HandleFunc("/review/", a.release_handler)
+	mux.HandleFunc("/geomodel", a.geo_handler)
+	return mux
 }
 
 func index_handler(w http.ResponseWriter, r *http.Request) {
@@ -43,8 +123,11 @@ func index_handler(w http.ResponseWriter, r *http.Request) {
 	/ - This help
 	/geomodel - Return geograhic model of toll roads.
 	/geomodel?v - Return version and checksum of geographic model
-	/ticket - Process driven toll roads given by OBUs and compute the toll.
+	/ticket - Accept driven toll roads given by OBUs, the toll is charged in the background.
+	/ticket/{id}?obu={id}&spz={spz}&country={country} - Status of the ticket of the OBU and its charge.
 	/obu - Initialize OBU and check information about OBU.
+	/review - List tickets held for manual review.
+	/review/{id}?obu={id}&spz={spz}&country={country} - Price the held ticket again and charge it, by POST.
 
 	Author michal.kukla@tul.cz
 	2023
@@ -52,47 +135,306 @@ func index_handler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func ticket_handler(w http.ResponseWriter, r *http.Request) {
+func (a *app) ticket_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use POST")
+		return
+	}
 	t := &ticket{}
 	if err := json.NewDecoder(r.Body).Decode(t); err != nil {
-		fmt.Println(err.Error())
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	// the same model for the whole ticket, even if it is reloaded meanwhile
+	model := server.CurrentModel()
+	// a ticket of another model is held by processTicket, unless it is a
+	// retry of a charged one
+	if err := checkTicket(*t, model); err != nil && !errors.Is(err, errModelChanged) {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
 	}
 	o := t.Obu
-	obu, _ := server.GetObu(o.ID, o.SPZ, o.Country, dbType)
-	if obu == nil {
-		w.Write([]byte("Not found"))
-		// handle unexpexted OBU
+	// an unknown OBU is refused at once, an unavailable ledger does not stop
+	// accepting tickets
+	obu, err := a.ledger.GetObu(o.ID, o.SPZ, o.Country)
+	if err != nil && !errors.Is(err, server.ErrLedgerUnavailable) {
+		writeLedgerError(w, err)
+		return
+	}
+	id := t.ID
+	if id == "" {
+		id = ticketID(*t)
+	}
+	key := server.TicketKey{ObuID: o.ID, SPZ: o.SPZ, Country: o.Country, TicketID: id}
+	if queued, ok := a.outbox.Get(key); ok && queued.State != server.TicketFailed {
+		queued.Duplicate = queued.Duplicate || queued.State == server.TicketCharged
+		writeTicketStatus(w, queued)
+		return
+	}
+	if obu != nil {
+		if original, err := a.ledger.GetTicket(o.ID, o.SPZ, o.Country, id); err == nil {
+			writeTicketStatus(w, server.OutboxTicket{TicketID: id, State: server.TicketCharged,
+				Obu: *obu, Transaction: *original, Duplicate: true})
+			return
+		}
+	}
+	queued := server.OutboxTicket{TicketID: id, Obu: o}
+	if obu != nil {
+		tx, err := priceTicket(id, t, *obu, model)
+		if err != nil {
+			a.holdTicket(w, id, *t, err)
+			return
+		}
+		queued.Transaction = tx
+	} else {
+		// priced by a worker once the ledger tells the attributes of the OBU
+		queued.Ticket, _ = json.Marshal(t)
+	}
+	queued, _, err = a.outbox.Add(queued)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
 		return
 	}
-	amount := processTicket(*t)
-	server.SetTollAmount(obu, amount, dbType)
-	obuJSON, _ := json.Marshal(obu)
+	writeTicketStatus(w, queued)
+}
+
+// ticket_status_handler answers the state of the ticket
+// /ticket/{id}?obu={id}&spz={spz}&country={country}. Ticket IDs are chosen
+// by the OBUs, so only the OBU which sent the ticket finds it. A ticket gone
+// from the outbox is looked up on the ledger.
+func (a *app) ticket_status_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use GET")
+		return
+	}
+	key, ok := ticketKey(r, "/ticket/")
+	if !ok {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "use /ticket/{id}?obu={id}&spz={spz}&country={country}")
+		return
+	}
+	id := key.TicketID
+	if queued, ok := a.outbox.Get(key); ok {
+		writeTicketStatus(w, queued)
+		return
+	}
+	for _, h := range a.review.List() {
+		if h.Key() == key {
+			writeData(w, http.StatusOK, "Ticket is held for manual review",
+				ticketStatus{TicketID: id, State: stateHeld, Code: h.Reason, Error: h.Message})
+			return
+		}
+	}
+	tx, err := a.ledger.GetTicket(key.ObuID, key.SPZ, key.Country, id)
+	if err != nil {
+		writeLedgerError(w, err)
+		return
+	}
+	s := ticketStatus{TicketID: id, State: server.TicketCharged, Transaction: tx}
+	if obu, err := a.ledger.GetObu(tx.ObuID, tx.SPZ, tx.Country); err == nil {
+		s.Obu = obu
+	}
+	writeData(w, http.StatusOK, "Ticket charged", s)
+}
 
-	w.Write([]byte(obuJSON))
+// ticketKey reads the ticket of the OBU of the request
+// {prefix}{id}?obu={id}&spz={spz}&country={country}.
+func ticketKey(r *http.Request, prefix string) (server.TicketKey, bool) {
+	query := r.URL.Query()
+	key := server.TicketKey{
+		ObuID:    query.Get("obu"),
+		SPZ:      query.Get("spz"),
+		Country:  query.Get("country"),
+		TicketID: strings.TrimPrefix(r.URL.Path, prefix),
+	}
+	ok := key.TicketID != "" && !strings.Contains(key.TicketID, "/") &&
+		key.ObuID != "" && key.SPZ != "" && key.Country != ""
+	return key, ok
+}
+
+// checkTicket rejects check-points which do not fit the geographic model.
+// The roads are referred to by their order in the model, so a ticket of
+// another model than model fails by errModelChanged, unless its check-points
+// are not in model at all.
+func checkTicket(t ticket, model []server.WptRecords) error {
+	p := t.CheckPoints
+	if len(p.I) == 0 {
+		return fmt.Errorf("the ticket has no check-points")
+	}
+	if len(p.J) != len(p.I) || len(p.Time) != len(p.I) {
+		return fmt.Errorf("the check-points have %d roads, %d points and %d times", len(p.I), len(p.J), len(p.Time))
+	}
+	for k := range p.I {
+		if p.I[k] < 0 || p.I[k] >= len(model) || p.J[k] < 0 || p.J[k] >= model[p.I[k]].Len {
+			return fmt.Errorf("the check-point %d, %d is not in the geographic model", p.I[k], p.J[k])
+		}
+	}
+	if checksum := server.ModelChecksum(model); t.Model != checksum {
+		return fmt.Errorf("%w: %s instead of %s", errModelChanged, t.Model, checksum)
+	}
+	return nil
+}
+
+// holdTicket keeps a ticket the tariff cannot price, or of another geographic
+// model, for manual review and answers it by 422 Unprocessable Entity.
+func (a *app) holdTicket(w http.ResponseWriter, id string, t ticket, err error) {
+	reason, holdErr := a.hold(id, t, err)
+	if holdErr != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, holdErr.Error())
+		return
+	}
+	writeResponse(w, response{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    reason,
+		Message: err.Error(),
+		Data:    ticketHeld{TicketID: id},
+	})
+}
+
+// hold keeps the ticket for manual review and returns the reason it is held
+// for.
+func (a *app) hold(id string, t ticket, err error) (string, error) {
+	reason := "invalid_ticket"
+	var tariffErr *server.TariffError
+	if errors.As(err, &tariffErr) {
+		reason = tariffErr.Reason
+	} else if errors.Is(err, errModelChanged) {
+		reason = CodeModelChanged
+	}
+	data, _ := json.Marshal(t)
+	held := server.HeldTicket{
+		TicketID: id,
+		ObuID:    t.Obu.ID,
+		SPZ:      t.Obu.SPZ,
+		Country:  t.Obu.Country,
+		Reason:   reason,
+		Message:  err.Error(),
+		Ticket:   data,
+		Time:     time.Now().UTC().Format(time.RFC3339),
+	}
+	return reason, a.review.Hold(held)
 }
 
-func obu_handler(w http.ResponseWriter, r *http.Request) {
+func (a *app) review_handler(w http.ResponseWriter, r *http.Request) {
+	writeData(w, http.StatusOK, "", a.review.List())
+}
+
+// release_handler prices the held ticket
+// /review/{id}?obu={id}&spz={spz}&country={country} again, once an operator
+// has corrected the OBU on the ledger or the tariff. The ticket is priced by
+// the OBU as it is stored on the ledger and goes to the outbox to be charged,
+// a ticket still not priceable stays held. A ticket of another geographic
+// model is charged on the roads of the model in use, the operator has
+// checked they are the roads driven.
+func (a *app) release_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use POST")
+		return
+	}
+	key, ok := ticketKey(r, "/review/")
+	if !ok {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "use /review/{id}?obu={id}&spz={spz}&country={country}")
+		return
+	}
+	var held *server.HeldTicket
+	for _, h := range a.review.List() {
+		if h.Key() == key {
+			held = &h
+			break
+		}
+	}
+	if held == nil {
+		writeError(w, http.StatusNotFound, CodeTicketNotFound, "ticket is not held")
+		return
+	}
+	var t ticket
+	if err := json.Unmarshal(held.Ticket, &t); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	obu, err := a.ledger.GetObu(key.ObuID, key.SPZ, key.Country)
+	if err != nil {
+		writeLedgerError(w, err)
+		return
+	}
+	model := server.CurrentModel()
+	t.Model = server.ModelChecksum(model)
+	tx, err := priceTicket(key.TicketID, &t, *obu, model)
+	if err != nil {
+		a.holdTicket(w, key.TicketID, t, err)
+		return
+	}
+	queued, _, err := a.outbox.Add(server.OutboxTicket{TicketID: key.TicketID, Obu: t.Obu, Transaction: tx})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	// the outbox charges it from now on
+	if err := a.review.Release(key); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	writeTicketStatus(w, queued)
+}
+
+// writeTicketStatus answers a pending ticket by 202 Accepted, the OBU polls
+// /ticket/{id} until it is charged or failed.
+func writeTicketStatus(w http.ResponseWriter, t server.OutboxTicket) {
+	s := ticketStatus{
+		TicketID:  t.TicketID,
+		State:     t.State,
+		Duplicate: t.Duplicate,
+		Attempts:  t.Attempts,
+		Code:      t.Code,
+		Error:     t.Error,
+	}
+	switch t.State {
+	case server.TicketPending:
+		writeData(w, http.StatusAccepted, "Ticket accepted", s)
+		return
+	case server.TicketFailed:
+		writeData(w, http.StatusOK, "Ticket failed", s)
+		return
+	}
+	s.Obu, s.Transaction = &t.Obu, &t.Transaction
+	message := "Ticket charged"
+	if t.Duplicate {
+		message = "Ticket has already been charged"
+	}
+	writeData(w, http.StatusOK, message, s)
+}
+
+func (a *app) obu_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use POST")
+		return
+	}
 	var o server.OnBoardUnit
 	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
-		fmt.Println(err.Error())
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
 	}
-	obu, _ := server.GetObu(o.ID, o.SPZ, o.Country, dbType)
-	if obu == nil {
-		w.Write([]byte("error: OBU not found"))
+	obu, err := a.ledger.GetObu(o.ID, o.SPZ, o.Country)
+	if err != nil {
+		writeLedgerError(w, err)
 		return
 	}
-	if obu.Emission != o.Emission || obu.Weight != o.Weight || obu.Axles != o.Axles {
-		server.UpdateObu(o.ID, o.SPZ, o.Country, o.Emission,
-			fmt.Sprintf("%d", o.Weight), fmt.Sprintf("%d", o.Axles), dbType)
-		w.Write([]byte("Modified parameters in OBU"))
+	if obu.Emission == o.Emission && obu.Weight == o.Weight && obu.Axles == o.Axles {
+		writeData(w, http.StatusOK, "", obu)
+		return
 	}
-	byteJson, _ := json.Marshal(obu)
-	w.Write(byteJson)
-
+	if err := a.ledger.UpdateObu(o.ID, o.SPZ, o.Country, o.Emission, o.Weight, o.Axles); err != nil {
+		writeLedgerError(w, err)
+		return
+	}
+	obu, err = a.ledger.GetObu(o.ID, o.SPZ, o.Country)
+	if err != nil {
+		writeLedgerError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, "Modified parameters in OBU", obu)
 }
 
-func geo_handler(w http.ResponseWriter, r *http.Request) {
-	var result []byte
+func (a *app) geo_handler(w http.ResponseWriter, r *http.Request) {
 	var opt string = ""
 	q, _ := url.PathUnescape(r.URL.RawQuery)
 	if len(q) != 0 {
@@ -106,64 +448,197 @@ func geo_handler(w http.ResponseWriter, r *http.Request) {
 		}
 
 	}
+	model := server.CurrentModel()
 	if opt == "v" {
 		var versions []server.WptRecords
-		server.LoadModel()
-		for _, v := range server.Model {
+		for _, v := range model {
 			var section server.WptRecords
 			section.Version = v.Version
 			section.Name = v.Name
-			section.Checksum = hash([]byte(fmt.Sprintf("%+v", v)))
+			// of the JSON the OBU gets, the same on both sides
+			data, _ := json.Marshal(v)
+			section.Checksum = hash(data)
 			versions = append(versions, section)
 		}
-		result, _ = json.Marshal(versions)
+		writeData(w, http.StatusOK, "", versions)
 	} else {
-		server.LoadModel()
-		result, _ = json.Marshal(server.Model)
+		writeData(w, http.StatusOK, "", model)
 	}
+}
 
-	w.Write([]byte(result))
+// reloadModel reads the geographic model at path again on every SIGHUP. An
+// invalid model is logged and the one in use is kept, the OBUs get the new
+// one by its checksum.
+func reloadModel(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := server.LoadModel(path); err != nil {
+			log.Printf("Failed to reload geographic model: %v", err)
+			continue
+		}
+		m := server.CurrentModel()
+		log.Printf("Reloaded geographic model %s of %d road sections", server.ModelChecksum(m), len(m))
+	}
 }
 
-func processTicket(t ticket) float64 {
-	var distance float64 = 0.0
-	var sazba float64 = 0.0
-	var roadname string = ""
-	var timestamp string = ""
-	model := server.Model
+// priceTicket prices the ticket by the OBU as it is stored on the ledger,
+// not by the attributes the OBU sent.
+func priceTicket(id string, t *ticket, obu server.OnBoardUnit, model []server.WptRecords) (server.TollTransaction, error) {
+	t.Obu = obu
+	tx, err := processTicket(*t, model)
+	if err != nil {
+		return tx, err
+	}
+	tx.TicketID = id
+	tx.TicketHash = ticketHash(*t)
+	return tx, nil
+}
 
+// processTicket splits the driven check-points into segments of one road
+// section, one time band and one tariff and charges each of them by the
+// tariff in force at the time of the check-points. A check-point the tariff
+// cannot price fails the whole ticket with a *server.TariffError.
+func processTicket(t ticket, model []server.WptRecords) (server.TollTransaction, error) {
+	var tx server.TollTransaction
 	obu := t.Obu
 	p := t.CheckPoints
-	var i int = 0
-	for ; i < len(p.I)-1; i++ {
-		if p.I[i] == p.I[i+1] && server.IsDay(p.Time[i]) == server.IsDay(p.Time[i+1]) {
-			//still the same paid road section, and still the same day or night
-			lat1 := model[p.I[i]].LatRad[p.J[i]]
-			lon1 := model[p.I[i]].LonRad[p.J[i]]
-			lat2 := model[p.I[i+1]].LatRad[p.J[i+1]]
-			lon2 := model[p.I[i+1]].LonRad[p.J[i+1]]
-			distance += server.Haversine(lat1, lon1, lat2, lon2)
-		} else if p.I[i] != p.I[i+1] || server.IsDay(p.Time[i]) != server.IsDay(p.Time[i+1]) {
-			//end of the same paid road section, or changed from daytime to nightime and vice versa
-			//For each road section there are different charge and for daytime and nightime
-			roadname = model[p.I[i]].Name
-			timestamp = p.Time[i]
-			sazba += server.ExecSazba(distance, timestamp, obu.Weight,
-				obu.Axles, obu.Category, obu.Emission, roadname)
-
-			distance = 0.0
+	if err := checkTicket(t, model); err != nil {
+		return tx, err
+	}
+	// the ledger charges the trip again by the check-points on its copy of
+	// the model
+	tx.Model = server.ModelChecksum(model)
+	tx.Charging = server.Charging
+	tx.CheckPoints = &p
+	tx.Time = p.Time[0]
+	start := 0
+	for i := 0; i < len(p.I); i++ {
+		if i+1 < len(p.I) && p.I[i] == p.I[i+1] && sameTariff(p.Time[i], p.Time[i+1]) {
+			//still the same paid road section, and still the same day or night and tariff
+			continue
+		}
+		//end of the same paid road section, or changed from daytime to nightime and vice versa,
+		//or a new tariff came into force
+		//For each road section there are different charge and for daytime and nightime
+		if server.Charging == server.ChargeBySection {
+			s, err := chargeSections(obu, &model[p.I[i]], p, start, i)
+			if err != nil {
+				return tx, err
+			}
+			tx.Segments = append(tx.Segments, s...)
+		} else {
+			s, err := chargeSegment(obu, &model[p.I[i]], p, start, i)
+			if err != nil {
+				return tx, err
+			}
+			tx.Segments = append(tx.Segments, s)
 		}
+		start = i + 1
+	}
 
+	var versions []string
+	for _, s := range tx.Segments {
+		tx.Amount += s.Amount
+		if len(versions) == 0 || versions[len(versions)-1] != s.TariffVersion {
+			versions = append(versions, s.TariffVersion)
+		}
 	}
+	tx.TariffVersion = strings.Join(versions, ",")
+	return tx, nil
+}
+
+// sameTariff reports whether both times are charged by the same rates.
+func sameTariff(time1, time2 string) bool {
+	return server.TariffVersion(time1) == server.TariffVersion(time2) &&
+		server.TimeBand(time1) == server.TimeBand(time2)
+}
 
-	roadname = model[p.I[i]].Name
-	timestamp = p.Time[i]
-	sazba += server.ExecSazba(distance, timestamp, obu.Weight,
-		obu.Axles, obu.Category, obu.Emission, roadname)
+// continued returns the check-point the segment from start goes on from, the
+// last one of the previous segment if it was split from it by the time band
+// or the tariff.
+func continued(p server.Polygon, start int) int {
+	if start > 0 && p.I[start-1] == p.I[start] {
+		return start - 1
+	}
+	return start
+}
 
-	return sazba
+// chargeSegment charges the distance driven along the road section between
+// the check-points start and end.
+func chargeSegment(obu server.OnBoardUnit, road *server.WptRecords, p server.Polygon, start, end int) (server.TollSegment, error) {
+	from := continued(p, start)
+	passage := road.Drive(p.J[from : end+1])
+	timestamp := p.Time[end]
+	amount, err := server.ExecSazba(passage.Distance, timestamp, obu.Weight,
+		obu.Axles, obu.Category, obu.Emission, road.Class)
+	if err != nil {
+		return server.TollSegment{}, err
+	}
+	return server.TollSegment{
+		Road:          road.Name,
+		Class:         road.Class,
+		TimeBand:      server.TimeBand(timestamp),
+		TariffVersion: server.TariffVersion(timestamp),
+		From:          p.Time[start],
+		To:            timestamp,
+		Entry:         passage.Entry,
+		Exit:          passage.Exit,
+		Reversals:     passage.Reversals,
+		Distance:      passage.Distance,
+		Amount:        amount,
+	}, nil
+}
+
+// chargeSections charges the official length of each charging section whose
+// virtual gantry was passed between the check-points start and end, by the
+// tariff at the check-point behind the gantry.
+func chargeSections(obu server.OnBoardUnit, road *server.WptRecords, p server.Polygon, start, end int) ([]server.TollSegment, error) {
+	from := continued(p, start)
+	var segments []server.TollSegment
+	for _, pass := range road.Passes(p.J[from : end+1]) {
+		sec := pass.Section
+		timestamp := p.Time[from+pass.To]
+		amount, err := server.ExecSazba(sec.Length, timestamp, obu.Weight,
+			obu.Axles, obu.Category, obu.Emission, sec.Class)
+		if err != nil {
+			return nil, err
+		}
+		entry, exit := road.Chainage[sec.Start], road.Chainage[sec.End]
+		if !pass.Forward {
+			entry, exit = exit, entry
+		}
+		segments = append(segments, server.TollSegment{
+			Road:          road.Name,
+			Section:       sec.Name,
+			Class:         sec.Class,
+			TimeBand:      server.TimeBand(timestamp),
+			TariffVersion: server.TariffVersion(timestamp),
+			From:          p.Time[from+pass.From],
+			To:            timestamp,
+			Entry:         entry,
+			Exit:          exit,
+			Distance:      sec.Length,
+			Amount:        amount,
+		})
+	}
+	return segments, nil
 }
 
 func hash(data []byte) string {
 	return fmt.Sprintf("%x", md5.Sum(data))
 }
+
+// ticketID identifies a ticket sent without a nonce by the OBU and the
+// check-points it has driven.
+func ticketID(t ticket) string {
+	polygon, _ := json.Marshal(t.CheckPoints)
+	data := fmt.Sprintf("%s~%s~%s~%s", t.Obu.ID, t.Obu.SPZ, t.Obu.Country, polygon)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+}
+
+// ticketHash identifies the content of the ticket in the recorded trip.
+func ticketHash(t ticket) string {
+	data, _ := json.Marshal(t)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Solamil/bp23/server"
+)
+
+var testObu = server.OnBoardUnit{
+	ID: "2c9fa1aa-4403-4cc9-96f4-09a05638bcad", SPZ: "1SA1234", Country: "CZ",
+	Currency: "CZK", Weight: 8500, Emission: "6", Category: "N", Axles: 4,
+}
+
+func TestMain(m *testing.M) {
+	// tariffs and the geographic model are read relative to server/
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	if err := server.LoadSazba(server.DIR); err != nil {
+		panic(err)
+	}
+	if err := server.LoadModel(server.DefaultConfig().Model); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func post(t *testing.T, h http.HandlerFunc, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+// decode reads the envelope of the response and its data into v.
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v any) response {
+	t.Helper()
+	var r response
+	r.Data = v
+	if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if r.Status != rec.Code {
+		t.Errorf("expected status %d in the body, but got %d", rec.Code, r.Status)
+	}
+	return r
+}
+
+// newApp serves the ledger with the review queue and the outbox in memory.
+func newApp(ledger server.Ledger) *app {
+	cfg := server.DefaultConfig()
+	review, _ := server.NewReviewQueue("")
+	outbox, _ := server.NewOutbox("", time.Hour)
+	return &app{cfg: &cfg, ledger: ledger, review: review, outbox: outbox}
+}
+
+// drain charges the due tickets of the outbox as the workers would.
+func drain(a *app) {
+	for {
+		t, ok := a.outbox.Next(time.Now())
+		if !ok {
+			return
+		}
+		a.charge(t)
+	}
+}
+
+// getStatus asks for the ticket of the OBU o.
+func getStatus(t *testing.T, a *app, o server.OnBoardUnit, id string) (*httptest.ResponseRecorder, ticketStatus) {
+	t.Helper()
+	query := url.Values{"obu": {o.ID}, "spz": {o.SPZ}, "country": {o.Country}}
+	req := httptest.NewRequest(http.MethodGet, "/ticket/"+id+"?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	a.ticket_status_handler(rec, req)
+	var s ticketStatus
+	decode(t, rec, &s)
+	return rec, s
+}
+
+func TestObuHandler(t *testing.T) {
+	a := newApp(server.NewMemoryLedger(testObu))
+
+	unknown := testObu
+	unknown.SPZ = "9XX9999"
+	rec := post(t, a.obu_handler, unknown)
+	if r := decode(t, rec, nil); rec.Code != http.StatusNotFound || r.Code != CodeObuNotFound {
+		t.Errorf("unknown OBU: expected 404 %s, but got %d %s", CodeObuNotFound, rec.Code, r.Code)
+	}
+
+	modified := testObu
+	modified.Weight = 12500
+	modified.Axles = 5
+	var o server.OnBoardUnit
+	rec = post(t, a.obu_handler, modified)
+	if r := decode(t, rec, &o); rec.Code != http.StatusOK || r.Message != "Modified parameters in OBU" {
+		t.Errorf("expected 200 with modified parameters, but got %d %s", rec.Code, r.Message)
+	}
+	if o.Weight != 12500 || o.Axles != 5 {
+		t.Errorf("expected weight 12500 and 5 axles, but got %d and %d", o.Weight, o.Axles)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{")))
+	rec = httptest.NewRecorder()
+	a.obu_handler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed body: expected 400, but got %d", rec.Code)
+	}
+}
+
+func TestTicketHandler(t *testing.T) {
+	other := testObu
+	other.ID = "other"
+	a := newApp(server.NewMemoryLedger(testObu, other))
+
+	var tk ticket
+	tk.ID = "d10"
+	tk.Obu = testObu
+	tk.Model = server.ModelChecksum(server.CurrentModel())
+	for j := 0; j < 10; j++ {
+		tk.CheckPoints.I = append(tk.CheckPoints.I, 1)
+		tk.CheckPoints.J = append(tk.CheckPoints.J, j)
+		tk.CheckPoints.Time = append(tk.CheckPoints.Time, "2023-05-02T10:00:00+02:00")
+	}
+	tx, err := processTicket(tk, server.CurrentModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := tx.Amount
+	if exp <= 0 {
+		t.Fatalf("expected a positive toll, but got %.2f", exp)
+	}
+
+	rec := post(t, a.ticket_handler, tk)
+	var accepted ticketStatus
+	if decode(t, rec, &accepted); rec.Code != http.StatusAccepted || accepted.State != server.TicketPending || accepted.TicketID != "d10" {
+		t.Errorf("expected 202 with the pending ticket, but got %d %+v", rec.Code, accepted)
+	}
+	if rec, s := getStatus(t, a, testObu, "d10"); rec.Code != http.StatusAccepted || s.State != server.TicketPending {
+		t.Errorf("expected the ticket pending before it is charged, but got %d %+v", rec.Code, s)
+	}
+	drain(a)
+	if rec, s := getStatus(t, a, testObu, "d10"); rec.Code != http.StatusOK || s.State != server.TicketCharged ||
+		s.Obu.Credit != exp || s.Transaction.Amount != exp || s.Duplicate {
+		t.Errorf("expected the ticket charged %.2f, but got %d %+v", exp, rec.Code, s)
+	}
+
+	// a retry of the same ticket
+	rec = post(t, a.ticket_handler, tk)
+	var result ticketStatus
+	if decode(t, rec, &result); rec.Code != http.StatusOK || result.Obu.Credit != exp || !result.Duplicate {
+		t.Errorf("retry: expected the charged duplicate, but got %d %+v", rec.Code, result)
+	}
+	drain(a)
+
+	// the same ID chosen by another OBU is its own ticket
+	if rec, _ := getStatus(t, a, other, "d10"); rec.Code != http.StatusNotFound {
+		t.Errorf("ticket of another OBU: expected 404, but got %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/ticket/d10", nil)
+	rec = httptest.NewRecorder()
+	if a.ticket_status_handler(rec, req); rec.Code != http.StatusBadRequest {
+		t.Errorf("ticket without its OBU: expected 400, but got %d", rec.Code)
+	}
+	replayed := tk
+	replayed.Obu = other
+	rec = post(t, a.ticket_handler, replayed)
+	if decode(t, rec, &result); rec.Code != http.StatusAccepted || result.Duplicate {
+		t.Errorf("ticket of another OBU: expected 202 with a new ticket, but got %d %+v", rec.Code, result)
+	}
+	drain(a)
+	if _, s := getStatus(t, a, other, "d10"); s.State != server.TicketCharged || s.Obu.ID != other.ID || s.Obu.Credit != exp {
+		t.Errorf("expected the ticket of another OBU charged %.2f, but got %+v", exp, s)
+	}
+
+	txList, err := a.ledger.GetObuTransactions(testObu.ID, testObu.SPZ, testObu.Country)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txList) != 1 || txList[0].Amount != exp || len(txList[0].Segments) != 1 ||
+		txList[0].Segments[0].Road != "D10" || txList[0].TicketHash == "" {
+		t.Errorf("expected one trip on D10 charged %.2f, but got %+v", exp, txList)
+	}
+
+	unknown := tk
+	unknown.Obu.ID = "unknown"
+	if rec := post(t, a.ticket_handler, unknown); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown OBU: expected 404, but got %d", rec.Code)
+	}
+
+	outside := tk
+	outside.ID = "outside"
+	outside.CheckPoints.J = append([]int{100000}, tk.CheckPoints.J[1:]...)
+	if rec := post(t, a.ticket_handler, outside); rec.Code != http.StatusBadRequest {
+		t.Errorf("check-point outside of the model: expected 400, but got %d", rec.Code)
+	}
+	if rec, _ := getStatus(t, a, testObu, "outside"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown ticket: expected 404, but got %d", rec.Code)
+	}
+}
+
+// The model is reloaded while /geomodel is served, each answer is a whole
+// model.
+func TestGeoHandlerReload(t *testing.T) {
+	a := newApp(server.NewMemoryLedger(testObu))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for k := 0; k < 20; k++ {
+			if err := server.LoadModel(a.cfg.Model); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for k := 0; k < 20; k++ {
+		rec := httptest.NewRecorder()
+		a.geo_handler(rec, httptest.NewRequest(http.MethodGet, "/geomodel?v", nil))
+		var versions []server.WptRecords
+		if decode(t, rec, &versions); rec.Code != http.StatusOK || len(versions) != 2 ||
+			versions[0].Name != "I35" || versions[1].Checksum == "" {
+			t.Errorf("expected the versions of I35 and D10, but got %d %+v", rec.Code, versions)
+		}
+	}
+	<-done
+}
+
+// flakyLedger is unavailable while down is set, for reading the OBUs too
+// while offline is set.
+type flakyLedger struct {
+	server.Ledger
+	down    bool
+	offline bool
+}
+
+func (f *flakyLedger) GetObu(id, spz, country string) (*server.OnBoardUnit, error) {
+	if f.offline {
+		return nil, fmt.Errorf("%w: peer is down", server.ErrLedgerUnavailable)
+	}
+	return f.Ledger.GetObu(id, spz, country)
+}
+
+func (f *flakyLedger) SetTollAmount(o *server.OnBoardUnit, tx *server.TollTransaction) error {
+	if f.down {
+		return fmt.Errorf("%w: peer is down", server.ErrLedgerUnavailable)
+	}
+	return f.Ledger.SetTollAmount(o, tx)
+}
+
+func TestTicketRetry(t *testing.T) {
+	prepaid := testObu
+	prepaid.ID = "prepaid"
+	prepaid.Account = server.AccountPrepaid
+	ledger := &flakyLedger{Ledger: server.NewMemoryLedger(testObu, prepaid), down: true}
+	a := newApp(ledger)
+	a.cfg.Outbox.RetryDelay = 0
+
+	var tk ticket
+	tk.ID = "retry"
+	tk.Obu = testObu
+	tk.Model = server.ModelChecksum(server.CurrentModel())
+	for j := 0; j < 10; j++ {
+		tk.CheckPoints.I = append(tk.CheckPoints.I, 1)
+		tk.CheckPoints.J = append(tk.CheckPoints.J, j)
+		tk.CheckPoints.Time = append(tk.CheckPoints.Time, "2023-05-02T10:00:00+02:00")
+	}
+	post(t, a.ticket_handler, tk)
+	t1, _ := a.outbox.Next(time.Now())
+	a.charge(t1)
+	if _, s := getStatus(t, a, testObu, "retry"); s.State != server.TicketPending || s.Attempts != 1 || s.Code != CodeUnavailable {
+		t.Errorf("expected the ticket pending after a failed attempt, but got %+v", s)
+	}
+
+	ledger.down = false
+	drain(a)
+	if _, s := getStatus(t, a, testObu, "retry"); s.State != server.TicketCharged || s.Attempts != 2 || s.Transaction.Amount <= 0 {
+		t.Errorf("expected the ticket charged by the second attempt, but got %+v", s)
+	}
+
+	// a prepaid OBU without credit is refused by the ledger
+	tk.ID = "no-credit"
+	tk.Obu = prepaid
+	tk.Model = server.ModelChecksum(server.CurrentModel())
+	post(t, a.ticket_handler, tk)
+	drain(a)
+	if _, s := getStatus(t, a, prepaid, "no-credit"); s.State != server.TicketFailed || s.Code != CodeInsufficientCredit {
+		t.Errorf("expected the ticket failed by %s, but got %+v", CodeInsufficientCredit, s)
+	}
+}
+
+// TestTicketPricedLater prices the tickets accepted while the ledger was
+// unavailable by the OBUs on the ledger once it is back.
+func TestTicketPricedLater(t *testing.T) {
+	light := testObu
+	light.ID = "light"
+	light.Weight = 3000
+	ledger := &flakyLedger{Ledger: server.NewMemoryLedger(testObu, light), down: true, offline: true}
+	a := newApp(ledger)
+	a.cfg.Outbox.RetryDelay = 0
+
+	var tk ticket
+	tk.Obu = testObu
+	tk.Model = server.ModelChecksum(server.CurrentModel())
+	for j := 0; j < 10; j++ {
+		tk.CheckPoints.I = append(tk.CheckPoints.I, 1)
+		tk.CheckPoints.J = append(tk.CheckPoints.J, j)
+		tk.CheckPoints.Time = append(tk.CheckPoints.Time, "2023-05-02T10:00:00+02:00")
+	}
+	exp, err := processTicket(tk, server.CurrentModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the OBUs send other attributes than the ones on the ledger
+	tk.ID = "heavy"
+	tk.Obu.Axles = 2
+	if rec := post(t, a.ticket_handler, tk); rec.Code != http.StatusAccepted {
+		t.Errorf("expected 202 while the ledger is unavailable, but got %d %s", rec.Code, rec.Body.String())
+	}
+	tk.ID = "light"
+	tk.Obu = light
+	tk.Obu.Weight = 8500
+	if rec := post(t, a.ticket_handler, tk); rec.Code != http.StatusAccepted {
+		t.Errorf("expected 202 while the ledger is unavailable, but got %d %s", rec.Code, rec.Body.String())
+	}
+	q, _ := a.outbox.Next(time.Now())
+	a.charge(q)
+	if q.Ticket == nil || q.Transaction.Amount != 0 {
+		t.Errorf("expected the ticket not priced yet, but got %+v", q)
+	}
+	if _, s := getStatus(t, a, testObu, "heavy"); s.State != server.TicketPending || s.Attempts != 1 || s.Code != CodeUnavailable {
+		t.Errorf("expected the ticket pending after a failed attempt, but got %+v", s)
+	}
+
+	ledger.down, ledger.offline = false, false
+	drain(a)
+	if _, s := getStatus(t, a, testObu, "heavy"); s.State != server.TicketCharged || s.Transaction.Amount != exp.Amount {
+		t.Errorf("expected the ticket charged %.2f by the OBU on the ledger, but got %+v", exp.Amount, s)
+	}
+	if _, s := getStatus(t, a, light, "light"); s.State != stateHeld || s.Code != server.ReasonUnknownWeight {
+		t.Errorf("expected the ticket held by the weight on the ledger, but got %+v", s)
+	}
+	if _, ok := a.outbox.Get(server.TicketKey{ObuID: light.ID, SPZ: light.SPZ, Country: light.Country, TicketID: "light"}); ok {
+		t.Errorf("expected the held ticket out of the outbox")
+	}
+	if list := a.review.List(); len(list) != 1 || list[0].TicketID != "light" {
+		t.Errorf("expected the ticket held for review, but got %+v", list)
+	}
+}
+
+func TestTicketHeld(t *testing.T) {
+	light := testObu
+	light.Weight = 3000
+	a := newApp(server.NewMemoryLedger(light))
+	review := a.review
+
+	var tk ticket
+	tk.ID = "light"
+	tk.Obu = light
+	tk.Model = server.ModelChecksum(server.CurrentModel())
+	for j := 0; j < 10; j++ {
+		tk.CheckPoints.I = append(tk.CheckPoints.I, 1)
+		tk.CheckPoints.J = append(tk.CheckPoints.J, j)
+		tk.CheckPoints.Time = append(tk.CheckPoints.Time, "2023-05-02T10:00:00+02:00")
+	}
+	rec := post(t, a.ticket_handler, tk)
+	var held ticketHeld
+	if r := decode(t, rec, &held); rec.Code != http.StatusUnprocessableEntity ||
+		r.Code != server.ReasonUnknownWeight || held.TicketID != "light" {
+		t.Errorf("expected 422 %s, but got %d %+v %+v", server.ReasonUnknownWeight, rec.Code, r, held)
+	}
+	if list := review.List(); len(list) != 1 || list[0].TicketID != "light" {
+		t.Errorf("expected the ticket held for review, but got %+v", list)
+	}
+	o, _ := a.ledger.GetObu(light.ID, light.SPZ, light.Country)
+	if txList, _ := a.ledger.GetObuTransactions(light.ID, light.SPZ, light.Country); o.Credit != 0 || len(txList) != 0 {
+		t.Errorf("expected no charge, but got credit %.2f and %d trips", o.Credit, len(txList))
+	}
+
+	if _, s := getStatus(t, a, light, "light"); s.State != stateHeld || s.Code != server.ReasonUnknownWeight {
+		t.Errorf("expected the ticket held, but got %+v", s)
+	}
+	// the ticket is priced by the OBU on the ledger, not by the one it sends
+	tk.Obu.Weight = 8500
+	if rec := post(t, a.ticket_handler, tk); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for the OBU sending another weight, but got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the operator corrects the OBU and the OBU retries the ticket
+	if err := a.ledger.UpdateObu(light.ID, light.SPZ, light.Country, light.Emission, 8500, light.Axles); err != nil {
+		t.Fatal(err)
+	}
+	if rec := post(t, a.ticket_handler, tk); rec.Code != http.StatusAccepted {
+		t.Errorf("expected 202 for the retry, but got %d %s", rec.Code, rec.Body.String())
+	}
+	drain(a)
+	if list := review.List(); len(list) != 0 {
+		t.Errorf("expected the ticket released, but got %+v", list)
+	}
+}
+
+func TestReleaseHeld(t *testing.T) {
+	light := testObu
+	light.Weight = 3000
+	a := newApp(server.NewMemoryLedger(light))
+
+	var tk ticket
+	tk.ID = "light"
+	tk.Obu = light
+	tk.Model = server.ModelChecksum(server.CurrentModel())
+	for j := 0; j < 10; j++ {
+		tk.CheckPoints.I = append(tk.CheckPoints.I, 1)
+		tk.CheckPoints.J = append(tk.CheckPoints.J, j)
+		tk.CheckPoints.Time = append(tk.CheckPoints.Time, "2023-05-02T10:00:00+02:00")
+	}
+	post(t, a.ticket_handler, tk)
+	release := func(id string) *httptest.ResponseRecorder {
+		query := url.Values{"obu": {light.ID}, "spz": {light.SPZ}, "country": {light.Country}}
+		req := httptest.NewRequest(http.MethodPost, "/review/"+id+"?"+query.Encode(), nil)
+		rec := httptest.NewRecorder()
+		a.release_handler(rec, req)
+		return rec
+	}
+
+	// still the unknown weight on the ledger
+	if rec := release("light"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for the uncorrected OBU, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if list := a.review.List(); len(list) != 1 {
+		t.Errorf("expected the ticket still held, but got %+v", list)
+	}
+	if rec := release("unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown ticket: expected 404, but got %d", rec.Code)
+	}
+
+	// the operator corrects the OBU, the ticket is charged without a retry of the OBU
+	if err := a.ledger.UpdateObu(light.ID, light.SPZ, light.Country, light.Emission, 8500, light.Axles); err != nil {
+		t.Fatal(err)
+	}
+	rec := release("light")
+	var s ticketStatus
+	if decode(t, rec, &s); rec.Code != http.StatusAccepted || s.State != server.TicketPending {
+		t.Errorf("expected 202 with the pending ticket, but got %d %+v", rec.Code, s)
+	}
+	if list := a.review.List(); len(list) != 0 {
+		t.Errorf("expected the ticket released, but got %+v", list)
+	}
+	drain(a)
+	if _, s := getStatus(t, a, light, "light"); s.State != server.TicketCharged || s.Transaction.Amount <= 0 {
+		t.Errorf("expected the ticket charged, but got %+v", s)
+	}
+}
+
+// TestTicketModelChanged holds the tickets of another geographic model, their
+// roads may be other roads of the model in use, until the operator releases
+// them.
+func TestTicketModelChanged(t *testing.T) {
+	a := newApp(server.NewMemoryLedger(testObu))
+
+	var tk ticket
+	tk.ID = "old"
+	tk.Obu = testObu
+	tk.Model = fmt.Sprintf("%x", sha256.Sum256(nil))
+	for j := 0; j < 10; j++ {
+		tk.CheckPoints.I = append(tk.CheckPoints.I, 1)
+		tk.CheckPoints.J = append(tk.CheckPoints.J, j)
+		tk.CheckPoints.Time = append(tk.CheckPoints.Time, "2023-05-02T10:00:00+02:00")
+	}
+	rec := post(t, a.ticket_handler, tk)
+	var held ticketHeld
+	if r := decode(t, rec, &held); rec.Code != http.StatusUnprocessableEntity || r.Code != CodeModelChanged || held.TicketID != "old" {
+		t.Errorf("expected 422 %s, but got %d %+v %+v", CodeModelChanged, rec.Code, r, held)
+	}
+	if list := a.review.List(); len(list) != 1 || list[0].Reason != CodeModelChanged {
+		t.Errorf("expected the ticket held for review, but got %+v", list)
+	}
+	drain(a)
+	if txList, _ := a.ledger.GetObuTransactions(testObu.ID, testObu.SPZ, testObu.Country); len(txList) != 0 {
+		t.Errorf("expected no charge, but got %d trips", len(txList))
+	}
+
+	// a ticket without the checksum is of an unknown model
+	tk.ID = "unknown"
+	tk.Model = ""
+	if rec := post(t, a.ticket_handler, tk); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("ticket without a model: expected 422, but got %d", rec.Code)
+	}
+
+	// a road the model in use does not have is refused at once
+	bad := tk
+	bad.ID = "bad"
+	bad.CheckPoints.I = []int{5}
+	bad.CheckPoints.J = []int{0}
+	bad.CheckPoints.Time = []string{"2023-05-02T10:00:00+02:00"}
+	if rec := post(t, a.ticket_handler, bad); rec.Code != http.StatusBadRequest {
+		t.Errorf("road out of the model: expected 400, but got %d", rec.Code)
+	}
+
+	// the operator releases both tickets on the model in use
+	for _, id := range []string{"old", "unknown"} {
+		query := url.Values{"obu": {testObu.ID}, "spz": {testObu.SPZ}, "country": {testObu.Country}}
+		req := httptest.NewRequest(http.MethodPost, "/review/"+id+"?"+query.Encode(), nil)
+		rec := httptest.NewRecorder()
+		a.release_handler(rec, req)
+		if rec.Code != http.StatusAccepted {
+			t.Errorf("release %s: expected 202, but got %d %s", id, rec.Code, rec.Body.String())
+		}
+	}
+	if list := a.review.List(); len(list) != 0 {
+		t.Errorf("expected the tickets released, but got %+v", list)
+	}
+	drain(a)
+	for _, id := range []string{"old", "unknown"} {
+		if _, s := getStatus(t, a, testObu, id); s.State != server.TicketCharged ||
+			s.Transaction.Model != server.ModelChecksum(server.CurrentModel()) {
+			t.Errorf("expected ticket %s charged on the model in use, but got %+v", id, s)
+		}
+	}
+}
+
+func TestProcessTicket(t *testing.T) {
+	trip := func(j ...int) ticket {
+		var tk ticket
+		tk.Obu = testObu
+		tk.Model = server.ModelChecksum(server.CurrentModel())
+		for _, j := range j {
+			tk.CheckPoints.I = append(tk.CheckPoints.I, 1)
+			tk.CheckPoints.J = append(tk.CheckPoints.J, j)
+			tk.CheckPoints.Time = append(tk.CheckPoints.Time, "2023-05-02T10:00:00+02:00")
+		}
+		return tk
+	}
+	full, err := processTicket(trip(0, 1, 2, 3, 4, 5, 6, 7, 8, 9), server.CurrentModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		tk        ticket
+		distance  float64
+		reversals int
+	}{
+		{"skipped points", trip(0, 4, 9), full.Segments[0].Distance, 0},
+		{"the opposite direction", trip(9, 5, 0), full.Segments[0].Distance, 0},
+		{"a U-turn", trip(0, 9, 0), 2 * full.Segments[0].Distance, 1},
+	}
+	for _, test := range tests {
+		tx, err := processTicket(test.tk, server.CurrentModel())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tx.Segments) != 1 || math.Abs(tx.Segments[0].Distance-test.distance) > 0.01 ||
+			tx.Segments[0].Reversals != test.reversals {
+			t.Errorf("%s: expected %.2f m with %d reversals, but got %+v", test.name, test.distance, test.reversals, tx.Segments)
+		}
+	}
+	malformed := trip(0, 4, 9)
+	malformed.CheckPoints.Time = malformed.CheckPoints.Time[1:]
+	for _, tk := range []ticket{trip(), malformed, trip(0, 100)} {
+		if _, err := processTicket(tk, server.CurrentModel()); err == nil {
+			t.Errorf("at input %+v expected an error", tk.CheckPoints)
+		}
+	}
+}
+
+func TestProcessTicketBySection(t *testing.T) {
+	defer func(c string) { server.Charging = c }(server.Charging)
+	server.Charging = server.ChargeBySection
+	trip := func(j ...int) ticket {
+		var tk ticket
+		tk.Obu = testObu
+		tk.Model = server.ModelChecksum(server.CurrentModel())
+		for k, j := range j {
+			tk.CheckPoints.I = append(tk.CheckPoints.I, 1)
+			tk.CheckPoints.J = append(tk.CheckPoints.J, j)
+			tk.CheckPoints.Time = append(tk.CheckPoints.Time, fmt.Sprintf("2023-05-02T10:00:%02d+02:00", k))
+		}
+		return tk
+	}
+	tests := []struct {
+		name     string
+		tk       ticket
+		sections int
+	}{
+		{"the whole section", trip(0, 1, 2, 3, 4, 5, 6, 7, 8, 9), 1},
+		{"before the gantry", trip(0, 1, 2), 0},
+		{"a U-turn behind the gantry", trip(0, 9, 0), 2},
+	}
+	for _, test := range tests {
+		tx, err := processTicket(test.tk, server.CurrentModel())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tx.Segments) != test.sections {
+			t.Errorf("%s: expected %d sections, but got %+v", test.name, test.sections, tx.Segments)
+			continue
+		}
+		for _, s := range tx.Segments {
+			if s.Section != "D10-1" || s.Distance != 180 || s.Amount <= 0 {
+				t.Errorf("%s: expected D10-1 charged by its 180 m, but got %+v", test.name, s)
+			}
+		}
+	}
+}
+
+// TestTripFixtures prices the trips shared with the tests of the chaincode,
+// the ledger has to charge them the same on the same model.
+func TestTripFixtures(t *testing.T) {
+	defer func(c string) { server.Charging = c }(server.Charging)
+	model, err := os.ReadFile("../testdata/model.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := json.Marshal(server.CurrentModel()); !bytes.Equal(data, model) {
+		t.Fatalf("expected ../testdata/model.json to be the JSON of the model, but got %s", data)
+	}
+	if got, exp := server.ModelChecksum(server.CurrentModel()), fmt.Sprintf("%x", sha256.Sum256(model)); got != exp {
+		t.Errorf("expected the checksum %s of the model, but got %s", exp, got)
+	}
+
+	data, err := os.ReadFile("../testdata/trips.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trips []struct {
+		Name     string             `json:"name"`
+		Charging string             `json:"charging"`
+		Obu      server.OnBoardUnit `json:"obu"`
+		Polygon  server.Polygon     `json:"polygon"`
+		Amount   float64            `json:"amount"`
+		Segments int                `json:"segments"`
+	}
+	if err := json.Unmarshal(data, &trips); err != nil {
+		t.Fatal(err)
+	}
+	for _, trip := range trips {
+		server.Charging = trip.Charging
+		tx, err := processTicket(ticket{Obu: trip.Obu, CheckPoints: trip.Polygon, Model: server.ModelChecksum(server.CurrentModel())}, server.CurrentModel())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(tx.Amount-trip.Amount) > 1e-9 || len(tx.Segments) != trip.Segments {
+			t.Errorf("%s: expected %v in %d segments, but got %v in %d", trip.Name, trip.Amount, trip.Segments,
+				tx.Amount, len(tx.Segments))
+		}
+		if tx.Model != server.ModelChecksum(server.CurrentModel()) || tx.Charging != trip.Charging || tx.CheckPoints == nil {
+			t.Errorf("%s: expected the check-points of the model charged by %s, but got %+v", trip.Name, trip.Charging, tx)
+		}
+	}
+}
+
+// TestUTurn charges the check-points the OBU records of ../testdata/uturn.gpx,
+// the road driven there and back after the U-turn.
+func TestUTurn(t *testing.T) {
+	defer func(c string) { server.Charging = c }(server.Charging)
+	data, err := os.ReadFile("../testdata/uturn.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trip struct {
+		Charging  string             `json:"charging"`
+		Obu       server.OnBoardUnit `json:"obu"`
+		Polygon   server.Polygon     `json:"polygon"`
+		Distance  float64            `json:"distance"`
+		Reversals int                `json:"reversals"`
+		Amount    float64            `json:"amount"`
+	}
+	if err := json.Unmarshal(data, &trip); err != nil {
+		t.Fatal(err)
+	}
+	server.Charging = trip.Charging
+	tx, err := processTicket(ticket{Obu: trip.Obu, CheckPoints: trip.Polygon, Model: server.ModelChecksum(server.CurrentModel())}, server.CurrentModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Segments) != 1 {
+		t.Fatalf("expected one segment, but got %+v", tx.Segments)
+	}
+	s := tx.Segments[0]
+	if math.Abs(s.Distance-trip.Distance) > 1e-6 || s.Reversals != trip.Reversals || math.Abs(tx.Amount-trip.Amount) > 1e-9 {
+		t.Errorf("expected %v m with %d reversals for %v, but got %v m with %d for %v", trip.Distance, trip.Reversals,
+			trip.Amount, s.Distance, s.Reversals, tx.Amount)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Solamil/bp23/server"
+)
+
+// response is the envelope of every answer of the server. An error has a
+// machine readable Code, a success carries its result in Data.
+type response struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// Codes of errors, a ticket the tariff cannot price is answered by the
+// Reason of its server.TariffError.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeObuNotFound        = "obu_not_found"
+	CodeObuExists          = "obu_exists"
+	CodeTicketNotFound     = "ticket_not_found"
+	CodeDuplicateTicket    = "duplicate_ticket"
+	CodeInsufficientCredit = "insufficient_credit"
+	CodeInvalidAccount     = "invalid_account"
+	CodeUnavailable        = "ledger_unavailable"
+	CodeInternal           = "internal_error"
+	CodeModelChanged       = "model_changed" // the ticket of another geographic model is held
+)
+
+func writeData(w http.ResponseWriter, status int, message string, data any) {
+	writeResponse(w, response{Status: status, Message: message, Data: data})
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeResponse(w, response{Status: status, Code: code, Message: message})
+}
+
+func writeResponse(w http.ResponseWriter, r response) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		fmt.Println(err)
+		r = response{Status: http.StatusInternalServerError, Code: CodeInternal, Message: err.Error()}
+		body, _ = json.Marshal(r)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(r.Status)
+	w.Write(body)
+}
+
+// writeLedgerError answers an error of the ledger by its status and code.
+func writeLedgerError(w http.ResponseWriter, err error) {
+	status, code := ledgerStatus(err)
+	if status == http.StatusInternalServerError {
+		fmt.Println(err)
+	}
+	writeError(w, status, code, err.Error())
+}
+
+func ledgerStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, server.ErrObuNotFound):
+		return http.StatusNotFound, CodeObuNotFound
+	case errors.Is(err, server.ErrTicketNotFound):
+		return http.StatusNotFound, CodeTicketNotFound
+	case errors.Is(err, server.ErrObuExists):
+		return http.StatusConflict, CodeObuExists
+	case errors.Is(err, server.ErrDuplicateTicket):
+		return http.StatusConflict, CodeDuplicateTicket
+	case errors.Is(err, server.ErrInsufficientCredit):
+		return http.StatusConflict, CodeInsufficientCredit
+	case errors.Is(err, server.ErrInvalidAccount):
+		return http.StatusConflict, CodeInvalidAccount
+	case errors.Is(err, server.ErrLedgerUnavailable):
+		return http.StatusServiceUnavailable, CodeUnavailable
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Solamil/bp23/server"
+)
+
+// idleWait is how long an idle worker sleeps unless it is woken by the
+// outbox.
+const idleWait = time.Minute
+
+// startWorkers charges the tickets of the outbox on the ledger until stop is
+// closed.
+func (a *app) startWorkers(stop <-chan struct{}) {
+	for i := 0; i < a.cfg.Outbox.Workers; i++ {
+		go a.worker(stop)
+	}
+}
+
+func (a *app) worker(stop <-chan struct{}) {
+	for {
+		if t, ok := a.outbox.Next(time.Now()); ok {
+			a.charge(t)
+			continue
+		}
+		wait := idleWait
+		if next, ok := a.outbox.NextAttempt(); ok && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-a.outbox.Ready():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// charge submits the claimed ticket to the ledger. A ticket the ledger has
+// recorded already is charged by its original trip. A ticket not priced yet
+// is priced first, by the OBU on the ledger.
+func (a *app) charge(t server.OutboxTicket) {
+	key := t.Key()
+	o := t.Obu
+	tx := t.Transaction
+	obu, err := a.ledger.GetObu(o.ID, o.SPZ, o.Country)
+	if err == nil {
+		if original, err := a.ledger.GetTicket(o.ID, o.SPZ, o.Country, t.TicketID); err == nil {
+			a.charged(key, *obu, *original, true)
+			return
+		}
+		if t.Ticket != nil {
+			var priced bool
+			if tx, priced = a.price(t, *obu); !priced {
+				return
+			}
+		}
+		err = a.ledger.SetTollAmount(obu, &tx)
+	}
+	if err != nil {
+		// the same ticket may have been charged in the meantime
+		if original, err := a.ledger.GetTicket(o.ID, o.SPZ, o.Country, t.TicketID); err == nil {
+			if obu, err := a.ledger.GetObu(o.ID, o.SPZ, o.Country); err == nil {
+				a.charged(key, *obu, *original, true)
+				return
+			}
+		}
+		a.retryOrFail(t, err)
+		return
+	}
+	a.charged(key, *obu, tx, false)
+}
+
+// price prices the ticket accepted while the ledger was unavailable. A
+// ticket the tariff cannot price leaves the outbox to be held for manual
+// review.
+func (a *app) price(t server.OutboxTicket, obu server.OnBoardUnit) (server.TollTransaction, bool) {
+	var tk ticket
+	err := json.Unmarshal(t.Ticket, &tk)
+	if err == nil {
+		var tx server.TollTransaction
+		if tx, err = priceTicket(t.TicketID, &tk, obu, server.CurrentModel()); err == nil {
+			return tx, true
+		}
+	}
+	if _, err := a.hold(t.TicketID, tk, err); err != nil {
+		a.retryOrFail(t, err)
+		return server.TollTransaction{}, false
+	}
+	if err := a.outbox.Remove(t.Key()); err != nil {
+		fmt.Println(err)
+	}
+	return server.TollTransaction{}, false
+}
+
+func (a *app) charged(key server.TicketKey, obu server.OnBoardUnit, tx server.TollTransaction, duplicate bool) {
+	if err := a.outbox.Charge(key, obu, tx, duplicate); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := a.review.Release(key); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// retryOrFail tries the ticket again while the ledger is unavailable and a
+// few times after an unexpected error. A ticket the ledger refuses fails.
+func (a *app) retryOrFail(t server.OutboxTicket, err error) {
+	status, code := ledgerStatus(err)
+	retry := errors.Is(err, server.ErrLedgerUnavailable) ||
+		(status == http.StatusInternalServerError && t.Attempts+1 < a.cfg.Outbox.MaxAttempts)
+	if retry {
+		err = a.outbox.Retry(t.Key(), code, err.Error(), time.Now().Add(a.retryDelay(t.Attempts)))
+	} else {
+		err = a.outbox.Fail(t.Key(), code, err.Error())
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// retryDelay doubles the delay by every attempt up to the maximal one.
+func (a *app) retryDelay(attempts int) time.Duration {
+	delay := time.Duration(a.cfg.Outbox.RetryDelay)
+	max := time.Duration(a.cfg.Outbox.MaxRetryDelay)
+	for i := 0; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config of the server. It is read from a JSON file, then overridden by the
+// environment variables and at last by the command line flags.
+type Config struct {
+	Port       int          `json:"Port"`
+	Ratio      float64      `json:"Ratio"`    // meters charged by a rate of a tariff without one
+	Charging   string       `json:"Charging"` // "distance" driven or official length of the "section" passed
+	DbType     string       `json:"DbType"`
+	DbFile     string       `json:"DbFile"` // OBUs of the JSON database
+	Fabric     FabricConfig `json:"Fabric"`
+	SazbaDir   string       `json:"SazbaDir"`
+	Model      string       `json:"Model"`      // directory of the GPX files or manifest of the geographic model
+	ReviewFile string       `json:"ReviewFile"` // tickets held for manual review
+	Outbox     OutboxConfig `json:"Outbox"`
+}
+
+// OutboxConfig sets how the accepted tickets are charged on the ledger in
+// the background.
+type OutboxConfig struct {
+	Dir           string   `json:"Dir"` // one file for each ticket
+	Workers       int      `json:"Workers"`
+	RetryDelay    Duration `json:"RetryDelay"` // of the first retry, doubled by every next one
+	MaxRetryDelay Duration `json:"MaxRetryDelay"`
+	MaxAttempts   int      `json:"MaxAttempts"` // of a ticket failing by an unexpected error
+	Retention     Duration `json:"Retention"`   // of charged and failed tickets
+}
+
+// FabricConfig locates the chaincode and the organization the server acts
+// for. The settings of the embedded FabricOrg override those of Org.
+type FabricConfig struct {
+	Channel    string               `json:"Channel"`
+	Chaincode  string               `json:"Chaincode"`
+	WalletPath string               `json:"WalletPath"` // kept between runs
+	Org        string               `json:"Org"`
+	Orgs       map[string]FabricOrg `json:"Orgs"`
+	FabricOrg
+	Timeouts GatewayTimeouts `json:"Timeouts"`
+}
+
+// GatewayTimeouts limit each call of the Fabric Gateway client to the peer.
+type GatewayTimeouts struct {
+	Evaluate     Duration `json:"Evaluate"`
+	Endorse      Duration `json:"Endorse"`
+	Submit       Duration `json:"Submit"`
+	CommitStatus Duration `json:"CommitStatus"` // waiting for the transaction to be committed
+}
+
+// Duration is a time.Duration written as "5s" in the configuration file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+const (
+	DefaultPort       = 8905
+	DefaultConfigFile = "config.json"
+)
+
+func DefaultConfig() Config {
+	return Config{
+		Port:     DefaultPort,
+		Ratio:    100,
+		Charging: ChargeByDistance,
+		DbType:   DbGateway,
+		DbFile:   filepath.Join("obu", "obuList.json"),
+		Fabric: FabricConfig{
+			Channel:    "channel1",
+			Chaincode:  "toll",
+			WalletPath: "wallet",
+			Org:        "Org1",
+			Orgs:       map[string]FabricOrg{"Org1": testOrg("Org1"), "Org2": testOrg("Org2")},
+			Timeouts: GatewayTimeouts{
+				Evaluate:     Duration(5 * time.Second),
+				Endorse:      Duration(15 * time.Second),
+				Submit:       Duration(5 * time.Second),
+				CommitStatus: Duration(time.Minute),
+			},
+		},
+		SazbaDir:   DIR,
+		Model:      filepath.Join("model", "manifest.json"),
+		ReviewFile: filepath.Join("obu", "heldTickets.json"),
+		Outbox: OutboxConfig{
+			Dir:           filepath.Join("obu", "outbox"),
+			Workers:       2,
+			RetryDelay:    Duration(time.Second),
+			MaxRetryDelay: Duration(5 * time.Minute),
+			MaxAttempts:   10,
+			Retention:     Duration(24 * time.Hour),
+		},
+	}
+}
+
+// option is a setting which can be given by an environment variable and a
+// flag.
+type option struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var options = []option{
+	{"port", "TOLL_PORT", "Port for the server to listen on.", func(c *Config, v string) error {
+		return parseInt(v, &c.Port)
+	}},
+	{"ratio", "TOLL_RATIO", "Meters charged by a rate of a tariff without its own ratio.", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		c.Ratio = f
+		return err
+	}},
+	{"charging", "TOLL_CHARGING", "Trips are charged by the \"distance\" driven or the \"section\" passed.", func(c *Config, v string) error {
+		c.Charging = v
+		return nil
+	}},
+	{"db", "TOLL_DB", "Database backend, \"Blockchain\", \"Gateway\", \"JSON\" or \"Memory\".", func(c *Config, v string) error {
+		c.DbType = v
+		return nil
+	}},
+	{"db-file", "TOLL_DB_FILE", "OBUs of the JSON database.", func(c *Config, v string) error {
+		c.DbFile = v
+		return nil
+	}},
+	{"channel", "TOLL_CHANNEL", "Fabric channel.", func(c *Config, v string) error {
+		c.Fabric.Channel = v
+		return nil
+	}},
+	{"chaincode", "TOLL_CHAINCODE", "Fabric chaincode.", func(c *Config, v string) error {
+		c.Fabric.Chaincode = v
+		return nil
+	}},
+	{"org", "TOLL_ORG", "Fabric organization of Orgs to act for.", func(c *Config, v string) error {
+		c.Fabric.Org = v
+		return nil
+	}},
+	{"connection-profile", "TOLL_CONNECTION_PROFILE", "Fabric connection profile.", func(c *Config, v string) error {
+		c.Fabric.ConnectionProfile = v
+		return nil
+	}},
+	{"wallet", "TOLL_WALLET", "Directory of the Fabric wallet.", func(c *Config, v string) error {
+		c.Fabric.WalletPath = v
+		return nil
+	}},
+	{"msp-id", "TOLL_MSP_ID", "MSP id of the Fabric identity.", func(c *Config, v string) error {
+		c.Fabric.MspID = v
+		return nil
+	}},
+	{"identity", "TOLL_IDENTITY", "Label of the Fabric identity in the wallet.", func(c *Config, v string) error {
+		c.Fabric.Identity = v
+		return nil
+	}},
+	{"cred-path", "TOLL_CRED_PATH", "msp directory of the Fabric user.", func(c *Config, v string) error {
+		c.Fabric.CredPath = v
+		return nil
+	}},
+	{"cert", "TOLL_CERT", "Certificate of the Fabric identity.", func(c *Config, v string) error {
+		c.Fabric.CertPath = v
+		return nil
+	}},
+	{"key", "TOLL_KEY", "Private key of the Fabric identity.", func(c *Config, v string) error {
+		c.Fabric.KeyPath = v
+		return nil
+	}},
+	{"peer-endpoint", "TOLL_PEER_ENDPOINT", "host:port of the peer of the Fabric Gateway.", func(c *Config, v string) error {
+		c.Fabric.PeerEndpoint = v
+		return nil
+	}},
+	{"peer-host-override", "TOLL_PEER_HOST_OVERRIDE", "Name of the peer in its TLS certificate.", func(c *Config, v string) error {
+		c.Fabric.PeerHostOverride = v
+		return nil
+	}},
+	{"tls-cert", "TOLL_TLS_CERT", "CA certificate of the TLS of the peer.", func(c *Config, v string) error {
+		c.Fabric.TLSCertPath = v
+		return nil
+	}},
+	{"sazba", "TOLL_SAZBA_DIR", "Directory of the tariffs.", func(c *Config, v string) error {
+		c.SazbaDir = v
+		return nil
+	}},
+	{"model", "TOLL_MODEL", "Directory of the GPX files or manifest of the geographic model.", func(c *Config, v string) error {
+		c.Model = v
+		return nil
+	}},
+	{"review-file", "TOLL_REVIEW_FILE", "File of the tickets held for manual review.", func(c *Config, v string) error {
+		c.ReviewFile = v
+		return nil
+	}},
+	{"outbox-dir", "TOLL_OUTBOX_DIR", "Directory of the tickets waiting to be charged.", func(c *Config, v string) error {
+		c.Outbox.Dir = v
+		return nil
+	}},
+	{"workers", "TOLL_WORKERS", "Number of workers charging the tickets.", func(c *Config, v string) error {
+		return parseInt(v, &c.Outbox.Workers)
+	}},
+	{"retry-delay", "TOLL_RETRY_DELAY", "Delay of the first retry of a ticket, e.g. 1s.", func(c *Config, v string) error {
+		return parseDuration(v, &c.Outbox.RetryDelay)
+	}},
+	{"max-retry-delay", "TOLL_MAX_RETRY_DELAY", "Longest delay between retries of a ticket.", func(c *Config, v string) error {
+		return parseDuration(v, &c.Outbox.MaxRetryDelay)
+	}},
+}
+
+func parseDuration(v string, d *Duration) error {
+	t, err := time.ParseDuration(v)
+	*d = Duration(t)
+	return err
+}
+
+func parseInt(v string, i *int) error {
+	n, err := strconv.Atoi(v)
+	*i = n
+	return err
+}
+
+// LoadConfig reads the configuration file given by the flag -config, or the
+// environment variable TOLL_CONFIG, overrides it by the environment and the
+// flags in args and validates the result. A missing default file is not an
+// error.
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", "", fmt.Sprintf("Configuration file, %s by default.", DefaultConfigFile))
+	type setting struct {
+		o     option
+		value string
+	}
+	var flags []setting
+	for _, o := range options {
+		o := o
+		fs.Func(o.flag, fmt.Sprintf("%s Environment variable %s.", o.usage, o.env), func(v string) error {
+			flags = append(flags, setting{o, v})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := DefaultConfig()
+	filename := *configFile
+	if filename == "" {
+		filename = getenv("TOLL_CONFIG")
+	}
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("error: %s: %v", filename, err)
+		}
+	} else if err := readJsonFile(DefaultConfigFile, &c); err != nil {
+		return nil, err
+	}
+
+	for _, o := range options {
+		if v := getenv(o.env); v != "" {
+			if err := o.set(&c, v); err != nil {
+				return nil, fmt.Errorf("error: %s: %v", o.env, err)
+			}
+		}
+	}
+	for _, s := range flags {
+		if err := s.o.set(&c, s.value); err != nil {
+			return nil, fmt.Errorf("error: -%s: %v", s.o.flag, err)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate reports all invalid settings at once.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, a ...any) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		add("invalid port %d", c.Port)
+	}
+	if c.Ratio <= 0 {
+		add("ratio has to be positive")
+	}
+	if c.Charging != ChargeByDistance && c.Charging != ChargeBySection {
+		add("unknown charging %s", c.Charging)
+	}
+	switch c.DbType {
+	case DbJson:
+		if c.DbFile == "" {
+			add("missing DbFile of the JSON database")
+		}
+	case DbMemory:
+	case DbBlockchain, DbGateway:
+		if (c.DbType == DbBlockchain) != fabricSDK {
+			add("the %s database is not built in, the server is built with -tags fabricsdk for %s and without for %s",
+				c.DbType, DbBlockchain, DbGateway)
+		}
+		f := c.Fabric
+		if f.Channel == "" || f.Chaincode == "" || f.WalletPath == "" {
+			add("Fabric needs a channel, chaincode and wallet")
+		}
+		org, err := f.Organization()
+		switch {
+		case err != nil:
+			add("%v", strings.TrimPrefix(err.Error(), "error: "))
+		case c.DbType == DbBlockchain:
+			if _, err := os.Stat(org.ConnectionProfile); err != nil {
+				add("connection profile: %v", err)
+			}
+		default:
+			if org.PeerEndpoint == "" {
+				add("missing PeerEndpoint of the Fabric Gateway")
+			}
+			if _, err := os.Stat(org.TLSCertPath); err != nil {
+				add("TLS certificate: %v", err)
+			}
+			t := f.Timeouts
+			if t.Evaluate <= 0 || t.Endorse <= 0 || t.Submit <= 0 || t.CommitStatus <= 0 {
+				add("timeouts of the Fabric Gateway have to be positive")
+			}
+		}
+	default:
+		add("unknown database %s", c.DbType)
+	}
+	if info, err := os.Stat(c.SazbaDir); err != nil {
+		add("sazba: %v", err)
+	} else if !info.IsDir() {
+		add("sazba: %s is not a directory", c.SazbaDir)
+	}
+	if files, err := ModelFiles(c.Model); err != nil {
+		add("model: %v", strings.TrimPrefix(err.Error(), "error: "))
+	} else if len(files) == 0 {
+		add("model: no GPX file in %s", c.Model)
+	}
+	if c.ReviewFile == "" {
+		add("missing ReviewFile")
+	}
+	b := c.Outbox
+	if b.Dir == "" {
+		add("missing Dir of the Outbox")
+	}
+	if b.Workers < 1 || b.MaxAttempts < 1 {
+		add("the Outbox needs a worker and an attempt")
+	}
+	if b.RetryDelay <= 0 || b.MaxRetryDelay < b.RetryDelay || b.Retention <= 0 {
+		add("invalid retry delays or retention of the Outbox")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("error: invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test.json")
+	if err := os.WriteFile(file, []byte(`{"Port": 9000, "DbType": "JSON", "Fabric": {"Channel": "channel2"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"TOLL_PORT": "9001", "TOLL_CHAINCODE": "toll2"}
+	getenv := func(key string) string { return env[key] }
+
+	c, err := LoadConfig([]string{"-config", file, "-port", "9002"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the flag wins over the environment and the environment over the file
+	org, err := c.Fabric.Organization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 9002 || c.DbType != DbJson || c.Fabric.Channel != "channel2" ||
+		c.Fabric.Chaincode != "toll2" || org.MspID != "Org1MSP" {
+		t.Errorf("expected port 9002, JSON, channel2, toll2 and Org1MSP, but got %+v", c)
+	}
+
+	c, err = LoadConfig([]string{"-config", file, "-org", "Org2", "-identity", "admin"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org, err := c.Fabric.Organization(); err != nil || org.MspID != "Org2MSP" || org.Identity != "admin" ||
+		!strings.Contains(org.CredPath, "org2.example.com") {
+		t.Errorf("expected admin of Org2MSP, but got %+v, %v", org, err)
+	}
+
+	env["TOLL_CONFIG"] = file
+	c, err = LoadConfig([]string{"-model", "model"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 9001 || c.Model != "model" {
+		t.Errorf("expected port 9001 and the model directory, but got %+v", c)
+	}
+
+	// the other Fabric backend of the build
+	other := DbBlockchain
+	if fabricSDK {
+		other = DbGateway
+	}
+	tests := []struct {
+		args []string
+		exp  string
+	}{
+		{[]string{"-port", "0"}, "invalid port"},
+		{[]string{"-port", "x"}, "-port"},
+		{[]string{"-db", "Oracle"}, "unknown database"},
+		{[]string{"-ratio", "0"}, "ratio"},
+		{[]string{"-charging", "gantry"}, "unknown charging"},
+		{[]string{"-sazba", filepath.Join(dir, "none")}, "sazba"},
+		{[]string{"-model", "model/none.json"}, "model"},
+		{[]string{"-model", dir}, "no GPX file"},
+		{[]string{"-db", DbBlockchain, "-connection-profile", filepath.Join(dir, "none.yaml")}, "connection profile"},
+		{[]string{"-db", DbBlockchain, "-org", "Org9"}, "unknown organization"},
+		{[]string{"-db", DbGateway, "-tls-cert", filepath.Join(dir, "none.crt")}, "TLS certificate"},
+		{[]string{"-db", other}, "not built in"},
+	}
+	for _, test := range tests {
+		_, err := LoadConfig(test.args, getenv)
+		if err == nil || !strings.Contains(err.Error(), test.exp) {
+			t.Errorf("at input %v expected error '%s', but got %v", test.args, test.exp, err)
+		}
+	}
+}
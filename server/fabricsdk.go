@@ -0,0 +1,119 @@
+//go:build fabricsdk
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/errors/status"
+	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
+	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+)
+
+// fabricSDK is whether the server is built with the deprecated fabric-sdk-go
+// instead of the Fabric Gateway client. Both bring the protobuf messages of
+// Fabric, which must not be registered twice in one binary.
+const fabricSDK = true
+
+// NewGatewayLedger is not available with the tag fabricsdk.
+func NewGatewayLedger(c FabricConfig) (*FabricLedger, error) {
+	return nil, fmt.Errorf("error: the %s database needs the server built without the tag fabricsdk", DbGateway)
+}
+
+// sdkContract calls the chaincode by the fabric-sdk-go gateway.
+type sdkContract struct {
+	contract *gateway.Contract
+}
+
+func (s *sdkContract) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	result, err := s.contract.EvaluateTransaction(name, args...)
+	return result, sdkError(err)
+}
+
+func (s *sdkContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	result, err := s.contract.SubmitTransaction(name, args...)
+	return result, sdkError(err)
+}
+
+// sdkError recognizes err by chaincodeError, unless the peers or the
+// orderer could not be reached.
+func sdkError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if unavailable(err) {
+		return fmt.Errorf("%w: %v", ErrLedgerUnavailable, err)
+	}
+	return chaincodeError(err)
+}
+
+// unavailable reports whether the peers or the orderer could not be
+// reached.
+func unavailable(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch s.Group {
+	case status.GRPCTransportStatus:
+		return s.Code == int32(codes.Unavailable) || s.Code == int32(codes.DeadlineExceeded)
+	case status.EndorserClientStatus, status.OrdererClientStatus, status.ClientStatus:
+		return s.Code == int32(status.ConnectionFailed) || s.Code == int32(status.Timeout)
+	}
+	return false
+}
+
+// NewFabricLedger connects to the configured chaincode as the identity of
+// the configured organization. The identity is put into the wallet only if
+// the wallet does not have it yet.
+func NewFabricLedger(c FabricConfig) (*FabricLedger, error) {
+	org, err := c.Organization()
+	if err != nil {
+		return nil, err
+	}
+	err = os.Setenv("DISCOVERY_AS_LOCALHOST", "true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to set DISCOVERY_AS_LOCALHOST: %v", err)
+	}
+
+	wallet, err := openWallet(c.WalletPath, org)
+	if err != nil {
+		return nil, err
+	}
+	id, err := wallet.get(org.Identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity %s: %v", org.Identity, err)
+	}
+	ids := gateway.NewInMemoryWallet()
+	err = ids.Put(org.Identity, gateway.NewX509Identity(id.MspID, id.Credentials.Certificate, id.Credentials.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	gw, err := gateway.Connect(
+		gateway.WithConfig(config.FromFile(filepath.Clean(org.ConnectionProfile))),
+		gateway.WithIdentity(ids, org.Identity),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to connect to gateway: %v", ErrLedgerUnavailable, err)
+	}
+
+	channelName := c.Channel
+
+	log.Printf("--> Connecting to channel %s as %s of %s", channelName, org.Identity, org.MspID)
+	network, err := gw.GetNetwork(channelName)
+	if err != nil {
+		gw.Close()
+		return nil, fmt.Errorf("failed to get network: %v", err)
+	}
+
+	chaincodeName := c.Chaincode
+
+	log.Println("--> Using chaincode", chaincodeName)
+	return &FabricLedger{close: gw.Close, contract: &sdkContract{contract: network.GetContract(chaincodeName)}}, nil
+}
@@ -0,0 +1,199 @@
+//go:build !fabricsdk
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	gatewaypb "github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// fabricSDK is whether the server is built with the deprecated fabric-sdk-go
+// instead of the Fabric Gateway client. Both bring the protobuf messages of
+// Fabric, which must not be registered twice in one binary.
+const fabricSDK = false
+
+// NewFabricLedger is not available without the tag fabricsdk.
+func NewFabricLedger(c FabricConfig) (*FabricLedger, error) {
+	return nil, fmt.Errorf("error: the %s database needs the server built with -tags fabricsdk", DbBlockchain)
+}
+
+// gatewayContract calls the chaincode by the Fabric Gateway client. Every
+// step of a transaction has its own timeout: a submitted transaction is
+// endorsed, sent to the orderer and then waited for until it is committed.
+type gatewayContract struct {
+	contract *client.Contract
+	timeouts GatewayTimeouts
+}
+
+func (g *gatewayContract) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(g.timeouts.Evaluate))
+	defer cancel()
+	proposal, err := g.contract.NewProposal(name, client.WithArguments(args...))
+	if err != nil {
+		return nil, err
+	}
+	result, err := proposal.EvaluateWithContext(ctx)
+	return result, gatewayError(err)
+}
+
+func (g *gatewayContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	proposal, err := g.contract.NewProposal(name, client.WithArguments(args...))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(g.timeouts.Endorse))
+	defer cancel()
+	transaction, err := proposal.EndorseWithContext(ctx)
+	if err != nil {
+		return nil, gatewayError(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(g.timeouts.Submit))
+	defer cancel()
+	commit, err := transaction.SubmitWithContext(ctx)
+	if err != nil {
+		return nil, gatewayError(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(g.timeouts.CommitStatus))
+	defer cancel()
+	s, err := commit.StatusWithContext(ctx)
+	if err != nil {
+		return nil, gatewayError(err)
+	}
+	if !s.Successful {
+		return nil, gatewayError(&client.CommitError{TransactionID: s.TransactionID, Code: s.Code})
+	}
+	log.Printf("--> %s committed as %s in block %d", name, s.TransactionID, s.BlockNumber)
+	return transaction.Result(), nil
+}
+
+// gatewayError adds the messages of the peers, among them the error of the
+// chaincode, to err and recognizes it by chaincodeError. A transaction
+// which lost a conflict with another one may succeed later.
+func gatewayError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var commitErr *client.CommitError
+	if errors.As(err, &commitErr) {
+		msg := fmt.Sprintf("transaction %s failed to commit with status %s", commitErr.TransactionID, commitErr.Code)
+		switch commitErr.Code {
+		case peer.TxValidationCode_MVCC_READ_CONFLICT, peer.TxValidationCode_PHANTOM_READ_CONFLICT:
+			return fmt.Errorf("%w: %s", ErrLedgerUnavailable, msg)
+		}
+		return errors.New(msg)
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %v", ErrLedgerUnavailable, err)
+	}
+	var details []string
+	for _, d := range s.Details() {
+		if d, ok := d.(*gatewaypb.ErrorDetail); ok {
+			details = append(details, fmt.Sprintf("%s (%s): %s", d.Address, d.MspId, d.Message))
+		}
+	}
+	if len(details) > 0 {
+		err = fmt.Errorf("%v: %s", err, strings.Join(details, "; "))
+	}
+	return chaincodeError(err)
+}
+
+// NewGatewayLedger connects to the configured chaincode by the Fabric
+// Gateway client of the peer PeerEndpoint. The identity is taken from the
+// wallet, it is put into the wallet only if the wallet does not have it yet.
+func NewGatewayLedger(c FabricConfig) (*FabricLedger, error) {
+	org, err := c.Organization()
+	if err != nil {
+		return nil, err
+	}
+	wallet, err := openWallet(c.WalletPath, org)
+	if err != nil {
+		return nil, err
+	}
+	id, sign, err := walletSigner(wallet, org)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity %s: %v", org.Identity, err)
+	}
+
+	tlsCert, err := os.ReadFile(filepath.Clean(org.TLSCertPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	cert, err := identity.CertificateFromPEM(tlsCert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	conn, err := grpc.Dial(org.PeerEndpoint,
+		grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(pool, org.PeerHostOverride)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to connect to peer %s: %v", ErrLedgerUnavailable, org.PeerEndpoint, err)
+	}
+
+	gw, err := client.Connect(id, client.WithSign(sign), client.WithClientConnection(conn))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to gateway: %v", err)
+	}
+
+	log.Printf("--> Connecting to channel %s at %s as %s of %s", c.Channel, org.PeerEndpoint, org.Identity, org.MspID)
+	network := gw.GetNetwork(c.Channel)
+	log.Println("--> Using chaincode", c.Chaincode)
+	return &FabricLedger{
+		close: func() {
+			gw.Close()
+			conn.Close()
+		},
+		contract: &gatewayContract{contract: network.GetContract(c.Chaincode), timeouts: c.Timeouts},
+	}, nil
+}
+
+// walletSigner returns the X.509 identity of org in the wallet and the
+// signer by its private key.
+func walletSigner(wallet *wallet, org FabricOrg) (*identity.X509Identity, identity.Sign, error) {
+	x, err := wallet.get(org.Identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := identity.CertificateFromPEM([]byte(x.Credentials.Certificate))
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := identity.NewX509Identity(org.MspID, cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := identity.PrivateKeyFromPEM([]byte(x.Credentials.Key))
+	if err != nil {
+		return nil, nil, err
+	}
+	sign, err := identity.NewPrivateKeySign(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, sign, nil
+}
@@ -0,0 +1,71 @@
+//go:build !fabricsdk
+
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	gatewaypb "github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGatewayError(t *testing.T) {
+	endorse, err := status.New(codes.Aborted, "failed to endorse transaction").WithDetails(&gatewaypb.ErrorDetail{
+		Address: "peer0.org1.example.com:7051",
+		MspId:   "Org1MSP",
+		Message: "chaincode response 500, the obu 1 CZ 2 does not exist",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		err error
+		exp error
+	}{
+		{endorse.Err(), ErrObuNotFound},
+		{status.Error(codes.Unavailable, "connection refused"), ErrLedgerUnavailable},
+		{status.Error(codes.DeadlineExceeded, "context deadline exceeded"), ErrLedgerUnavailable},
+		{&client.CommitError{TransactionID: "tx1", Code: peer.TxValidationCode_MVCC_READ_CONFLICT}, ErrLedgerUnavailable},
+	}
+	for _, test := range tests {
+		if got := gatewayError(test.err); !errors.Is(got, test.exp) {
+			t.Errorf("at input %v expected %v, but got %v", test.err, test.exp, got)
+		}
+	}
+
+	err = gatewayError(&client.CommitError{TransactionID: "tx2", Code: peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE})
+	if err == nil || errors.Is(err, ErrLedgerUnavailable) || err.Error() != "transaction tx2 failed to commit with status ENDORSEMENT_POLICY_FAILURE" {
+		t.Errorf("expected a failed commit of tx2, but got %v", err)
+	}
+}
+
+// failingContract fails every call by err.
+type failingContract struct {
+	err error
+}
+
+func (f failingContract) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	return nil, f.err
+}
+
+func (f failingContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	return nil, f.err
+}
+
+func TestFabricLedgerError(t *testing.T) {
+	f := &FabricLedger{contract: failingContract{gatewayError(status.Error(codes.Unavailable, "connection refused"))}}
+	_, err := f.GetObu("1", "1AB", "CZ")
+	if !errors.Is(err, ErrLedgerUnavailable) || strings.Count(err.Error(), ErrLedgerUnavailable.Error()) != 1 {
+		t.Errorf("expected the ledger unavailable once, but got %v", err)
+	}
+	f.contract = failingContract{gatewayError(status.Error(codes.Aborted, "the obu 1 does not exist"))}
+	err = f.UpdateObu("1", "1AB", "CZ", "EURO 6", 3000, 2)
+	if !errors.Is(err, ErrObuNotFound) || strings.Count(err.Error(), ErrObuNotFound.Error()) != 1 {
+		t.Errorf("expected the obu not found once, but got %v", err)
+	}
+}
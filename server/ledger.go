@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Ledger is a store of OBUs and their payments. The Fabric ledger is the
+// production backend, the others serve development and tests.
+type Ledger interface {
+	GetObu(id, spz, country string) (*OnBoardUnit, error)
+	CreateObu(o *OnBoardUnit) error
+	UpdateObu(id, spz, country, newEmission string, newWeight, newAxles int) error
+	// SetTollAmount charges the OBU by tx.Amount, records the trip and
+	// refreshes o with the stored state. A ticket is charged only once, a
+	// tx.TicketID repeated by the OBU fails with ErrDuplicateTicket. A prepaid account
+	// without enough credit fails with ErrInsufficientCredit.
+	SetTollAmount(o *OnBoardUnit, tx *TollTransaction) error
+	// GetTicket returns the trip recorded for the ticket of the OBU or
+	// ErrTicketNotFound.
+	GetTicket(id, spz, country, ticketID string) (*TollTransaction, error)
+	SetNullCredit(id, spz, country string) error
+	// TopUpCredit adds amount to the credit of a prepaid account.
+	TopUpCredit(id, spz, country string, amount float64) (*OnBoardUnit, error)
+	// SettleInvoice pays amount of the debt of a postpaid account.
+	SettleInvoice(id, spz, country string, amount float64) (*OnBoardUnit, error)
+	// SetAccount switches an OBU with zero credit to another account.
+	SetAccount(id, spz, country, account string) (*OnBoardUnit, error)
+	DeleteObu(id, spz, country string) error
+	GetAllObus() ([]*OnBoardUnit, error)
+	// GetObuTransactions lists the trips of the OBU ordered by time.
+	GetObuTransactions(id, spz, country string) ([]*TollTransaction, error)
+	// GetTransactionsByTime lists the trips which began within [from, to).
+	GetTransactionsByTime(from, to time.Time) ([]*TollTransaction, error)
+	Close()
+}
+
+const (
+	DbBlockchain = "Blockchain"
+	DbGateway    = "Gateway" // the Fabric Gateway client
+	DbJson       = "JSON"
+	DbMemory     = "Memory"
+)
+
+var (
+	ErrObuNotFound     = errors.New("obu does not exist")
+	ErrObuExists       = errors.New("obu already exists")
+	ErrTicketNotFound  = errors.New("ticket does not exist")
+	ErrDuplicateTicket = errors.New("ticket has already been processed")
+
+	ErrInsufficientCredit = errors.New("insufficient credit")
+	ErrInvalidAccount     = errors.New("invalid account operation")
+
+	// ErrLedgerUnavailable is returned when the backend cannot be reached,
+	// the request may succeed later.
+	ErrLedgerUnavailable = errors.New("ledger is unavailable")
+)
+
+// InitDb opens the ledger of the configured type.
+func InitDb(c *Config) (Ledger, error) {
+	switch c.DbType {
+	case DbJson:
+		return NewJSONLedger(c.DbFile)
+	case DbMemory:
+		return NewMemoryLedger(), nil
+	case DbBlockchain, "":
+		return NewFabricLedger(c.Fabric)
+	case DbGateway:
+		return NewGatewayLedger(c.Fabric)
+	default:
+		return nil, fmt.Errorf("error: unknown database %s", c.DbType)
+	}
+}
@@ -0,0 +1,413 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryLedger keeps OBUs in memory. It follows the semantics of the
+// asset-toll chaincode, an OBU is identified by the triple ID, SPZ and
+// Country. When created by NewJSONLedger every change is also written into
+// a JSON file.
+type MemoryLedger struct {
+	mu       sync.Mutex
+	obuList  []OnBoardUnit
+	txList   []TollTransaction
+	filename string
+}
+
+// ledgerFile is the JSON file of a ledger created by NewJSONLedger. The OBUs
+// and their trips are written together, so a charged credit is never saved
+// without its trip.
+type ledgerFile struct {
+	Obus         []OnBoardUnit     `json:"obus"`
+	Transactions []TollTransaction `json:"transactions"`
+}
+
+// NewMemoryLedger returns a ledger holding the given OBUs.
+func NewMemoryLedger(obuList ...OnBoardUnit) *MemoryLedger {
+	return &MemoryLedger{obuList: append([]OnBoardUnit{}, obuList...)}
+}
+
+// NewJSONLedger returns a ledger backed by the JSON file filename of the OBUs
+// and their trips, or of a list of OBUs only. A missing file is an empty
+// ledger, it is created on the first change.
+func NewJSONLedger(filename string) (*MemoryLedger, error) {
+	m := &MemoryLedger{filename: filename}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return m, nil
+	}
+	if data[0] == '[' {
+		err = json.Unmarshal(data, &m.obuList)
+	} else {
+		var f ledgerFile
+		err = json.Unmarshal(data, &f)
+		m.obuList, m.txList = f.Obus, f.Transactions
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error: %s: %v", filename, err)
+	}
+	return m, nil
+}
+
+func readJsonFile(filename string, v any) error {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error: %s: %v", filename, err)
+	}
+	return nil
+}
+
+func (m *MemoryLedger) GetObu(id, spz, country string) (*OnBoardUnit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.find(id, spz, country)
+	if err != nil {
+		return nil, err
+	}
+	o := m.obuList[i]
+	return &o, nil
+}
+
+func (m *MemoryLedger) UpdateObu(id, spz, country, newEmission string, newWeight, newAxles int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.find(id, spz, country)
+	if err != nil {
+		return err
+	}
+	old := m.obuList[i]
+	m.obuList[i].Emission = newEmission
+	m.obuList[i].Weight = newWeight
+	m.obuList[i].Axles = newAxles
+	if err := m.save(); err != nil {
+		m.obuList[i] = old
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryLedger) SetTollAmount(o *OnBoardUnit, tx *TollTransaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.find(o.ID, o.SPZ, o.Country)
+	if err != nil {
+		return err
+	}
+	if tx.TicketID != "" && m.findTicket(o.ID, o.SPZ, o.Country, tx.TicketID) != -1 {
+		return fmt.Errorf("%w: %s", ErrDuplicateTicket, tx.TicketID)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	record := *tx
+	record.TxID = fmt.Sprintf("%d-%d", time.Now().UnixNano(), len(m.txList))
+	record.ObuID = o.ID
+	record.SPZ = o.SPZ
+	record.Country = o.Country
+	record.Currency = m.obuList[i].Currency
+	record.Timestamp = now
+	if t, err := time.Parse(time.RFC3339, record.Time); err == nil {
+		record.Time = t.UTC().Format(time.RFC3339)
+	} else {
+		record.Time = now
+	}
+
+	old := m.obuList[i]
+	if err := chargeObu(&m.obuList[i], tx.Amount); err != nil {
+		return err
+	}
+	m.txList = append(m.txList, record)
+	if err := m.save(); err != nil {
+		m.obuList[i] = old
+		m.txList = m.txList[:len(m.txList)-1]
+		return err
+	}
+	*o = m.obuList[i]
+	*tx = record
+	return nil
+}
+
+func (m *MemoryLedger) GetTicket(id, spz, country, ticketID string) (*TollTransaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findTicket(id, spz, country, ticketID)
+	if i == -1 {
+		return nil, fmt.Errorf("%w: %s", ErrTicketNotFound, ticketID)
+	}
+	tx := m.txList[i]
+	return &tx, nil
+}
+
+func (m *MemoryLedger) SetNullCredit(id, spz, country string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.find(id, spz, country)
+	if err != nil {
+		return err
+	}
+	old := m.obuList[i]
+	m.obuList[i].Credit = 0
+	if err := m.save(); err != nil {
+		m.obuList[i] = old
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryLedger) TopUpCredit(id, spz, country string, amount float64) (*OnBoardUnit, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: amount %.2f", ErrInvalidAccount, amount)
+	}
+	return m.updateAccount(id, spz, country, func(o *OnBoardUnit) error {
+		if o.Account != AccountPrepaid {
+			return fmt.Errorf("%w: the obu %s does not have a prepaid account", ErrInvalidAccount, id)
+		}
+		o.Credit += amount
+		return nil
+	})
+}
+
+func (m *MemoryLedger) SettleInvoice(id, spz, country string, amount float64) (*OnBoardUnit, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: amount %.2f", ErrInvalidAccount, amount)
+	}
+	return m.updateAccount(id, spz, country, func(o *OnBoardUnit) error {
+		if o.Account == AccountPrepaid {
+			return fmt.Errorf("%w: the obu %s does not have a postpaid account", ErrInvalidAccount, id)
+		}
+		if amount > o.Credit {
+			return fmt.Errorf("%w: amount %.2f exceeds the debt %.2f", ErrInvalidAccount, amount, o.Credit)
+		}
+		o.Credit -= amount
+		return nil
+	})
+}
+
+func (m *MemoryLedger) SetAccount(id, spz, country, account string) (*OnBoardUnit, error) {
+	if account != AccountPrepaid && account != AccountPostpaid {
+		return nil, fmt.Errorf("%w: unknown account %s", ErrInvalidAccount, account)
+	}
+	return m.updateAccount(id, spz, country, func(o *OnBoardUnit) error {
+		if o.Credit != 0 {
+			return fmt.Errorf("%w: the obu %s has to have zero credit to change its account", ErrInvalidAccount, id)
+		}
+		o.Account = account
+		return nil
+	})
+}
+
+func (m *MemoryLedger) updateAccount(id, spz, country string, update func(*OnBoardUnit) error) (*OnBoardUnit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.find(id, spz, country)
+	if err != nil {
+		return nil, err
+	}
+	o := m.obuList[i]
+	if err := update(&o); err != nil {
+		return nil, err
+	}
+	old := m.obuList[i]
+	m.obuList[i] = o
+	if err := m.save(); err != nil {
+		m.obuList[i] = old
+		return nil, err
+	}
+	return &o, nil
+}
+
+// chargeObu takes the toll from the credit of a prepaid account or adds it
+// to the debt of a postpaid one, as the chaincode does.
+func chargeObu(o *OnBoardUnit, amount float64) error {
+	if o.Account != AccountPrepaid {
+		o.Credit += amount
+		return nil
+	}
+	if o.Credit < amount {
+		return fmt.Errorf("%w: %.2f %s of the obu %s for the toll %.2f",
+			ErrInsufficientCredit, o.Credit, o.Currency, o.ID, amount)
+	}
+	o.Credit -= amount
+	return nil
+}
+
+func (m *MemoryLedger) CreateObu(o *OnBoardUnit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	account := o.Account
+	if account == "" {
+		account = AccountPostpaid
+	}
+	if account != AccountPrepaid && account != AccountPostpaid {
+		return fmt.Errorf("%w: unknown account %s", ErrInvalidAccount, account)
+	}
+	if _, err := m.find(o.ID, o.SPZ, o.Country); err == nil {
+		return fmt.Errorf("%w: the onBoardUnit %s already exists", ErrObuExists, o.ID)
+	}
+	obu := OnBoardUnit{
+		ID:       o.ID,
+		SPZ:      o.SPZ,
+		Country:  o.Country,
+		Credit:   0.0,
+		Currency: o.Currency,
+		Emission: o.Emission,
+		Category: o.Category,
+		Account:  account,
+		Weight:   o.Weight,
+		Axles:    o.Axles,
+	}
+	m.obuList = append(m.obuList, obu)
+	if err := m.save(); err != nil {
+		m.obuList = m.obuList[:len(m.obuList)-1]
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryLedger) DeleteObu(id, spz, country string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.find(id, spz, country)
+	if err != nil {
+		return err
+	}
+	old := m.obuList
+	m.obuList = append(append([]OnBoardUnit{}, old[:i]...), old[i+1:]...)
+	if err := m.save(); err != nil {
+		m.obuList = old
+		return err
+	}
+	return nil
+}
+
+func (m *MemoryLedger) GetAllObus() ([]*OnBoardUnit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var obuList []*OnBoardUnit
+	for _, o := range m.obuList {
+		obu := o
+		obuList = append(obuList, &obu)
+	}
+	return obuList, nil
+}
+
+func (m *MemoryLedger) GetObuTransactions(id, spz, country string) ([]*TollTransaction, error) {
+	return m.transactions(func(tx *TollTransaction) bool {
+		return tx.ObuID == id && tx.SPZ == spz && tx.Country == country
+	})
+}
+
+func (m *MemoryLedger) GetTransactionsByTime(from, to time.Time) ([]*TollTransaction, error) {
+	return m.transactions(func(tx *TollTransaction) bool {
+		t, err := time.Parse(time.RFC3339, tx.Time)
+		if err != nil {
+			return false
+		}
+		return !t.Before(from) && t.Before(to)
+	})
+}
+
+func (m *MemoryLedger) transactions(match func(*TollTransaction) bool) ([]*TollTransaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var txList []*TollTransaction
+	for _, tx := range m.txList {
+		record := tx
+		if match(&record) {
+			txList = append(txList, &record)
+		}
+	}
+	sort.SliceStable(txList, func(i, j int) bool {
+		return txList[i].Time < txList[j].Time
+	})
+	return txList, nil
+}
+
+func (m *MemoryLedger) Close() {}
+
+func (m *MemoryLedger) find(id, spz, country string) (int, error) {
+	for i, o := range m.obuList {
+		if o.ID == id && o.SPZ == spz && o.Country == country {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%w: %s~%s~%s", ErrObuNotFound, id, spz, country)
+}
+
+func (m *MemoryLedger) findTicket(id, spz, country, ticketID string) int {
+	for i, tx := range m.txList {
+		if tx.TicketID == ticketID && tx.ObuID == id && tx.SPZ == spz && tx.Country == country {
+			return i
+		}
+	}
+	return -1
+}
+
+// save writes the OBUs and their trips into a temporary file first and then
+// renames it, so the database file is never left half written.
+func (m *MemoryLedger) save() error {
+	if m.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ledgerFile{Obus: m.obuList, Transactions: m.txList}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.filename, data)
+}
+
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONLedger(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "obuList.json")
+	l, err := NewJSONLedger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := OnBoardUnit{ID: "1", SPZ: "1SA1234", Country: "CZ", Currency: "CZK",
+		Weight: 8500, Emission: "6", Category: "N", Axles: 4}
+	if err := l.CreateObu(&o); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateObu(&o); err == nil {
+		t.Errorf("expected an error creating the same OBU twice")
+	}
+	if err := l.SetTollAmount(&o, &TollTransaction{Amount: 10.5, Time: "2023-05-02T10:00:00+02:00"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetTollAmount(&o, &TollTransaction{Amount: 2, Time: "2023-05-01T10:00:00+02:00"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewJSONLedger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reopened.GetObu("1", "1SA1234", "CZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Credit != 12.5 || got.Category != "N" {
+		t.Errorf("expected credit 12.50 and category N, but got %.2f and '%s'", got.Credit, got.Category)
+	}
+	txList, err := reopened.GetObuTransactions("1", "1SA1234", "CZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txList) != 2 || txList[0].Amount != 2 || txList[0].Time != "2023-05-01T08:00:00Z" {
+		t.Errorf("expected two trips ordered by time, but got %+v", txList)
+	}
+	if _, err := reopened.GetObu("1", "1SA1234", "SK"); !errors.Is(err, ErrObuNotFound) {
+		t.Errorf("expected ErrObuNotFound, but got %v", err)
+	}
+	if _, err := reopened.TopUpCredit("1", "1SA1234", "CZ", 10); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("top up of a postpaid account: expected ErrInvalidAccount, but got %v", err)
+	}
+	if o, err := reopened.SettleInvoice("1", "1SA1234", "CZ", 12.5); err != nil || o.Credit != 0 {
+		t.Errorf("expected the debt settled, but got %v, %v", o, err)
+	}
+	if err := reopened.DeleteObu("1", "1SA1234", "CZ"); err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := reopened.GetAllObus(); len(all) != 0 {
+		t.Errorf("expected an empty ledger, but got %d OBUs", len(all))
+	}
+}
+
+// TestJSONLedgerList opens a file of a list of OBUs, it is written with their
+// trips on the first change.
+func TestJSONLedgerList(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "obuList.json")
+	if err := os.WriteFile(filename, []byte(`[{"ID": "1", "SPZ": "1SA1234", "Country": "CZ", "Credit": 3}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewJSONLedger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := OnBoardUnit{ID: "1", SPZ: "1SA1234", Country: "CZ"}
+	if err := l.SetTollAmount(&o, &TollTransaction{TicketID: "t1", Amount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewJSONLedger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx, err := reopened.GetTicket("1", "1SA1234", "CZ", "t1"); err != nil || tx.Amount != 2 {
+		t.Errorf("expected the trip of 2.00 saved with the OBU, but got %v, %v", tx, err)
+	}
+	if got, _ := reopened.GetObu("1", "1SA1234", "CZ"); got == nil || got.Credit != 5 {
+		t.Errorf("expected credit 5.00, but got %v", got)
+	}
+}
+
+func TestPrepaidAccount(t *testing.T) {
+	o := OnBoardUnit{ID: "1", SPZ: "1SA1234", Country: "CZ", Account: AccountPrepaid}
+	l := NewMemoryLedger()
+	if err := l.CreateObu(&o); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetTollAmount(&o, &TollTransaction{Amount: 5}); !errors.Is(err, ErrInsufficientCredit) {
+		t.Errorf("expected ErrInsufficientCredit, but got %v", err)
+	}
+	if _, err := l.TopUpCredit("1", "1SA1234", "CZ", 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetTollAmount(&o, &TollTransaction{Amount: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Credit != 15 {
+		t.Errorf("expected credit 15.00, but got %.2f", o.Credit)
+	}
+	if txList, _ := l.GetObuTransactions("1", "1SA1234", "CZ"); len(txList) != 1 {
+		t.Errorf("expected only the charged trip recorded, but got %d", len(txList))
+	}
+}
+
+func TestTicketOfObu(t *testing.T) {
+	l := NewMemoryLedger()
+	a := OnBoardUnit{ID: "1", SPZ: "1SA1234", Country: "CZ"}
+	b := OnBoardUnit{ID: "2", SPZ: "1SB5678", Country: "CZ"}
+	for _, o := range []*OnBoardUnit{&a, &b} {
+		if err := l.CreateObu(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.SetTollAmount(&a, &TollTransaction{TicketID: "t1", Amount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetTollAmount(&a, &TollTransaction{TicketID: "t1", Amount: 10}); !errors.Is(err, ErrDuplicateTicket) {
+		t.Errorf("expected ErrDuplicateTicket, but got %v", err)
+	}
+	// the same ID chosen by another OBU is its own ticket
+	if err := l.SetTollAmount(&b, &TollTransaction{TicketID: "t1", Amount: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err := l.GetTicket("2", "1SB5678", "CZ", "t1"); err != nil || tx.Amount != 3 {
+		t.Errorf("expected the trip of 3.00 of OBU 2, but got %v, %v", tx, err)
+	}
+	if _, err := l.GetTicket("2", "1SB5678", "CZ", "t2"); !errors.Is(err, ErrTicketNotFound) {
+		t.Errorf("expected ErrTicketNotFound, but got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// Manifest lists the GPX files of the road sections of the geographic model,
+// relative to the manifest. The order of the files is the order of the
+// roads the OBUs refer to.
+type Manifest struct {
+	Files []string `json:"files"`
+}
+
+// modelSnapshot is the geographic model in use with its checksum.
+type modelSnapshot struct {
+	roads    []WptRecords
+	checksum string
+}
+
+// model is the geographic model in use. It is replaced as a whole, so a
+// request holding it never sees a half-built one.
+var model atomic.Pointer[modelSnapshot]
+
+// CurrentModel returns the road sections of the geographic model in use.
+// They must not be modified.
+func CurrentModel() []WptRecords {
+	if m := model.Load(); m != nil {
+		return m.roads
+	}
+	return nil
+}
+
+func setModel(m []WptRecords) {
+	model.Store(&modelSnapshot{roads: m, checksum: modelChecksum(m)})
+}
+
+// ModelChecksum identifies the geographic model on the ledger, where the
+// trips are charged by the distances and the road classes of the model of
+// this checksum. It is the SHA-256 of the JSON of the road sections, the
+// chaincode computes it the same way when the model is published.
+func ModelChecksum(m []WptRecords) string {
+	if s := model.Load(); s != nil && len(m) > 0 && len(m) == len(s.roads) && &m[0] == &s.roads[0] {
+		return s.checksum
+	}
+	return modelChecksum(m)
+}
+
+func modelChecksum(m []WptRecords) string {
+	data, _ := json.Marshal(m)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// ModelFiles lists the GPX files of the geographic model at path, a manifest
+// or a directory of the files in the order of their names.
+func ModelFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error: %v", err)
+	}
+	if info.IsDir() {
+		files, err := filepath.Glob(filepath.Join(path, "*.gpx"))
+		if err != nil {
+			return nil, fmt.Errorf("error: %v", err)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error: %v", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error: %s: %v", path, err)
+	}
+	var files []string
+	for _, f := range m.Files {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(filepath.Dir(path), f)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// LoadModel reads the geographic model at path, see ModelFiles. The model in
+// use is replaced only if the new one is valid.
+func LoadModel(path string) error {
+	files, err := ModelFiles(path)
+	if err != nil {
+		return err
+	}
+	if err := loadModel(files...); err != nil {
+		return fmt.Errorf("%v (%s)", err, path)
+	}
+	return nil
+}
+
+func loadModel(files ...string) error {
+	m, err := readModel(files...)
+	if err != nil {
+		return err
+	}
+	setModel(m)
+	return nil
+}
+
+// readModel reads and validates the road sections of the GPX files.
+func readModel(files ...string) ([]WptRecords, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("error: no road section in the geographic model")
+	}
+	var m []WptRecords
+	names := map[string]bool{}
+	for _, f := range files {
+		var route WptRecords
+		if err := readGpx(f, &route); err != nil {
+			return nil, err
+		}
+		if route.Len == 0 {
+			return nil, fmt.Errorf("error: %s: %s has no points", f, route.Name)
+		}
+		if names[route.Name] {
+			return nil, fmt.Errorf("error: %s: repeated road section %s", f, route.Name)
+		}
+		names[route.Name] = true
+		m = append(m, route)
+	}
+	if err := validateSections(m); err != nil {
+		return nil, err
+	}
+	if err := validateClasses(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -3,15 +3,14 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-
-	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
-	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+	"strings"
+	"time"
 )
 
+// OnBoardUnit is a vehicle registered for tolling. The Credit of a prepaid
+// account is its balance, of a postpaid account its debt.
 type OnBoardUnit struct {
+	Account  string  `json:"Account"`
 	Axles    int     `json:"Axles"`
 	Country  string  `json:"Country"`
 	Credit   float64 `json:"Credit"`
@@ -23,208 +22,199 @@ type OnBoardUnit struct {
 	Category string  `json:"Category"`
 }
 
-var gw *gateway.Gateway
-var contract *gateway.Contract
+// Accounts of OBUs, an OBU without an account is postpaid.
+const (
+	AccountPrepaid  = "prepaid"
+	AccountPostpaid = "postpaid"
+)
 
-// var obuJsonList []OnBoardUnit
+// FabricLedger keeps OBUs in the asset-toll chaincode, reached by the Fabric
+// Gateway client, or by the deprecated fabric-sdk-go gateway in a server
+// built with the tag fabricsdk.
+type FabricLedger struct {
+	close    func()
+	contract contract
+}
 
-func GetObu(id, spz, country, dbType string) (*OnBoardUnit, error) {
-	if contract == nil {
-		return nil, fmt.Errorf("error: database %s is not initialized", dbType)
+// contract evaluates and submits transactions of the chaincode. A submitted
+// transaction returns after it has been committed. The errors are already
+// recognized by chaincodeError.
+type contract interface {
+	EvaluateTransaction(name string, args ...string) ([]byte, error)
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+}
 
-	}
-	result, err := contract.EvaluateTransaction("ReadObu", id, spz, country)
+func (f *FabricLedger) GetObu(id, spz, country string) (*OnBoardUnit, error) {
+	result, err := f.contract.EvaluateTransaction("ReadObu", id, spz, country)
 	if err != nil {
-		return nil, err 
+		return nil, err
 	}
 	var o OnBoardUnit
-	_ = json.Unmarshal(result, &o)
+	err = json.Unmarshal(result, &o)
+	if err != nil {
+		return nil, err
+	}
 	return &o, nil
 }
 
-func UpdateObu(id, spz, country, newEmission, newWeight, newAxles string, dbType string) error {
-	if contract == nil {
-		return fmt.Errorf("error: database %s is not initialized", dbType)
+func (f *FabricLedger) UpdateObu(id, spz, country, newEmission string, newWeight, newAxles int) error {
+	_, err := f.contract.SubmitTransaction("UpdateObu", id, spz, country, newEmission,
+		fmt.Sprintf("%d", newWeight), fmt.Sprintf("%d", newAxles))
+	return err
+}
 
+func (f *FabricLedger) SetTollAmount(o *OnBoardUnit, tx *TollTransaction) error {
+	trip, err := json.Marshal(tx)
+	if err != nil {
+		return err
 	}
-	_, err := contract.SubmitTransaction("UpdateObu", id, spz, country, newEmission, newWeight, newAxles)
+	// the chaincode derives the segments from the check-points on its model
+	// and prices them by the tariff on the ledger, so the endorsed trip
+	// replaces the one computed here
+	result, err := f.contract.SubmitTransaction("ChargeTrip", o.ID, o.SPZ, o.Country, string(trip))
 	if err != nil {
-		return err 
+		return err
 	}
-	return nil
+	charge := struct {
+		Obu         *OnBoardUnit
+		Transaction *TollTransaction
+	}{o, tx}
+	return json.Unmarshal(result, &charge)
 }
 
-func SetTollAmount(o *OnBoardUnit, amount float64, dbType string) error {
-	if contract == nil {
-		return fmt.Errorf("error: database %s is not initialized", dbType)
+func (f *FabricLedger) GetTicket(id, spz, country, ticketID string) (*TollTransaction, error) {
+	result, err := f.contract.EvaluateTransaction("TicketExists", id, spz, country, ticketID)
+	if err != nil {
+		return nil, err
 	}
-
-	obuByte, err := contract.SubmitTransaction("TollRoadObu", o.ID, o.SPZ, o.Country, fmt.Sprintf("%.2f", amount))
+	if string(result) != "true" {
+		return nil, fmt.Errorf("%w: %s", ErrTicketNotFound, ticketID)
+	}
+	result, err = f.contract.EvaluateTransaction("ReadTicket", id, spz, country, ticketID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = json.Unmarshal(obuByte, o)
+	var tx TollTransaction
+	err = json.Unmarshal(result, &tx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return &tx, nil
 }
 
-func SetNullCredit(id, spz, country, dbType string) error{
-	if contract == nil {
-		return fmt.Errorf("error: database %s is not initialized", dbType)
-		
-	}
+func (f *FabricLedger) SetNullCredit(id, spz, country string) error {
+	_, err := f.contract.SubmitTransaction("SetNullCredit", id, spz, country)
+	return err
+}
 
-	_, err := contract.SubmitTransaction("SetNullCredit", id, spz, country)
-	if err != nil {
-		return fmt.Errorf("%v", err)
-	}
-	return nil
+func (f *FabricLedger) CreateObu(o *OnBoardUnit) error {
+	_, err := f.contract.SubmitTransaction("CreateObu", o.ID, o.SPZ, o.Country, o.Currency, o.Emission, o.Category, fmt.Sprintf("%d", o.Weight), fmt.Sprintf("%d", o.Axles), o.Account)
+	return err
 }
 
-func CreateObu(o *OnBoardUnit, dbType string) error {
-	if contract == nil {
-		return fmt.Errorf("error: database %s is not initialized", dbType)
-	}
+func (f *FabricLedger) TopUpCredit(id, spz, country string, amount float64) (*OnBoardUnit, error) {
+	return f.submitObu("TopUpCredit", id, spz, country, fmt.Sprintf("%.2f", amount))
+}
 
-	_, err := contract.SubmitTransaction("CreateObu", o.ID, o.SPZ, o.Country, o.Currency, o.Emission, o.Category, fmt.Sprintf("%d", o.Weight), fmt.Sprintf("%d", o.Axles))
-	if err != nil {
-		return err 
-	}
-	return nil
+func (f *FabricLedger) SettleInvoice(id, spz, country string, amount float64) (*OnBoardUnit, error) {
+	return f.submitObu("SettleInvoice", id, spz, country, fmt.Sprintf("%.2f", amount))
+}
 
+func (f *FabricLedger) SetAccount(id, spz, country, account string) (*OnBoardUnit, error) {
+	return f.submitObu("SetAccount", id, spz, country, account)
 }
 
-func DeleteObu(id, spz, country string, dbType string) error {
-	if contract == nil {
-		return fmt.Errorf("error: database %s is not initialized", dbType)
+func (f *FabricLedger) submitObu(name string, args ...string) (*OnBoardUnit, error) {
+	result, err := f.contract.SubmitTransaction(name, args...)
+	if err != nil {
+		return nil, err
 	}
-	_, err := contract.SubmitTransaction("DeleteObu", id, spz, country)
+	var o OnBoardUnit
+	err = json.Unmarshal(result, &o)
 	if err != nil {
-		return err 
+		return nil, err
 	}
-	return nil
+	return &o, nil
 }
 
-func InitDb(dbType string) {
-	switch dbType {
-	case "JSON":
-		initDbJson(filepath.Join("obu", "obuList.json"))
-	default:
-		initDbBlockchain("channel1", "toll")
-	
-	}
+func (f *FabricLedger) DeleteObu(id, spz, country string) error {
+	_, err := f.contract.SubmitTransaction("DeleteObu", id, spz, country)
+	return err
 }
 
-func initDbBlockchain(chname string, ccname string) {
-	err := os.Setenv("DISCOVERY_AS_LOCALHOST", "true")
+func (f *FabricLedger) GetAllObus() ([]*OnBoardUnit, error) {
+	result, err := f.contract.EvaluateTransaction("GetAllObus")
 	if err != nil {
-		log.Fatalf("Error setting DISCOVERY_AS_LOCALHOST environment variable: %v", err)
+		return nil, err
 	}
-
-	walletPath := "wallet"
-	// remove any existing wallet from prior runs
-	os.RemoveAll(walletPath)
-	wallet, err := gateway.NewFileSystemWallet(walletPath)
-	if err != nil {
-		log.Fatalf("Failed to create wallet: %v", err)
-	}
-
-	if !wallet.Exists("appUser") {
-		err = populateWallet(wallet)
-		if err != nil {
-			log.Fatalf("Failed to populate wallet contents: %v", err)
-		}
-	}
-	var ccpPath string = filepath.Join(
-		"..",
-		"..",
-		"fabric",
-		"fabric-samples",
-		"test-network",
-		"organizations",
-		"peerOrganizations",
-		"org1.example.com",
-		"connection-org1.yaml",
-	)
-
-	gw, err = gateway.Connect(
-		gateway.WithConfig(config.FromFile(filepath.Clean(ccpPath))),
-		gateway.WithIdentity(wallet, "appUser"),
-	)
-	if err != nil {
-		log.Fatalf("Failed to connect to gateway: %v", err)
+	var obuList []*OnBoardUnit
+	if len(result) == 0 {
+		return obuList, nil
 	}
-
-	channelName := chname
-
-	log.Println("--> Connecting to channel", channelName)
-	network, err := gw.GetNetwork(channelName)
+	err = json.Unmarshal(result, &obuList)
 	if err != nil {
-		log.Fatalf("Failed to get network: %v", err)
+		return nil, err
 	}
-
-	chaincodeName := ccname
-
-	log.Println("--> Using chaincode", chaincodeName)
-	contract = network.GetContract(chaincodeName)
-	// result, err := contract.EvaluateTransaction("GetAllObus")
-	// if err != nil {
-	// 	log.Fatalf("Failed to evaluate transaction: %v", err)
-	// }
-	// fmt.Println(string(result))
-}
-
-func initDbJson(filepath string) {
-
+	return obuList, nil
 }
 
-func CloseDbBlockchain() {
-	if gw != nil {
-		gw.Close()
+func (f *FabricLedger) GetObuTransactions(id, spz, country string) ([]*TollTransaction, error) {
+	result, err := f.contract.EvaluateTransaction("GetObuTransactions", id, spz, country)
+	if err != nil {
+		return nil, err
 	}
+	return unmarshalTransactions(result)
 }
 
-func populateWallet(wallet *gateway.Wallet) error {
-	log.Println("============ Populating wallet ============")
-	credPath := filepath.Join(
-		"..",
-		"..",
-		"fabric",
-		"fabric-samples",
-		"test-network",
-		"organizations",
-		"peerOrganizations",
-		"org1.example.com",
-		"users",
-		"User1@org1.example.com",
-		"msp",
-	)
-
-	certPath := filepath.Join(credPath, "signcerts", "cert.pem")
-	// read the certificate pem
-	cert, err := os.ReadFile(filepath.Clean(certPath))
+func (f *FabricLedger) GetTransactionsByTime(from, to time.Time) ([]*TollTransaction, error) {
+	result, err := f.contract.EvaluateTransaction("GetTransactionsByTime", from.Format(time.RFC3339), to.Format(time.RFC3339))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return unmarshalTransactions(result)
+}
 
-	keyDir := filepath.Join(credPath, "keystore")
-	// there's a single file in this dir containing the private key
-	files, err := os.ReadDir(keyDir)
-	if err != nil {
-		return err
-	}
-	if len(files) != 1 {
-		return fmt.Errorf("keystore folder should have contain one file")
+func unmarshalTransactions(result []byte) ([]*TollTransaction, error) {
+	var txList []*TollTransaction
+	if len(result) == 0 {
+		return txList, nil
 	}
-	keyPath := filepath.Join(keyDir, files[0].Name())
-	key, err := os.ReadFile(filepath.Clean(keyPath))
+	err := json.Unmarshal(result, &txList)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return txList, nil
+}
 
-	identity := gateway.NewX509Identity("Org1MSP", string(cert), string(key))
+// chaincodeError recognizes errors of the chaincode, which reach the
+// client as plain messages.
+func chaincodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "is not allowed to"):
+		// the identity of the server is not of the toll operator
+		return err
+	case strings.Contains(msg, "the obu") && strings.Contains(msg, "does not exist"):
+		return fmt.Errorf("%w: %v", ErrObuNotFound, err)
+	case strings.Contains(msg, "the ticket") && strings.Contains(msg, "does not exist"):
+		return fmt.Errorf("%w: %v", ErrTicketNotFound, err)
+	case strings.Contains(msg, "already exists"):
+		return fmt.Errorf("%w: %v", ErrObuExists, err)
+	case strings.Contains(msg, "has already been processed"):
+		return fmt.Errorf("%w: %v", ErrDuplicateTicket, err)
+	case strings.Contains(msg, "insufficient credit"):
+		return fmt.Errorf("%w: %v", ErrInsufficientCredit, err)
+	case strings.Contains(msg, "account"), strings.Contains(msg, "exceeds the debt"), strings.Contains(msg, "invalid amount"):
+		return fmt.Errorf("%w: %v", ErrInvalidAccount, err)
+	}
+	return err
+}
 
-	return wallet.Put("appUser", identity)
+func (f *FabricLedger) Close() {
+	if f.close != nil {
+		f.close()
+	}
 }
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a ticket in the outbox.
+const (
+	TicketPending = "pending" // waiting to be charged on the ledger
+	TicketCharged = "charged"
+	TicketFailed  = "failed" // refused by the ledger, Code tells why
+)
+
+// OutboxTicket is a ticket accepted from an OBU and priced by the server.
+// It stays in the outbox until the ledger charges or refuses it. A ticket
+// accepted while the ledger was unavailable keeps the Ticket of the OBU
+// until it is priced.
+type OutboxTicket struct {
+	TicketID    string          `json:"TicketID"`
+	Obu         OnBoardUnit     `json:"Obu"`              // as sent by the OBU, as stored once charged
+	Transaction TollTransaction `json:"Transaction"`      // as priced by the server, as recorded once charged
+	Ticket      json.RawMessage `json:"Ticket,omitempty"` // not priced yet
+	State       string          `json:"State"`
+	Duplicate   bool            `json:"Duplicate"` // charged by an earlier submission
+	Attempts    int             `json:"Attempts"`
+	NextAttempt time.Time       `json:"NextAttempt"`
+	Code        string          `json:"Code,omitempty"`
+	Error       string          `json:"Error,omitempty"` // of the last attempt
+	Received    time.Time       `json:"Received"`
+	Updated     time.Time       `json:"Updated"`
+}
+
+// TicketKey identifies a ticket. Ticket IDs are chosen by the OBUs, so the
+// same ID sent by two OBUs is two tickets.
+type TicketKey struct {
+	ObuID    string
+	SPZ      string
+	Country  string
+	TicketID string
+}
+
+func (t OutboxTicket) Key() TicketKey {
+	return TicketKey{t.Obu.ID, t.Obu.SPZ, t.Obu.Country, t.TicketID}
+}
+
+// Outbox keeps the accepted tickets, one JSON file for each of them in its
+// directory unless the directory is empty, so that no ticket is lost while
+// the ledger is unreachable or the server restarts. A change rewrites only
+// the file of its ticket. Charged and failed tickets are dropped after the
+// retention.
+type Outbox struct {
+	mu        sync.Mutex
+	tickets   []OutboxTicket
+	claimed   map[TicketKey]bool // tickets being charged by a worker
+	dir       string
+	retention time.Duration
+	ready     chan struct{}
+}
+
+func NewOutbox(dir string, retention time.Duration) (*Outbox, error) {
+	o := &Outbox{
+		claimed:   make(map[TicketKey]bool),
+		dir:       dir,
+		retention: retention,
+		ready:     make(chan struct{}, 1),
+	}
+	if dir == "" {
+		return o, nil
+	}
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		var t OutboxTicket
+		if err := readJsonFile(filepath.Join(dir, f.Name()), &t); err != nil {
+			return nil, err
+		}
+		o.tickets = append(o.tickets, t)
+	}
+	sort.SliceStable(o.tickets, func(i, j int) bool { return o.tickets[i].Received.Before(o.tickets[j].Received) })
+	return o, nil
+}
+
+// Add accepts a pending ticket. A ticket of the same OBU and ID is returned
+// instead unless it has failed, then it is replaced to be tried again.
+func (o *Outbox) Add(t OutboxTicket) (OutboxTicket, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now().UTC()
+	i := o.find(t.Key())
+	if i >= 0 && o.tickets[i].State != TicketFailed {
+		return o.tickets[i], false, nil
+	}
+	t.State = TicketPending
+	t.Attempts = 0
+	t.NextAttempt = now
+	t.Code, t.Error = "", ""
+	t.Received, t.Updated = now, now
+	if err := o.save(t); err != nil {
+		return t, false, err
+	}
+	if i >= 0 {
+		o.tickets = append(o.tickets[:i], o.tickets[i+1:]...)
+	}
+	o.tickets = append(o.tickets, t)
+	o.prune(now)
+	o.signal()
+	return t, true, nil
+}
+
+// Get returns the ticket of the key.
+func (o *Outbox) Get(key TicketKey) (OutboxTicket, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	i := o.find(key)
+	if i < 0 {
+		return OutboxTicket{}, false
+	}
+	return o.tickets[i], true
+}
+
+// Next claims the pending ticket waiting longest whose attempt is due at
+// now. The claim ends by Retry, Charge or Fail of the ticket.
+func (o *Outbox) Next(now time.Time) (OutboxTicket, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	next := -1
+	for i, t := range o.tickets {
+		if t.State != TicketPending || o.claimed[t.Key()] || t.NextAttempt.After(now) {
+			continue
+		}
+		if next < 0 || t.NextAttempt.Before(o.tickets[next].NextAttempt) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return OutboxTicket{}, false
+	}
+	o.claimed[o.tickets[next].Key()] = true
+	// wake another worker for the rest of the due tickets
+	o.signal()
+	return o.tickets[next], true
+}
+
+// NextAttempt returns the time of the earliest attempt of an unclaimed
+// pending ticket.
+func (o *Outbox) NextAttempt() (time.Time, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var next time.Time
+	found := false
+	for _, t := range o.tickets {
+		if t.State == TicketPending && !o.claimed[t.Key()] && (!found || t.NextAttempt.Before(next)) {
+			next, found = t.NextAttempt, true
+		}
+	}
+	return next, found
+}
+
+// Ready is signalled when a ticket may have become due.
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+// Retry schedules another attempt of the claimed ticket at the time at.
+func (o *Outbox) Retry(key TicketKey, code, msg string, at time.Time) error {
+	return o.update(key, func(t *OutboxTicket) {
+		t.Attempts++
+		t.NextAttempt = at
+		t.Code, t.Error = code, msg
+	})
+}
+
+// Charge records the charged ticket with the OBU and the trip stored on the
+// ledger.
+func (o *Outbox) Charge(key TicketKey, obu OnBoardUnit, tx TollTransaction, duplicate bool) error {
+	return o.update(key, func(t *OutboxTicket) {
+		t.Attempts++
+		t.State = TicketCharged
+		t.Obu, t.Transaction, t.Duplicate = obu, tx, duplicate
+		t.Ticket = nil
+		t.Code, t.Error = "", ""
+	})
+}
+
+// Fail records the ticket refused by the ledger, it is not tried again.
+func (o *Outbox) Fail(key TicketKey, code, msg string) error {
+	return o.update(key, func(t *OutboxTicket) {
+		t.Attempts++
+		t.State = TicketFailed
+		t.Code, t.Error = code, msg
+	})
+}
+
+// Remove drops the claimed ticket, e.g. one held for manual review.
+func (o *Outbox) Remove(key TicketKey) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.claimed, key)
+	i := o.find(key)
+	if i < 0 {
+		return nil
+	}
+	if err := o.remove(key); err != nil {
+		return err
+	}
+	o.tickets = append(o.tickets[:i], o.tickets[i+1:]...)
+	o.prune(time.Now().UTC())
+	return nil
+}
+
+// update changes the claimed ticket and ends the claim, the change is kept
+// only if it is saved.
+func (o *Outbox) update(key TicketKey, change func(t *OutboxTicket)) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.claimed, key)
+	i := o.find(key)
+	if i < 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	t := o.tickets[i]
+	change(&t)
+	t.Updated = now
+	if err := o.save(t); err != nil {
+		return err
+	}
+	o.tickets[i] = t
+	o.prune(now)
+	o.signal()
+	return nil
+}
+
+// prune drops the charged and failed tickets kept longer than the retention.
+// A file which cannot be removed is tried again by the next change.
+func (o *Outbox) prune(now time.Time) {
+	tickets := o.tickets[:0]
+	for _, t := range o.tickets {
+		expired := t.State != TicketPending && now.Sub(t.Updated) > o.retention
+		if expired && o.remove(t.Key()) == nil {
+			continue
+		}
+		tickets = append(tickets, t)
+	}
+	o.tickets = tickets
+}
+
+func (o *Outbox) find(key TicketKey) int {
+	for i, t := range o.tickets {
+		if t.Key() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (o *Outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// file returns the file of the ticket, named by a hash of its key as the
+// ticket IDs are chosen by the OBUs.
+func (o *Outbox) file(key TicketKey) string {
+	data, _ := json.Marshal(key)
+	return filepath.Join(o.dir, fmt.Sprintf("%x.json", sha256.Sum256(data)))
+}
+
+func (o *Outbox) save(t OutboxTicket) error {
+	if o.dir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.file(t.Key()), data)
+}
+
+func (o *Outbox) remove(key TicketKey) error {
+	if o.dir == "" {
+		return nil
+	}
+	err := os.Remove(o.file(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
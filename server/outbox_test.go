@@ -0,0 +1,129 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	o, err := NewOutbox(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obu := OnBoardUnit{ID: "obu", SPZ: "1AB", Country: "CZ"}
+	key := func(id string) TicketKey { return TicketKey{obu.ID, obu.SPZ, obu.Country, id} }
+	for _, id := range []string{"a", "b"} {
+		if _, added, err := o.Add(OutboxTicket{TicketID: id, Obu: obu}); err != nil || !added {
+			t.Fatalf("expected ticket %s added, but got %v %v", id, added, err)
+		}
+	}
+	if q, added, _ := o.Add(OutboxTicket{TicketID: "a", Obu: obu}); added || q.State != TicketPending {
+		t.Errorf("expected the pending ticket a returned, but got %v %+v", added, q)
+	}
+	// the same ID of another OBU is another ticket
+	other := OutboxTicket{TicketID: "a", Obu: OnBoardUnit{ID: "other", SPZ: "2AB", Country: "CZ"}}
+	if _, added, err := o.Add(other); err != nil || !added {
+		t.Errorf("expected ticket a of another OBU added, but got %v %v", added, err)
+	}
+	if q, ok := o.Get(key("a")); !ok || q.Obu.ID != obu.ID {
+		t.Errorf("expected ticket a of %s, but got %+v", obu.ID, q)
+	}
+
+	now := time.Now()
+	a, _ := o.Next(now)
+	b, _ := o.Next(now)
+	c, _ := o.Next(now)
+	if _, ok := o.Next(now); ok || a.Key() != key("a") || b.Key() != key("b") || c.Key() != other.Key() {
+		t.Errorf("expected tickets a, b and a of another OBU claimed once, but got %+v, %+v and %+v",
+			a.Key(), b.Key(), c.Key())
+	}
+	if err := o.Charge(other.Key(), other.Obu, TollTransaction{TxID: "other"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Retry(key("a"), "ledger_unavailable", "peer is down", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Fail(key("b"), "insufficient_credit", "insufficient credit"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.Next(now); ok {
+		t.Errorf("expected no ticket due before the retry")
+	}
+	if next, ok := o.NextAttempt(); !ok || !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the retry of a in a minute, but got %v", next)
+	}
+
+	// the tickets survive a restart
+	o, err = NewOutbox(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, ok := o.Get(key("a")); !ok || q.State != TicketPending || q.Attempts != 1 || q.Code != "ledger_unavailable" {
+		t.Errorf("expected ticket a pending after one attempt, but got %+v", q)
+	}
+	if q, ok := o.Get(key("b")); !ok || q.State != TicketFailed {
+		t.Errorf("expected ticket b failed, but got %+v", q)
+	}
+	// a failed ticket is tried again when it is resubmitted
+	if q, added, _ := o.Add(OutboxTicket{TicketID: "b", Obu: obu}); !added || q.State != TicketPending || q.Attempts != 0 {
+		t.Errorf("expected ticket b pending again, but got %v %+v", added, q)
+	}
+
+	// b waits longer since its resubmission came before the retry of a
+	b, _ = o.Next(now.Add(time.Hour))
+	a, _ = o.Next(now.Add(time.Hour))
+	if b.TicketID != "b" || a.TicketID != "a" {
+		t.Fatalf("expected tickets b and a due, but got %s and %s", b.TicketID, a.TicketID)
+	}
+	if err := o.Charge(key("a"), obu, TollTransaction{TxID: "tx", Amount: 10}, false); err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := o.Get(key("a")); q.State != TicketCharged || q.Transaction.TxID != "tx" || q.Attempts != 2 {
+		t.Errorf("expected ticket a charged by tx, but got %+v", q)
+	}
+}
+
+// TestOutboxPrune drops the tickets past the retention by any change of the
+// outbox, with their files.
+func TestOutboxPrune(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obu := OnBoardUnit{ID: "obu", SPZ: "1AB", Country: "CZ"}
+	for _, id := range []string{"a", "b"} {
+		if _, _, err := o.Add(OutboxTicket{TicketID: id, Obu: obu}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := o.Next(time.Now())
+	if err := o.Charge(a.Key(), obu, TollTransaction{TxID: "tx"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("expected a file for each ticket, but got %d", len(files))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	b, _ := o.Next(time.Now())
+	if err := o.Retry(b.Key(), "ledger_unavailable", "peer is down", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.Get(a.Key()); ok {
+		t.Errorf("expected the charged ticket dropped after the retention")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected the file of the pending ticket only, but got %d", len(files))
+	}
+	o, err = NewOutbox(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.Get(b.Key()); !ok || a.TicketID != "a" || b.TicketID != "b" {
+		t.Errorf("expected ticket b kept, but got %+v", b)
+	}
+}
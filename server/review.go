@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// HeldTicket is a ticket the tariff cannot price. Instead of charging zero
+// it waits for an operator to correct the OBU or the tariff, after which the
+// OBU's retry of the ticket is charged.
+type HeldTicket struct {
+	TicketID string          `json:"TicketID"`
+	ObuID    string          `json:"ObuID"`
+	SPZ      string          `json:"SPZ"`
+	Country  string          `json:"Country"`
+	Reason   string          `json:"Reason"` // Reason of the TariffError
+	Message  string          `json:"Message"`
+	Ticket   json.RawMessage `json:"Ticket"`
+	Time     string          `json:"Time"` // when it was held, RFC3339
+}
+
+func (h HeldTicket) Key() TicketKey {
+	return TicketKey{h.ObuID, h.SPZ, h.Country, h.TicketID}
+}
+
+// ReviewQueue keeps the held tickets, in a JSON file unless its filename is
+// empty.
+type ReviewQueue struct {
+	mu       sync.Mutex
+	held     []HeldTicket
+	filename string
+}
+
+func NewReviewQueue(filename string) (*ReviewQueue, error) {
+	q := &ReviewQueue{filename: filename}
+	if filename == "" {
+		return q, nil
+	}
+	if err := readJsonFile(filename, &q.held); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Hold adds the ticket to the queue, a held ticket of the same OBU and ID
+// is replaced.
+func (q *ReviewQueue) Hold(h HeldTicket) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	held := q.held
+	q.held = nil
+	for _, o := range held {
+		if o.Key() != h.Key() {
+			q.held = append(q.held, o)
+		}
+	}
+	q.held = append(q.held, h)
+	if err := q.save(); err != nil {
+		q.held = held
+		return err
+	}
+	return nil
+}
+
+// Release removes the ticket from the queue, it is not an error if the
+// ticket has not been held.
+func (q *ReviewQueue) Release(key TicketKey) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, h := range q.held {
+		if h.Key() == key {
+			held := q.held
+			q.held = append(append([]HeldTicket{}, held[:i]...), held[i+1:]...)
+			if err := q.save(); err != nil {
+				q.held = held
+				return err
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// List returns the held tickets in the order they were held.
+func (q *ReviewQueue) List() []HeldTicket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]HeldTicket{}, q.held...)
+}
+
+func (q *ReviewQueue) save() error {
+	if q.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(q.held, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.filename, data)
+}
@@ -3,22 +3,35 @@ package server
 import (
 	"fmt"
 	"math"
-	"os"
-	"strconv"
 
-	"github.com/beevik/etree"
+	"github.com/Solamil/bp23/geo/gpx"
 )
 
 const earthRadius = 6371000 // Radius of the Earth in meters
 
 type WptRecords struct {
-	LatRad    []float64 `json:"latRad"`
-	LonRad    []float64 `json:"lonRad"`
-	Distances []float64 `json:"distances"`
-	Version   string    `json:"version"`
-	Len       int       `json:"len"`
-	Name      string    `json:"name"`
-	Checksum  string    `json:"checksum"`
+	LatRad    []float64         `json:"latRad"`
+	LonRad    []float64         `json:"lonRad"`
+	Distances []float64         `json:"distances"`
+	Version   string            `json:"version"`
+	Len       int               `json:"len"`
+	Name      string            `json:"name"`
+	Class     string            `json:"class"` // road class of the tariff
+	Checksum  string            `json:"checksum"`
+	Chainage  []float64         `json:"-"` // meters along the section to its points
+	Sections  []ChargingSection `json:"sections,omitempty"`
+}
+
+// reversalTolerance is how many meters the vehicle has to go back along a
+// section to have turned, a shorter step back is the error of the positions.
+const reversalTolerance = 50
+
+// Passage is the drive along a road section between its check-points.
+type Passage struct {
+	Entry     float64 // meters along the section where the vehicle entered it
+	Exit      float64 // and where it left it
+	Distance  float64 // meters driven along the section
+	Reversals int     // turns to the opposite direction
 }
 
 type Polygon struct {
@@ -27,55 +40,105 @@ type Polygon struct {
 	Time []string `json:"time"`
 }
 
-var Model []WptRecords
-
-func LoadModel() {
-	var model []WptRecords
-	var route1 WptRecords
-	readGpx("model/i35.gpx", &route1)
-	model = append(model, route1)
-
-	var route2 WptRecords
-	readGpx("model/d10.gpx", &route2)
-	model = append(model, route2)
-	Model = model
-}
-
-func readGpx(filename string, route *WptRecords) {
-	result, err := os.Open(filename)
-	if os.IsNotExist(err) {
-		return
-	}
+func readGpx(filename string, route *WptRecords) error {
+	g, err := gpx.Read(filename)
 	if err != nil {
-		fmt.Printf("error %s", err)
-		return
+		return err
+	}
+	if g.Title == "" || g.Version == "" {
+		return fmt.Errorf("error: %s: missing title or version", filename)
+	}
+	route.Name = g.Title
+	route.Version = g.Version
+	for _, e := range g.Extensions {
+		if e.Tag == "road" {
+			route.Class = e.Attrs["class"]
+		}
+	}
+	if route.Class == "" {
+		return fmt.Errorf("error: %s: missing road class", filename)
 	}
-	defer result.Close()
 
-	doc := etree.NewDocument()
-	if err := doc.ReadFromFile(filename); err != nil {
-		fmt.Println(err)
-		return
+	// the chainage of the points runs along one polyline
+	segments := g.Segments()
+	if len(segments) > 1 {
+		return fmt.Errorf("error: %s: %d segments, a road section is one polyline", filename, len(segments))
+	}
+	var points []gpx.Point
+	if len(segments) == 1 {
+		points = segments[0]
 	}
-	root := doc.SelectElement("gpx")
-	name := root.SelectElement("title").Text()
-	route.Name = name
-	route.Version = root.SelectElement("version").Text()
-
-	for _, e := range root.SelectElements("wpt") {
-		latStr := e.SelectAttrValue("lat", "0.0")
-		latDeg, _ := strconv.ParseFloat(latStr, 64)
-		latRad := degreesToRadians(latDeg)
-		route.LatRad = append(route.LatRad, latRad)
-
-		lonStr := e.SelectAttrValue("lon", "0.0")
-		lonDeg, _ := strconv.ParseFloat(lonStr, 64)
-		lonRad := degreesToRadians(lonDeg)
-		route.LonRad = append(route.LonRad, lonRad)
+	for _, p := range points {
+		route.LatRad = append(route.LatRad, degreesToRadians(p.Lat))
+		route.LonRad = append(route.LonRad, degreesToRadians(p.Lon))
 		route.Distances = append(route.Distances, 0.0)
 	}
 	route.Len = len(route.LonRad)
+	route.Chainage = chainage(route.LatRad, route.LonRad)
+	if err := readSections(route, g.Extensions); err != nil {
+		return fmt.Errorf("error: %s: %v", filename, err)
+	}
+	return nil
+}
+
+// validateClasses checks that the loaded tariffs price the road classes of
+// the road sections and of their charging sections.
+func validateClasses(model []WptRecords) error {
+	for _, r := range model {
+		if err := checkRoadClass(r.Class); err != nil {
+			return fmt.Errorf("error: %s: %v", r.Name, err)
+		}
+		for _, s := range r.Sections {
+			if err := checkRoadClass(s.Class); err != nil {
+				return fmt.Errorf("error: %s: section %s: %v", r.Name, s.Name, err)
+			}
+		}
+	}
+	return nil
+}
 
+// chainage returns the distance along the polyline to each of its points.
+func chainage(latRad, lonRad []float64) []float64 {
+	c := make([]float64, len(latRad))
+	for j := 1; j < len(c); j++ {
+		c[j] = c[j-1] + Haversine(latRad[j-1], lonRad[j-1], latRad[j], lonRad[j])
+	}
+	return c
+}
+
+// Drive returns the passage through the points of the section in the order
+// they were driven. The distance is measured along the section, so the points
+// skipped between the check-points are driven too, and a vehicle turning
+// back is charged for both directions.
+func (r *WptRecords) Drive(points []int) Passage {
+	if len(points) == 0 {
+		return Passage{}
+	}
+	c := r.Chainage
+	if len(c) != r.Len {
+		c = chainage(r.LatRad, r.LonRad)
+	}
+	var p Passage
+	p.Entry = c[points[0]]
+	// from start the vehicle drove in the direction dir up to extreme
+	start, extreme, dir := p.Entry, p.Entry, 0.0
+	for _, j := range points[1:] {
+		x := c[j]
+		switch {
+		case dir == 0 || (x-extreme)*dir > 0:
+			if x != extreme {
+				dir = math.Copysign(1, x-start)
+			}
+			extreme = x
+		case math.Abs(x-extreme) > reversalTolerance:
+			p.Distance += math.Abs(extreme - start)
+			p.Reversals++
+			start, extreme, dir = extreme, x, -dir
+		}
+	}
+	p.Distance += math.Abs(extreme - start)
+	p.Exit = c[points[len(points)-1]]
+	return p
 }
 
 func degreesToRadians(degrees float64) float64 {
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadModel(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	track := write("track.gpx", `<gpx><title>D11</title><version>1</version><trk>
+		<trkseg><trkpt lat="50.0" lon="15.0"/><trkpt lat="50.1" lon="15.1"/><trkpt lat="50.2" lon="15.2"/></trkseg></trk>
+		<extensions><road class="D"/></extensions></gpx>`)
+	split := write("split.gpx", `<gpx><title>D11</title><version>1</version><trk>
+		<trkseg><trkpt lat="50.0" lon="15.0"/><trkpt lat="50.1" lon="15.1"/></trkseg>
+		<trkseg><trkpt lat="50.2" lon="15.2"/></trkseg></trk>
+		<extensions><road class="D"/></extensions></gpx>`)
+	untitled := write("untitled.gpx", `<gpx><wpt lat="50.0" lon="15.0"/></gpx>`)
+	malformed := write("malformed.gpx", `<gpx><title>D11</title><version>1</version><wpt lat="50.0" lon=""/></gpx>`)
+	unclassed := write("unclassed.gpx", `<gpx><title>R35</title><version>1</version><wpt lat="50.0" lon="15.0"/></gpx>`)
+	unknown := write("unknown.gpx", `<gpx><title>R35</title><version>1</version><wpt lat="50.0" lon="15.0"/>
+		<extensions><road class="R"/></extensions></gpx>`)
+	unknownSection := write("section.gpx", `<gpx><title>D11</title><version>1</version>
+		<wpt lat="50.0" lon="15.0"/><wpt lat="50.1" lon="15.1"/>
+		<extensions><road class="D"/><section name="D11-1" length="100" class="R" start="0" end="1"/></extensions></gpx>`)
+
+	if err := LoadSazba(DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer setModel(CurrentModel())
+	if err := loadModel(track); err != nil {
+		t.Fatal(err)
+	}
+	m := CurrentModel()
+	if len(m) != 1 || m[0].Name != "D11" || m[0].Class != "D" || m[0].Len != 3 || len(m[0].Distances) != 3 {
+		t.Errorf("expected D11 of the class D of 3 points, but got %+v", m)
+	}
+	tests := [][]string{
+		{untitled}, {malformed}, {split}, {unclassed}, {unknown}, {unknownSection},
+		{filepath.Join(dir, "none.gpx")}, {}, {track, track},
+	}
+	for _, files := range tests {
+		if err := loadModel(files...); err == nil {
+			t.Errorf("at input %v expected an error", files)
+		}
+		if m := CurrentModel(); len(m) != 1 || m[0].Name != "D11" {
+			t.Errorf("expected the model kept after an error, but got %+v", m)
+		}
+	}
+}
+
+func TestModelFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"i35.gpx", "d10.gpx", "readme.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := filepath.Join(dir, "manifest.json")
+	if err := os.WriteFile(manifest, []byte(`{"files": ["i35.gpx", "d10.gpx"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	malformed := filepath.Join(dir, "malformed.json")
+	if err := os.WriteFile(malformed, []byte(`["i35.gpx"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		files []string
+	}{
+		{dir, []string{"d10.gpx", "i35.gpx"}},
+		{manifest, []string{"i35.gpx", "d10.gpx"}},
+	}
+	for _, test := range tests {
+		files, err := ModelFiles(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, filepath.Base(f))
+			if filepath.Dir(f) != dir {
+				t.Errorf("expected %s in %s", f, dir)
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(test.files, ",") {
+			t.Errorf("at input %s expected %v, but got %v", filepath.Base(test.path), test.files, names)
+		}
+	}
+	for _, path := range []string{malformed, filepath.Join(dir, "none.json")} {
+		if _, err := ModelFiles(path); err == nil {
+			t.Errorf("at input %s expected an error", filepath.Base(path))
+		}
+	}
+
+	// the model of the server
+	if err := LoadSazba(DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer setModel(CurrentModel())
+	if err := LoadModel(DefaultConfig().Model); err != nil {
+		t.Fatal(err)
+	}
+	if m := CurrentModel(); len(m) != 2 || m[0].Name != "I35" || m[1].Name != "D10" {
+		t.Errorf("expected I35 and D10, but got %d road sections", len(m))
+	}
+}
+
+func TestDrive(t *testing.T) {
+	// 11 points 20 m apart
+	var r WptRecords
+	for j := 0; j <= 10; j++ {
+		r.LatRad = append(r.LatRad, 0.88)
+		r.LonRad = append(r.LonRad, 0.26+float64(j)*20/earthRadius/math.Cos(0.88))
+	}
+	r.Len = len(r.LatRad)
+	r.Chainage = chainage(r.LatRad, r.LonRad)
+
+	tests := []struct {
+		points    []int
+		distance  float64
+		entry     float64
+		exit      float64
+		reversals int
+	}{
+		{[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 200, 0, 200, 0},
+		{[]int{0, 5, 10}, 200, 0, 200, 0},
+		{[]int{10, 8, 5}, 100, 200, 100, 0},
+		{[]int{0, 2, 1, 3, 5}, 100, 0, 100, 0},
+		{[]int{0, 10, 2}, 360, 0, 40, 1},
+		{[]int{2, 9, 1, 8}, 140 + 160 + 140, 40, 160, 2},
+		{[]int{3}, 0, 60, 60, 0},
+	}
+	for _, test := range tests {
+		p := r.Drive(test.points)
+		if math.Abs(p.Distance-test.distance) > 0.01 || math.Abs(p.Entry-test.entry) > 0.01 ||
+			math.Abs(p.Exit-test.exit) > 0.01 || p.Reversals != test.reversals {
+			t.Errorf("at input %v expected %.0f m from %.0f to %.0f with %d reversals, but got %+v",
+				test.points, test.distance, test.entry, test.exit, test.reversals, p)
+		}
+	}
+}
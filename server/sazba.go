@@ -2,192 +2,522 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"strings"
+	"path/filepath"
+	"sort"
 	"time"
+	_ "time/tzdata" // the time zones of a host without zoneinfo, the ledger prices by its own
 )
 
-type weight struct {
-	Axles2 float64 `json:"2"`
-	Axles3 float64 `json:"3"`
-	Axles4 float64 `json:"4"`
-	Axles5 float64 `json:"5"`
+// Tariff is a tariff document of the regulator. Every dimension of the
+// charge is a keyed list, so new categories, emission classes, weight bands,
+// axles, road classes or time bands are a change of data only. The tariff is
+// in force from ValidFrom up to, but not including, ValidTo. Its time bands
+// are by the clock of TimeZone, whatever the offset of the check-points.
+type Tariff struct {
+	Version     string          `json:"version"`
+	ValidFrom   string          `json:"validFrom"` // RFC3339
+	ValidTo     string          `json:"validTo"`   // RFC3339, empty if open ended
+	Currency    string          `json:"currency"`
+	TimeZone    string          `json:"timeZone"` // IANA name, e.g. Europe/Prague
+	Ratio       float64         `json:"ratio"`    // meters charged by a rate, Ratio if 0
+	RoadClasses []RoadClass     `json:"roadClasses"`
+	TimeBands   []TimeBandRule  `json:"timeBands"`
+	Categories  []Category      `json:"categories"`
+	Emissions   []EmissionClass `json:"emissions"`
+	Weights     []WeightBand    `json:"weights"`
+	Rates       []Rate          `json:"rates"`
+
+	rates     map[rateKey]float64
+	validFrom time.Time
+	validTo   time.Time // zero if open ended
+	location  *time.Location
+}
+
+// RoadClass is a class of the roads charged by the same rates, e.g. the
+// motorways. A road section of the model names its class.
+type RoadClass struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// TimeBandRule is a part of the day from From up to To, in the time zone of
+// the tariff. A band with To before From goes over midnight.
+type TimeBandRule struct {
+	ID   string `json:"id"`
+	From string `json:"from"` // HH:MM
+	To   string `json:"to"`   // HH:MM
+
+	from, to int // minutes of the day
+}
+
+// Category of a vehicle. Vehicles with more axles than MaxAxles are charged
+// as with MaxAxles.
+type Category struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases"`
+	MinAxles int      `json:"minAxles"`
+	MaxAxles int      `json:"maxAxles"`
 }
 
-type emission struct {
-	W3575 weight `json:"35-75"`
-	W7512 weight `json:"75-12"`
-	W12   weight `json:"12"`
+type EmissionClass struct {
+	ID      string   `json:"id"`
+	Aliases []string `json:"aliases"`
 }
 
-type vehicle struct {
-	E04   emission `json:"0-4"`
-	E5EEV emission `json:"5-EEV"`
-	E6    emission `json:"6"`
-	Ecng  emission `json:"CNG"`
+// WeightBand covers weights in kilograms from Min up to, but not including,
+// Max. Max 0 has no upper limit.
+type WeightBand struct {
+	ID  string `json:"id"`
+	Min int    `json:"min"`
+	Max int    `json:"max"`
 }
 
-type Sazba struct {
-	N  vehicle `json:"N"`
-	M2 vehicle `json:"M2"`
-	// m3 vehicle `json:"M3"`
+// Rate is the charge for the ratio of meters driven by a vehicle of the given
+// dimensions.
+type Rate struct {
+	Road     string  `json:"road"`
+	Time     string  `json:"time"`
+	Category string  `json:"category"`
+	Emission string  `json:"emission"`
+	Weight   string  `json:"weight"`
+	Axles    int     `json:"axles"`
+	Rate     float64 `json:"rate"`
+}
+
+type rateKey struct {
+	road, time, category, emission, weight string
+	axles                                  int
+}
+
+// Errors of pricing a charge by a dimension the tariff does not know.
+var (
+	ErrNoTariff        = errors.New("no tariff is in force")
+	ErrInvalidTime     = errors.New("invalid time")
+	ErrUnknownRoad     = errors.New("unknown road class")
+	ErrUnknownCategory = errors.New("category does not exist")
+	ErrUnknownEmission = errors.New("emission class does not exist")
+	ErrUnknownWeight   = errors.New("weight does not belong to any weight band")
+	ErrUnknownAxles    = errors.New("number of axles has no rate")
+)
+
+// Machine readable reasons of a TariffError.
+const (
+	ReasonNoTariff        = "no_tariff"
+	ReasonInvalidTime     = "invalid_time"
+	ReasonUnknownRoad     = "unknown_road"
+	ReasonUnknownCategory = "unknown_category"
+	ReasonUnknownEmission = "unknown_emission"
+	ReasonUnknownWeight   = "unknown_weight"
+	ReasonUnknownAxles    = "unknown_axles"
+)
+
+// TariffError tells which value of a charge the tariff cannot price. It
+// unwraps to one of the Err variables above.
+type TariffError struct {
+	Reason string
+	Value  string
+	Err    error
+}
+
+func (e *TariffError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Value)
+}
+
+func (e *TariffError) Unwrap() error {
+	return e.Err
 }
 
 var Ratio float64 = 100.0 // pay for each 100 meters
 const DIR = "sazba"
 
-var dDayFilename string = DIR + "/d-day.json"
-var dNightFilename string = DIR + "/d-night.json"
-var iDayFilename string = DIR + "/i-day.json"
-var iNightFilename string = DIR + "/i-night.json"
+// tariffs are the loaded versions ordered by validity
+var tariffs []*Tariff
 
-var dDay Sazba
-var dNight Sazba
-var iDay Sazba
-var iNight Sazba
+// LoadSazba loads and validates all tariff documents in dir, DIR by
+// default.
+func LoadSazba(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("error: no tariff in %s", dir)
+	}
+	var list []*Tariff
+	for _, f := range files {
+		t, err := loadTariff(f)
+		if err != nil {
+			return err
+		}
+		list = append(list, t)
+	}
+	return setTariffs(list)
+}
 
-func LoadSazba() {
-	load(dDayFilename, &dDay)
-	load(dNightFilename, &dNight)
-	load(iDayFilename, &iDay)
-	load(iNightFilename, &iNight)
-	//	c := Charge(100, time.Now().Format(time.RFC3339), 8500, 4, "M3", "4", "I35")
+// setTariffs replaces the tariffs in force, their validity must not
+// overlap.
+func setTariffs(list []*Tariff) error {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].validFrom.Before(list[j].validFrom)
+	})
+	for i := 1; i < len(list); i++ {
+		prev := list[i-1]
+		if prev.Version == list[i].Version {
+			return fmt.Errorf("error: tariff version %s is repeated", prev.Version)
+		}
+		if prev.validTo.IsZero() || prev.validTo.After(list[i].validFrom) {
+			return fmt.Errorf("error: tariffs %s and %s overlap", prev.Version, list[i].Version)
+		}
+	}
+	tariffs = list
+	return nil
+}
 
+// tariffAt returns the tariff in force at timedate.
+func tariffAt(timedate string) (*Tariff, error) {
+	tm, err := time.Parse(time.RFC3339, timedate)
+	if err != nil {
+		return nil, &TariffError{ReasonInvalidTime, timedate, ErrInvalidTime}
+	}
+	for _, t := range tariffs {
+		if !tm.Before(t.validFrom) && (t.validTo.IsZero() || tm.Before(t.validTo)) {
+			return t, nil
+		}
+	}
+	return nil, &TariffError{ReasonNoTariff, timedate, ErrNoTariff}
 }
 
-// Compute a charge by a distance for using a toll road
-// distance in meters
-func ExecSazba(distance float64, timedate string, weightKilo int,
-	numberaxles int, category string, emissionCategory string, roadname string) float64 {
-	var result float64 = 0.0
-	if distance < Ratio {
-		return result
-	}
-
-	var s Sazba
-	whichSazba(roadname, timedate, &s)
-	var v vehicle
-	whichCategory(category, s, &v)
-	var e emission
-	whichEmission(emissionCategory, v, &e)
-	var w weight
-	whichWeight(weightKilo, e, &w)
-	var charge float64
-	whichAxles(numberaxles, category, w, &charge)
-	d := distance / Ratio
-
-	result = charge * d
-	return result
-}
-
-func load(filename string, sazba *Sazba) {
-	jsonFile, err := os.Open(filename)
+// TariffVersion returns the version of the tariff in force at timedate, or
+// an empty string if there is none.
+func TariffVersion(timedate string) string {
+	t, err := tariffAt(timedate)
 	if err != nil {
-		fmt.Println(err)
+		return ""
 	}
-	defer jsonFile.Close()
-	byteValue, _ := io.ReadAll(jsonFile)
-	json.Unmarshal(byteValue, sazba)
+	return t.Version
+}
 
+func loadTariff(filename string) (*Tariff, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var t Tariff
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("error: %s: %v", filename, err)
+	}
+	if err := t.validate(); err != nil {
+		return nil, fmt.Errorf("error: %s: %v", filename, err)
+	}
+	return &t, nil
 }
 
-// Distinguish I. class road or highway
-func whichSazba(roadname string, timedate string, s *Sazba) {
-	if IsDay(timedate) {
-		if found := strings.HasPrefix(roadname, "D"); found {
-			*s = dDay
-		} else if found := strings.HasPrefix(roadname, "I"); found {
-			*s = iDay
-		} else {
-			fmt.Printf("Roadname %s does not belong to any type of road.", roadname)
+// validate checks the references between the lists and that a rate exists
+// for every combination of the dimensions.
+func (t *Tariff) validate() error {
+	if t.Version == "" {
+		return fmt.Errorf("missing version")
+	}
+	if t.Ratio < 0 {
+		return fmt.Errorf("negative ratio")
+	}
+	var err error
+	if t.TimeZone == "" || t.TimeZone == "Local" {
+		return fmt.Errorf("missing time zone")
+	}
+	if t.location, err = time.LoadLocation(t.TimeZone); err != nil {
+		return fmt.Errorf("timeZone: %v", err)
+	}
+	if t.validFrom, err = time.Parse(time.RFC3339, t.ValidFrom); err != nil {
+		return fmt.Errorf("validFrom: %v", err)
+	}
+	if t.ValidTo != "" {
+		if t.validTo, err = time.Parse(time.RFC3339, t.ValidTo); err != nil {
+			return fmt.Errorf("validTo: %v", err)
+		}
+		if !t.validTo.After(t.validFrom) {
+			return fmt.Errorf("validTo is not after validFrom")
+		}
+	}
+	if len(t.RoadClasses) == 0 || len(t.TimeBands) == 0 || len(t.Categories) == 0 ||
+		len(t.Emissions) == 0 || len(t.Weights) == 0 {
+		return fmt.Errorf("every dimension needs at least one entry")
+	}
+
+	roads := map[string]bool{}
+	for _, r := range t.RoadClasses {
+		if r.ID == "" || roads[r.ID] {
+			return fmt.Errorf("road class '%s' is empty or repeated", r.ID)
+		}
+		roads[r.ID] = true
+	}
+
+	bands := map[string]bool{}
+	for i := range t.TimeBands {
+		b := &t.TimeBands[i]
+		if b.ID == "" || bands[b.ID] {
+			return fmt.Errorf("time band '%s' is empty or repeated", b.ID)
+		}
+		bands[b.ID] = true
+		if b.from, err = parseClock(b.From); err != nil {
+			return fmt.Errorf("time band %s: %v", b.ID, err)
+		}
+		if b.to, err = parseClock(b.To); err != nil {
+			return fmt.Errorf("time band %s: %v", b.ID, err)
+		}
+	}
+	for minute := 0; minute < 24*60; minute++ {
+		n := 0
+		for _, b := range t.TimeBands {
+			if b.contains(minute) {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("time %02d:%02d is in %d time bands", minute/60, minute%60, n)
+		}
+	}
+
+	categories := map[string]bool{}
+	aliases := map[string]bool{}
+	for _, c := range t.Categories {
+		if c.ID == "" || categories[c.ID] {
+			return fmt.Errorf("category '%s' is empty or repeated", c.ID)
+		}
+		categories[c.ID] = true
+		if c.MinAxles < 1 || c.MaxAxles < c.MinAxles {
+			return fmt.Errorf("category %s: invalid axles %d-%d", c.ID, c.MinAxles, c.MaxAxles)
+		}
+		for _, a := range c.Aliases {
+			if aliases[a] {
+				return fmt.Errorf("category alias '%s' is repeated", a)
+			}
+			aliases[a] = true
+		}
+	}
+
+	emissions := map[string]bool{}
+	aliases = map[string]bool{}
+	for _, e := range t.Emissions {
+		if e.ID == "" || emissions[e.ID] {
+			return fmt.Errorf("emission class '%s' is empty or repeated", e.ID)
 		}
+		emissions[e.ID] = true
+		for _, a := range e.Aliases {
+			if aliases[a] {
+				return fmt.Errorf("emission alias '%s' is repeated", a)
+			}
+			aliases[a] = true
+		}
+	}
 
-	} else {
-		// Night charge
-		if found := strings.HasPrefix(roadname, "D"); found {
-			*s = dNight
-		} else if found := strings.HasPrefix(roadname, "I"); found {
-			*s = iNight
-		} else {
-			fmt.Printf("Roadname %s does not belong to any type of road.", roadname)
+	weights := map[string]bool{}
+	for i, w := range t.Weights {
+		if w.ID == "" || weights[w.ID] {
+			return fmt.Errorf("weight band '%s' is empty or repeated", w.ID)
 		}
+		weights[w.ID] = true
+		if w.Max != 0 && w.Max <= w.Min {
+			return fmt.Errorf("weight band %s: invalid range %d-%d", w.ID, w.Min, w.Max)
+		}
+		for _, o := range t.Weights[i+1:] {
+			if (w.Max == 0 || o.Min < w.Max) && (o.Max == 0 || w.Min < o.Max) {
+				return fmt.Errorf("weight bands %s and %s overlap", w.ID, o.ID)
+			}
+		}
+	}
 
+	t.rates = map[rateKey]float64{}
+	for _, r := range t.Rates {
+		if !roads[r.Road] || !bands[r.Time] || !categories[r.Category] ||
+			!emissions[r.Emission] || !weights[r.Weight] {
+			return fmt.Errorf("rate %+v refers to an unknown entry", r)
+		}
+		if r.Rate < 0 {
+			return fmt.Errorf("rate %+v is negative", r)
+		}
+		k := rateKey{r.Road, r.Time, r.Category, r.Emission, r.Weight, r.Axles}
+		if _, ok := t.rates[k]; ok {
+			return fmt.Errorf("rate %+v is repeated", r)
+		}
+		t.rates[k] = r.Rate
+	}
+	for _, r := range t.RoadClasses {
+		for _, b := range t.TimeBands {
+			for _, c := range t.Categories {
+				for _, e := range t.Emissions {
+					for _, w := range t.Weights {
+						for a := c.MinAxles; a <= c.MaxAxles; a++ {
+							k := rateKey{r.ID, b.ID, c.ID, e.ID, w.ID, a}
+							if _, ok := t.rates[k]; !ok {
+								return fmt.Errorf("missing rate for %s, %s, %s, %s, %s, %d axles",
+									r.ID, b.ID, c.ID, e.ID, w.ID, a)
+							}
+						}
+					}
+				}
+			}
+		}
 	}
+	return nil
 }
 
-func whichCategory(category string, s Sazba, v *vehicle) {
-	switch category {
-	case "N":
-		*v = s.N
-	case "M2", "M3":
-		*v = s.M2
-	default:
-		fmt.Printf("Category %s does not exist.", category)
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
 	}
+	return t.Hour()*60 + t.Minute(), nil
+}
 
+func (b TimeBandRule) contains(minute int) bool {
+	if b.from <= b.to {
+		return minute >= b.from && minute < b.to
+	}
+	return minute >= b.from || minute < b.to
 }
 
-func whichEmission(emissionStr string, v vehicle, e *emission) {
-	switch emissionStr {
-	case "0", "1", "2", "3", "4", "euro0":
-		*e = v.E04
-	case "5", "EEV":
-		*e = v.E5EEV
-	case "6":
-		*e = v.E6
-	case "CNG":
-		*e = v.Ecng
-	default:
-		fmt.Printf("Emission %s does not exist.", emissionStr)
+// Compute a charge by a distance for using a toll road by the tariff in
+// force at timedate
+// distance in meters
+// A dimension the tariff cannot price fails with a *TariffError, even for a
+// distance too short to be charged.
+func ExecSazba(distance float64, timedate string, weightKilo int,
+	numberaxles int, category string, emissionCategory string, roadClass string) (float64, error) {
+	t, err := tariffAt(timedate)
+	if err != nil {
+		return 0, err
+	}
+	road, err := t.whichRoadClass(roadClass)
+	if err != nil {
+		return 0, err
+	}
+	band, err := t.whichTimeBand(timedate)
+	if err != nil {
+		return 0, err
+	}
+	c, err := t.whichCategory(category)
+	if err != nil {
+		return 0, err
+	}
+	e, err := t.whichEmission(emissionCategory)
+	if err != nil {
+		return 0, err
+	}
+	w, err := t.whichWeight(weightKilo)
+	if err != nil {
+		return 0, err
+	}
+	charge, err := t.whichAxles(road, band, c, e, w, numberaxles)
+	if err != nil {
+		return 0, err
+	}
 
+	ratio := t.ratio()
+	if distance < ratio {
+		return 0, nil
 	}
+	return charge * distance / ratio, nil
+}
 
+func (t *Tariff) ratio() float64 {
+	if t.Ratio > 0 {
+		return t.Ratio
+	}
+	return Ratio
 }
 
-func whichWeight(weightKilo int, e emission, w *weight) {
-	//Weight in kilograms
+// Check the class of the road, e.g. I. class road or highway, is priced by
+// the tariff
+func (t *Tariff) whichRoadClass(class string) (string, error) {
+	for _, r := range t.RoadClasses {
+		if r.ID == class {
+			return r.ID, nil
+		}
+	}
+	return "", &TariffError{ReasonUnknownRoad, class, ErrUnknownRoad}
+}
+
+// checkRoadClass checks that every loaded tariff prices the road class.
+func checkRoadClass(class string) error {
+	for _, t := range tariffs {
+		if _, err := t.whichRoadClass(class); err != nil {
+			return fmt.Errorf("tariff %s: %w", t.Version, err)
+		}
+	}
+	return nil
+}
+
+func (t *Tariff) whichTimeBand(timedate string) (string, error) {
+	tm, err := time.Parse(time.RFC3339, timedate)
+	if err != nil {
+		return "", &TariffError{ReasonInvalidTime, timedate, ErrInvalidTime}
+	}
+	tm = tm.In(t.location)
+	minute := tm.Hour()*60 + tm.Minute()
+	for _, b := range t.TimeBands {
+		if b.contains(minute) {
+			return b.ID, nil
+		}
+	}
+	// validate guarantees a band for every minute
+	return "", &TariffError{ReasonInvalidTime, timedate, ErrInvalidTime}
+}
 
-	if weightKilo > 3500 && weightKilo < 7500 {
-		*w = e.W3575
-	} else if weightKilo >= 7500 && weightKilo < 12000 {
-		*w = e.W7512
-	} else if weightKilo >= 12000 {
-		*w = e.W12
-	} else {
-		fmt.Printf("This %d weight has no place in database.", weightKilo)
+func (t *Tariff) whichCategory(category string) (*Category, error) {
+	for i, c := range t.Categories {
+		for _, a := range c.Aliases {
+			if a == category {
+				return &t.Categories[i], nil
+			}
+		}
 	}
+	return nil, &TariffError{ReasonUnknownCategory, category, ErrUnknownCategory}
 }
 
-func whichAxles(numberaxles int, category string, w weight, a *float64) {
-	if numberaxles > 5 && category == "N" {
-		numberaxles = 5
-	} else if numberaxles > 3 && (category == "M2" || category == "M3") {
-		numberaxles = 3
+func (t *Tariff) whichEmission(emissionStr string) (string, error) {
+	for _, e := range t.Emissions {
+		for _, a := range e.Aliases {
+			if a == emissionStr {
+				return e.ID, nil
+			}
+		}
 	}
+	return "", &TariffError{ReasonUnknownEmission, emissionStr, ErrUnknownEmission}
+}
 
-	switch numberaxles {
-	case 2:
-		*a = w.Axles2
-	case 3:
-		*a = w.Axles3
-	case 4:
-		*a = w.Axles4
-	case 5:
-		*a = w.Axles5
-	default:
-		fmt.Printf("This %d number of axles has no place in database.", numberaxles)
+func (t *Tariff) whichWeight(weightKilo int) (string, error) {
+	//Weight in kilograms
+	for _, w := range t.Weights {
+		if weightKilo >= w.Min && (w.Max == 0 || weightKilo < w.Max) {
+			return w.ID, nil
+		}
 	}
+	return "", &TariffError{ReasonUnknownWeight, fmt.Sprintf("%d", weightKilo), ErrUnknownWeight}
 }
 
-func IsDay(timedate string) bool {
-	t, err := time.Parse(time.RFC3339, timedate)
-	if err != nil {
-		fmt.Println(err)
+func (t *Tariff) whichAxles(road, band string, c *Category, emission, weight string, numberaxles int) (float64, error) {
+	axles := numberaxles
+	if axles > c.MaxAxles {
+		axles = c.MaxAxles
+	}
+	rate, ok := t.rates[rateKey{road, band, c.ID, emission, weight, axles}]
+	if !ok {
+		return 0, &TariffError{ReasonUnknownAxles, fmt.Sprintf("%d", numberaxles), ErrUnknownAxles}
 	}
-	if t.Hour() > 21 || t.Hour() <= 4 {
-		return false
+	return rate, nil
+}
+
+// TimeBand names the part of the day the tariff in force distinguishes, or
+// returns an empty string if there is no tariff at timedate.
+func TimeBand(timedate string) string {
+	t, err := tariffAt(timedate)
+	if err != nil {
+		return ""
 	}
-	return true
+	band, _ := t.whichTimeBand(timedate)
+	return band
 }
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testTariff() *Tariff {
+	return &Tariff{
+		Version:     "test",
+		ValidFrom:   "2023-01-01T00:00:00+01:00",
+		TimeZone:    "Europe/Prague",
+		RoadClasses: []RoadClass{{ID: "D", Name: "motorway"}},
+		TimeBands: []TimeBandRule{
+			{ID: "day", From: "05:00", To: "22:00"},
+			{ID: "night", From: "22:00", To: "05:00"},
+		},
+		Categories: []Category{{ID: "N", Aliases: []string{"N"}, MinAxles: 2, MaxAxles: 2}},
+		Emissions:  []EmissionClass{{ID: "6", Aliases: []string{"6"}}},
+		Weights:    []WeightBand{{ID: "12", Min: 12000}},
+		Rates: []Rate{
+			{Road: "D", Time: "day", Category: "N", Emission: "6", Weight: "12", Axles: 2, Rate: 2},
+			{Road: "D", Time: "night", Category: "N", Emission: "6", Weight: "12", Axles: 2, Rate: 1},
+		},
+	}
+}
+
+func TestTariffValidate(t *testing.T) {
+	tests := []struct {
+		modify func(*Tariff)
+		exp    string
+	}{
+		{func(*Tariff) {}, ""},
+		{func(t *Tariff) { t.Version = "" }, "missing version"},
+		{func(t *Tariff) { t.TimeZone = "" }, "missing time zone"},
+		{func(t *Tariff) { t.TimeZone = "CET+1" }, "timeZone"},
+		{func(t *Tariff) { t.TimeBands[1].From = "23:00" }, "time 22:00 is in 0 time bands"},
+		{func(t *Tariff) { t.Weights = append(t.Weights, WeightBand{ID: "big", Min: 20000}) }, "overlap"},
+		{func(t *Tariff) { t.Rates = t.Rates[:1] }, "missing rate for D, night"},
+		{func(t *Tariff) { t.Rates[0].Emission = "7" }, "unknown entry"},
+	}
+	for i, test := range tests {
+		tariff := testTariff()
+		test.modify(tariff)
+		err := tariff.validate()
+		if test.exp == "" && err != nil {
+			t.Errorf("test %d: expected no error, but got %v", i, err)
+		} else if test.exp != "" && (err == nil || !strings.Contains(err.Error(), test.exp)) {
+			t.Errorf("test %d: expected error '%s', but got %v", i, test.exp, err)
+		}
+	}
+}
+
+// TestTariffFixtures validates the tariffs shared with the tests of the
+// chaincode, both have to accept and refuse the same tariffs.
+func TestTariffFixtures(t *testing.T) {
+	data, err := os.ReadFile("../testdata/tariffs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []struct {
+		Name   string `json:"name"`
+		Error  string `json:"error"`
+		Tariff Tariff `json:"tariff"`
+	}
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		err := f.Tariff.validate()
+		if f.Error == "" && err != nil {
+			t.Errorf("%s: expected no error, but got %v", f.Name, err)
+		} else if f.Error != "" && (err == nil || !strings.Contains(err.Error(), f.Error)) {
+			t.Errorf("%s: expected error '%s', but got %v", f.Name, f.Error, err)
+		}
+	}
+}
+
+func TestLoadSazba(t *testing.T) {
+	if err := LoadSazba(DIR); err != nil {
+		t.Fatal(err)
+	}
+	// 10 * 1.566 CZK for a truck of emission class 6, 8.5 t and 4 axles
+	if got, err := ExecSazba(1000, "2023-05-02T10:00:00+02:00", 8500, 4, "N", "6", "D"); err != nil || got < 15.659 || got > 15.661 {
+		t.Errorf("expected 15.66, but got %.5f, %v", got, err)
+	}
+	// by the clock of Prague, whatever the offset of the check-point
+	for _, timedate := range []string{"2023-05-02T22:30:00+02:00", "2023-05-02T20:30:00Z", "2023-05-02T16:30:00-04:00"} {
+		if got := TimeBand(timedate); got != "night" {
+			t.Errorf("at input %s expected night, but got '%s'", timedate, got)
+		}
+	}
+	if got := TimeBand("2023-01-02T04:30:00Z"); got != "day" {
+		t.Errorf("expected day at 05:30 of the winter time, but got '%s'", got)
+	}
+}
+
+func TestTariffValidity(t *testing.T) {
+	old := tariffs
+	defer func() { tariffs = old }()
+
+	t2023 := testTariff()
+	t2023.Version = "2023"
+	t2023.ValidTo = "2024-01-01T00:00:00+01:00"
+	t2024 := testTariff()
+	t2024.Version = "2024"
+	t2024.ValidFrom = "2024-01-01T00:00:00+01:00"
+	t2024.Rates[1].Rate = 3
+	for _, tariff := range []*Tariff{t2023, t2024} {
+		if err := tariff.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := setTariffs([]*Tariff{t2024, t2023}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		timedate string
+		version  string
+		exp      float64
+		err      error
+	}{
+		{"2023-12-31T23:59:00+01:00", "2023", 10, nil},
+		{"2024-01-01T00:00:00+01:00", "2024", 30, nil},
+		{"2022-12-31T23:00:00+01:00", "", 0, ErrNoTariff},
+	}
+	for _, test := range tests {
+		if got := TariffVersion(test.timedate); got != test.version {
+			t.Errorf("at %s expected version '%s', but got '%s'", test.timedate, test.version, got)
+		}
+		if got, err := ExecSazba(1000, test.timedate, 12500, 2, "N", "6", "D"); got != test.exp || !errors.Is(err, test.err) {
+			t.Errorf("at %s expected %.2f, %v, but got %.2f, %v", test.timedate, test.exp, test.err, got, err)
+		}
+	}
+
+	t2023.ValidTo = "2024-01-02T00:00:00+01:00"
+	t2023.validate()
+	if err := setTariffs([]*Tariff{t2023, t2024}); err == nil {
+		t.Errorf("expected an error for overlapping tariffs")
+	}
+}
+
+func TestExecSazbaErrors(t *testing.T) {
+	if err := LoadSazba(DIR); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		timedate, category, emission, road string
+		weight, axles                      int
+		distance                           float64
+		reason                             string
+	}{
+		{"2023-05-02T10:00:00+02:00", "N", "6", "D", 8500, 4, 1000, ""},
+		{"2023-05-02T10:00:00+02:00", "X", "6", "D", 8500, 4, 1000, ReasonUnknownCategory},
+		{"2023-05-02T10:00:00+02:00", "N", "9", "D", 8500, 4, 1000, ReasonUnknownEmission},
+		{"2023-05-02T10:00:00+02:00", "N", "6", "D", 3000, 4, 1000, ReasonUnknownWeight},
+		{"2023-05-02T10:00:00+02:00", "N", "6", "R", 8500, 4, 1000, ReasonUnknownRoad},
+		{"2023-05-02T10:00:00+02:00", "N", "6", "D", 8500, 1, 1000, ReasonUnknownAxles},
+		{"2023-05-02 10:00", "N", "6", "D", 8500, 4, 1000, ReasonInvalidTime},
+		{"2020-05-02T10:00:00+02:00", "N", "6", "D", 8500, 4, 1000, ReasonNoTariff},
+		// too short to be charged, but still not priceable
+		{"2023-05-02T10:00:00+02:00", "X", "6", "D", 8500, 4, 10, ReasonUnknownCategory},
+	}
+	for i, test := range tests {
+		_, err := ExecSazba(test.distance, test.timedate, test.weight, test.axles,
+			test.category, test.emission, test.road)
+		var tariffErr *TariffError
+		if test.reason == "" && err != nil {
+			t.Errorf("test %d: expected no error, but got %v", i, err)
+		} else if test.reason != "" && (!errors.As(err, &tariffErr) || tariffErr.Reason != test.reason) {
+			t.Errorf("test %d: expected reason %s, but got %v", i, test.reason, err)
+		}
+	}
+}
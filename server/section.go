@@ -0,0 +1,185 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/Solamil/bp23/geo/gpx"
+)
+
+// Modes of charging the trips.
+const (
+	ChargeByDistance = "distance" // the distance driven along the road sections
+	ChargeBySection  = "section"  // the official length of the charging sections passed
+)
+
+// Charging is the mode the trips are charged by.
+var Charging = ChargeByDistance
+
+// Directions a charging section is charged in, by the order of the points of
+// its road section.
+const (
+	DirectionBoth     = "both"
+	DirectionForward  = "forward"
+	DirectionBackward = "backward"
+)
+
+// ChargingSection is a toll section of a road between two gantries. A
+// vehicle passing its virtual gantry is charged its official length. It is
+// read from a <section> of the <extensions> of the GPX of the road, e.g.
+//
+//	<section name="D10-001" from="Turnov" to="Ohrazenice" length="1850"
+//	    class="D" direction="both" start="0" end="9" gantry="5"/>
+type ChargingSection struct {
+	Name       string  `json:"name"`
+	FromGantry string  `json:"fromGantry"`
+	ToGantry   string  `json:"toGantry"`
+	Length     float64 `json:"length"` // official meters
+	Class      string  `json:"class"`  // road class of the tariff, of the road by default
+	Direction  string  `json:"direction"`
+	Start      int     `json:"start"`  // first point of the road in the section
+	End        int     `json:"end"`    // last point of the road in the section
+	Gantry     int     `json:"gantry"` // point of the virtual gantry, the middle one by default
+}
+
+// GantryPass is a passage of a vehicle through the virtual gantry of a
+// charging section between the check-points From and To.
+type GantryPass struct {
+	Section *ChargingSection
+	From    int
+	To      int
+	Forward bool // in the order of the points of the road
+}
+
+// readSections reads the charging sections of the extensions of the road.
+func readSections(route *WptRecords, extensions []gpx.Extension) error {
+	for _, e := range extensions {
+		if e.Tag != "section" {
+			continue
+		}
+		a := e.Attrs
+		s := ChargingSection{
+			Name:       a["name"],
+			FromGantry: a["from"],
+			ToGantry:   a["to"],
+			Class:      a["class"],
+			Direction:  a["direction"],
+			Gantry:     -1,
+		}
+		if s.Direction == "" {
+			s.Direction = DirectionBoth
+		}
+		if s.Class == "" {
+			s.Class = route.Class
+		}
+		var err error
+		if s.Length, err = strconv.ParseFloat(a["length"], 64); err != nil {
+			return fmt.Errorf("section %s: invalid length '%s'", s.Name, a["length"])
+		}
+		ints := []struct {
+			name string
+			v    *int
+		}{{"start", &s.Start}, {"end", &s.End}, {"gantry", &s.Gantry}}
+		for _, i := range ints {
+			v, ok := a[i.name]
+			if !ok && i.name == "gantry" {
+				continue
+			}
+			if *i.v, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("section %s: invalid %s '%s'", s.Name, i.name, v)
+			}
+		}
+		if s.Gantry == -1 {
+			s.Gantry = middle(route.Chainage, s.Start, s.End)
+		}
+		if err := s.validate(route.Len); err != nil {
+			return err
+		}
+		route.Sections = append(route.Sections, s)
+	}
+	return nil
+}
+
+// middle returns the point between start and end nearest to the middle of
+// them along the road.
+func middle(chainage []float64, start, end int) int {
+	if start < 0 || end >= len(chainage) || start > end {
+		return start
+	}
+	half := (chainage[start] + chainage[end]) / 2
+	m := start
+	for j := start; j <= end; j++ {
+		if math.Abs(chainage[j]-half) < math.Abs(chainage[m]-half) {
+			m = j
+		}
+	}
+	return m
+}
+
+func (s *ChargingSection) validate(points int) error {
+	switch {
+	case s.Name == "":
+		return fmt.Errorf("section without a name")
+	case s.Length <= 0:
+		return fmt.Errorf("section %s: length has to be positive", s.Name)
+	case s.Start < 0 || s.End >= points || s.Start >= s.End:
+		return fmt.Errorf("section %s: invalid points %d-%d of %d", s.Name, s.Start, s.End, points)
+	case s.Gantry < s.Start || s.Gantry > s.End:
+		return fmt.Errorf("section %s: gantry %d out of the section", s.Name, s.Gantry)
+	case s.Direction != DirectionBoth && s.Direction != DirectionForward && s.Direction != DirectionBackward:
+		return fmt.Errorf("section %s: unknown direction '%s'", s.Name, s.Direction)
+	}
+	return nil
+}
+
+// validateSections checks that the names of the charging sections are unique
+// and that every road has them when the trips are charged by them.
+func validateSections(model []WptRecords) error {
+	names := map[string]bool{}
+	for _, r := range model {
+		if len(r.Sections) == 0 && Charging == ChargeBySection {
+			return fmt.Errorf("error: %s has no charging section", r.Name)
+		}
+		for _, s := range r.Sections {
+			if names[s.Name] {
+				return fmt.Errorf("error: %s: repeated charging section %s", r.Name, s.Name)
+			}
+			names[s.Name] = true
+		}
+	}
+	return nil
+}
+
+// Passes returns the virtual gantries passed between the points of the road
+// in the order they were driven, in the directions their sections are
+// charged in. A point right at a gantry is beyond it in the order of the
+// road.
+func (r *WptRecords) Passes(points []int) []GantryPass {
+	var passes []GantryPass
+	for k := 1; k < len(points); k++ {
+		a, b := r.Chainage[points[k-1]], r.Chainage[points[k]]
+		step := len(passes)
+		for i := range r.Sections {
+			s := &r.Sections[i]
+			g := r.Chainage[s.Gantry]
+			switch {
+			case a < g && b >= g && s.Direction != DirectionBackward:
+				passes = append(passes, GantryPass{Section: s, From: k - 1, To: k, Forward: true})
+			case a >= g && b < g && s.Direction != DirectionForward:
+				passes = append(passes, GantryPass{Section: s, From: k - 1, To: k})
+			}
+		}
+		// more gantries between two check-points in the order they were passed
+		p := passes[step:]
+		sort.SliceStable(p, func(i, j int) bool {
+			gi, gj := r.Chainage[p[i].Section.Gantry], r.Chainage[p[j].Section.Gantry]
+			if b > a {
+				return gi < gj
+			}
+			return gi > gj
+		})
+	}
+	return passes
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// road has 11 points 20 m apart, the road class D and the sections of the
+// extensions.
+func road(t *testing.T, extensions string) (string, error) {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("<gpx><title>D11</title><version>1</version>")
+	for j := 0; j <= 10; j++ {
+		lon := 15 + float64(j)*20/earthRadius/math.Cos(50*math.Pi/180)*180/math.Pi
+		fmt.Fprintf(&b, `<wpt lat="50" lon="%.7f"/>`, lon)
+	}
+	b.WriteString(`<extensions><road class="D"/>` + extensions + "</extensions></gpx>")
+	f := filepath.Join(t.TempDir(), "d11.gpx")
+	if err := os.WriteFile(f, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var r WptRecords
+	err := readGpx(f, &r)
+	if err == nil {
+		setModel([]WptRecords{r})
+	}
+	return f, err
+}
+
+func TestReadSections(t *testing.T) {
+	defer setModel(CurrentModel())
+	if _, err := road(t, `<section name="D11-1" from="A" to="B" length="1000" class="D" start="0" end="5"/>`+
+		`<section name="D11-2" length="900" direction="forward" start="5" end="10" gantry="6"/>`); err != nil {
+		t.Fatal(err)
+	}
+	s := CurrentModel()[0].Sections
+	if len(s) != 2 || s[0].Name != "D11-1" || s[0].FromGantry != "A" || s[0].Length != 1000 ||
+		s[0].Direction != DirectionBoth || s[0].Gantry != 2 && s[0].Gantry != 3 {
+		t.Errorf("expected D11-1 with its gantry in the middle, but got %+v", s)
+	}
+	if len(s) == 2 && (s[1].Gantry != 6 || s[1].Direction != DirectionForward || s[1].Class != "D") {
+		t.Errorf("expected D11-2 forward of the class D with the gantry 6, but got %+v", s[1])
+	}
+
+	tests := []string{
+		`<section length="1000" start="0" end="5"/>`,
+		`<section name="D11-1" length="0" start="0" end="5"/>`,
+		`<section name="D11-1" length="1000" start="5" end="11"/>`,
+		`<section name="D11-1" length="1000" start="0" end="5" gantry="7"/>`,
+		`<section name="D11-1" length="1000" start="0" end="5" direction="north"/>`,
+		`<section name="D11-1" length="1000" start="x" end="5"/>`,
+	}
+	for _, test := range tests {
+		if _, err := road(t, test); err == nil {
+			t.Errorf("at input %s expected an error", test)
+		}
+	}
+
+	// the names are unique and each road has sections when charged by them
+	f, _ := road(t, `<section name="D11-1" length="1000" start="0" end="5"/>`)
+	if err := loadModel(f, f); err == nil {
+		t.Errorf("expected an error of a repeated section")
+	}
+	defer func(c string) { Charging = c }(Charging)
+	Charging = ChargeBySection
+	f, _ = road(t, "")
+	if err := loadModel(f); err == nil {
+		t.Errorf("expected an error of a road without sections")
+	}
+}
+
+func TestPasses(t *testing.T) {
+	defer setModel(CurrentModel())
+	if _, err := road(t, `<section name="D11-1" length="1000" start="0" end="4" gantry="2"/>`+
+		`<section name="D11-2" length="900" direction="forward" start="4" end="10" gantry="7"/>`); err != nil {
+		t.Fatal(err)
+	}
+	r := &CurrentModel()[0]
+	tests := []struct {
+		points []int
+		exp    string
+	}{
+		{[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, "D11-1+ D11-2+"},
+		{[]int{0, 10}, "D11-1+ D11-2+"},
+		{[]int{10, 0}, "D11-1-"},
+		{[]int{3, 4, 5}, ""},
+		{[]int{1, 3, 1, 3}, "D11-1+ D11-1- D11-1+"},
+		{[]int{2, 3}, ""},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, p := range r.Passes(test.points) {
+			dir := "-"
+			if p.Forward {
+				dir = "+"
+			}
+			got = append(got, p.Section.Name+dir)
+		}
+		if s := strings.Join(got, " "); s != test.exp {
+			t.Errorf("at input %v expected '%s', but got '%s'", test.points, test.exp, s)
+		}
+	}
+
+	// gantries of two sections at one point are passed in the order of the
+	// sections in both directions
+	if _, err := road(t, `<section name="D11-1" length="1000" start="0" end="4" gantry="4"/>`+
+		`<section name="D11-2" length="900" start="4" end="10" gantry="4"/>`); err != nil {
+		t.Fatal(err)
+	}
+	r = &CurrentModel()[0]
+	for _, points := range [][]int{{0, 10}, {10, 0}} {
+		if p := r.Passes(points); len(p) != 2 || p[0].Section.Name != "D11-1" || p[1].Section.Name != "D11-2" {
+			t.Errorf("at input %v expected the passes of D11-1 and D11-2, but got %+v", points, p)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+// TollSegment is a part of a trip driven on one road section within one
+// time band of one tariff.
+type TollSegment struct {
+	Road          string  `json:"Road"`
+	Section       string  `json:"Section,omitempty"` // charging section passed, if charged by sections
+	Class         string  `json:"Class"`             // road class of the tariff
+	TimeBand      string  `json:"TimeBand"`
+	TariffVersion string  `json:"TariffVersion"`
+	From          string  `json:"From"`
+	To            string  `json:"To"`
+	Entry         float64 `json:"Entry"`     // meters along the road section where it was entered
+	Exit          float64 `json:"Exit"`      // and left
+	Reversals     int     `json:"Reversals"` // turns back on the road section
+	Distance      float64 `json:"Distance"`  // meters along the road section
+	Amount        float64 `json:"Amount"`
+}
+
+// TollTransaction records one charged trip of an OBU, it mirrors the asset
+// of the asset-toll chaincode.
+type TollTransaction struct {
+	TxID          string        `json:"TxID"`
+	ObuID         string        `json:"ObuID"`
+	SPZ           string        `json:"SPZ"`
+	Country       string        `json:"Country"`
+	Time          string        `json:"Time"` // beginning of the trip, RFC3339
+	Segments      []TollSegment `json:"Segments"`
+	TariffVersion string        `json:"TariffVersion"` // versions of the segments
+	Amount        float64       `json:"Amount"`
+	Currency      string        `json:"Currency"`
+	TicketID      string        `json:"TicketID"`
+	TicketHash    string        `json:"TicketHash"`
+	Timestamp     string        `json:"Timestamp"`             // time of the ledger transaction
+	Model         string        `json:"Model,omitempty"`       // checksum of the geographic model of the check-points
+	Charging      string        `json:"Charging,omitempty"`    // mode the trip is charged by
+	CheckPoints   *Polygon      `json:"CheckPoints,omitempty"` // as driven by the OBU
+}
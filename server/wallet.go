@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FabricOrg is an organization the server can act for and the identity it
+// submits transactions by. The identity is taken from the wallet by its
+// label, or read from CertPath and KeyPath, or from the msp directory
+// CredPath of the user. The Fabric Gateway client connects to the peer at
+// PeerEndpoint instead of reading the connection profile.
+type FabricOrg struct {
+	MspID             string `json:"MspID"`
+	ConnectionProfile string `json:"ConnectionProfile"`
+	Identity          string `json:"Identity"` // label in the wallet
+	CredPath          string `json:"CredPath"`
+	CertPath          string `json:"CertPath"`
+	KeyPath           string `json:"KeyPath"`
+	PeerEndpoint      string `json:"PeerEndpoint"`     // host:port of the gateway peer
+	PeerHostOverride  string `json:"PeerHostOverride"` // name of the peer in its TLS certificate
+	TLSCertPath       string `json:"TLSCertPath"`      // CA certificate of the peer's TLS
+}
+
+// testPeerPorts are the ports of peer0 of the organizations of the Fabric
+// test network.
+var testPeerPorts = map[string]int{"Org1": 7051, "Org2": 9051}
+
+// testOrg is the organization of User1 of the Fabric test network next to
+// this repository, e.g. Org1.
+func testOrg(name string) FabricOrg {
+	domain := strings.ToLower(name) + ".example.com"
+	dir := filepath.Join("..", "..", "fabric", "fabric-samples", "test-network",
+		"organizations", "peerOrganizations", domain)
+	user := "User1@" + domain
+	peer := "peer0." + domain
+	return FabricOrg{
+		MspID:             name + "MSP",
+		ConnectionProfile: filepath.Join(dir, fmt.Sprintf("connection-%s.yaml", strings.ToLower(name))),
+		Identity:          user,
+		CredPath:          filepath.Join(dir, "users", user, "msp"),
+		PeerEndpoint:      fmt.Sprintf("localhost:%d", testPeerPorts[name]),
+		PeerHostOverride:  peer,
+		TLSCertPath:       filepath.Join(dir, "peers", peer, "tls", "ca.crt"),
+	}
+}
+
+// Organization returns the organization Org of Orgs overridden by the
+// settings of c itself.
+func (c FabricConfig) Organization() (FabricOrg, error) {
+	org, ok := c.Orgs[c.Org]
+	if c.Org != "" && !ok {
+		return org, fmt.Errorf("error: unknown organization %s", c.Org)
+	}
+	override := func(v *string, o string) {
+		if o != "" {
+			*v = o
+		}
+	}
+	override(&org.MspID, c.MspID)
+	override(&org.ConnectionProfile, c.ConnectionProfile)
+	override(&org.Identity, c.Identity)
+	override(&org.CredPath, c.CredPath)
+	override(&org.CertPath, c.CertPath)
+	override(&org.KeyPath, c.KeyPath)
+	override(&org.PeerEndpoint, c.PeerEndpoint)
+	override(&org.PeerHostOverride, c.PeerHostOverride)
+	override(&org.TLSCertPath, c.TLSCertPath)
+	if org.MspID == "" || org.Identity == "" {
+		return org, fmt.Errorf("error: organization '%s' needs an MSP id and an identity", c.Org)
+	}
+	return org, nil
+}
+
+// walletExtension is the suffix of the identity files in a wallet.
+const walletExtension = ".id"
+
+// wallet is a directory of identities labeled by the names of their files,
+// the file system wallet of fabric-sdk-go and of the Fabric SDKs for Node.js
+// and Java, so a wallet populated by either of them can be reused.
+type wallet struct {
+	path string
+}
+
+// x509Identity is an identity in a wallet.
+type x509Identity struct {
+	Version     int    `json:"version"`
+	MspID       string `json:"mspId"`
+	Type        string `json:"type"`
+	Credentials struct {
+		Certificate string `json:"certificate"`
+		Key         string `json:"privateKey"`
+	} `json:"credentials"`
+}
+
+func newX509Identity(mspID, cert, key string) *x509Identity {
+	id := &x509Identity{Version: 1, MspID: mspID, Type: "X.509"}
+	id.Credentials.Certificate = cert
+	id.Credentials.Key = key
+	return id
+}
+
+func newWallet(path string) (*wallet, error) {
+	path = filepath.Clean(path)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &wallet{path: path}, nil
+}
+
+func (w *wallet) file(label string) string {
+	return filepath.Join(w.path, label) + walletExtension
+}
+
+func (w *wallet) exists(label string) bool {
+	_, err := os.Stat(w.file(label))
+	return err == nil
+}
+
+func (w *wallet) get(label string) (*x509Identity, error) {
+	data, err := os.ReadFile(w.file(label))
+	if err != nil {
+		return nil, err
+	}
+	var id x509Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("%s: %v", w.file(label), err)
+	}
+	if id.Type != "X.509" {
+		return nil, fmt.Errorf("%s is not an X.509 identity", label)
+	}
+	return &id, nil
+}
+
+func (w *wallet) put(label string, id *x509Identity) error {
+	data, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(w.file(label), data, 0600)
+}
+
+// openWallet opens the wallet at path and puts the identity of org into it
+// unless the wallet has it already.
+func openWallet(path string, org FabricOrg) (*wallet, error) {
+	wallet, err := newWallet(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wallet %s: %v", path, err)
+	}
+	if !wallet.exists(org.Identity) {
+		err = populateWallet(wallet, org)
+		if err != nil {
+			return nil, fmt.Errorf("failed to put identity %s into wallet %s: %v", org.Identity, path, err)
+		}
+	}
+	return wallet, nil
+}
+
+func populateWallet(wallet *wallet, org FabricOrg) error {
+	log.Printf("============ Populating wallet with %s ============", org.Identity)
+	certPath, keyPath := org.CertPath, org.KeyPath
+	var err error
+	if certPath == "" {
+		if certPath, err = singleFile(filepath.Join(org.CredPath, "signcerts"), ".pem"); err != nil {
+			return err
+		}
+	}
+	if keyPath == "" {
+		if keyPath, err = singleFile(filepath.Join(org.CredPath, "keystore"), "_sk"); err != nil {
+			return err
+		}
+	}
+	cert, err := os.ReadFile(filepath.Clean(certPath))
+	if err != nil {
+		return err
+	}
+	key, err := os.ReadFile(filepath.Clean(keyPath))
+	if err != nil {
+		return err
+	}
+
+	identity := newX509Identity(org.MspID, string(cert), string(key))
+
+	return wallet.put(org.Identity, identity)
+}
+
+// singleFile finds the file of the certificate or the key in dir. If there
+// are more files, only one of them may have the suffix.
+func singleFile(dir, suffix string) (string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var all, matching []string
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		all = append(all, f.Name())
+		if strings.HasSuffix(f.Name(), suffix) {
+			matching = append(matching, f.Name())
+		}
+	}
+	switch {
+	case len(all) == 1:
+		return filepath.Join(dir, all[0]), nil
+	case len(matching) == 1:
+		return filepath.Join(dir, matching[0]), nil
+	case len(all) == 0:
+		return "", fmt.Errorf("%s is empty", dir)
+	}
+	return "", fmt.Errorf("%s has more files %v, choose one by CertPath or KeyPath", dir, all)
+}
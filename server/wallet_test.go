@@ -0,0 +1,66 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPopulateWallet(t *testing.T) {
+	dir := t.TempDir()
+	msp := filepath.Join(dir, "msp")
+	files := map[string]string{
+		filepath.Join(msp, "signcerts", "User1@org2.example.com-cert.pem"): "cert",
+		filepath.Join(msp, "keystore", "priv_sk"):                          "key",
+		filepath.Join(msp, "keystore", "README"):                           "",
+	}
+	for f, content := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walletPath := filepath.Join(dir, "wallet")
+	wallet, err := newWallet(walletPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := FabricOrg{MspID: "Org2MSP", Identity: "user", CredPath: msp}
+	if err := populateWallet(wallet, org); err != nil {
+		t.Fatal(err)
+	}
+
+	// the wallet is kept for the next run
+	wallet, err = newWallet(walletPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := wallet.get("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.MspID != "Org2MSP" || id.Credentials.Certificate != "cert" || id.Credentials.Key != "key" {
+		t.Errorf("expected the identity of Org2MSP, but got %+v", id)
+	}
+	// as written by fabric-sdk-go
+	sdk := `{"version":1,"mspId":"Org1MSP","type":"X.509","credentials":{"certificate":"c","privateKey":"k"}}`
+	if err := os.WriteFile(filepath.Join(walletPath, "sdk.id"), []byte(sdk), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := wallet.get("sdk"); err != nil || id.MspID != "Org1MSP" || id.Credentials.Key != "k" {
+		t.Errorf("expected the identity of Org1MSP, but got %+v, %v", id, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(msp, "keystore", "other_sk"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := populateWallet(wallet, org); err == nil {
+		t.Errorf("expected an error for two keys")
+	}
+	org.KeyPath = filepath.Join(msp, "keystore", "other_sk")
+	if err := populateWallet(wallet, org); err != nil {
+		t.Errorf("expected the key given by KeyPath, but got %v", err)
+	}
+}
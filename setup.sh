@@ -5,6 +5,13 @@ export $(./setOrgEnv.sh "${1:-Org1}" | xargs )
 
 # peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.example.com --tls --cafile "${PWD}/organizations/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem" -C $CHANNEL_NAME -n $CONTRACT_NAME --peerAddresses localhost:7051 --tlsRootCertFiles "${PWD}/organizations/peerOrganizations/org1.example.com/peers/peer0.org1.example.com/tls/ca.crt" --peerAddresses localhost:9051 --tlsRootCertFiles "${PWD}/organizations/peerOrganizations/org2.example.com/peers/peer0.org2.example.com/tls/ca.crt" -c '{"function":"InitLedger","Args":[]}'
 
+# Publish a tariff, only the tariff authority Org2 may do it
+# export $(./setOrgEnv.sh Org2 | xargs )
+# peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.example.com --tls --cafile "${PWD}/organizations/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem" -C $CHANNEL_NAME -n $CONTRACT_NAME --peerAddresses localhost:7051 --tlsRootCertFiles "${PWD}/organizations/peerOrganizations/org1.example.com/peers/peer0.org1.example.com/tls/ca.crt" --peerAddresses localhost:9051 --tlsRootCertFiles "${PWD}/organizations/peerOrganizations/org2.example.com/peers/peer0.org2.example.com/tls/ca.crt" -c "{\"function\":\"PublishTariff\",\"Args\":[$(jq -c . tariff-2023.json | jq -R .)]}"
+# peer chaincode query -C $CHANNEL_NAME -n $CONTRACT_NAME -c '{"Args":["GetAllTariffs"]}'
+# Publish the geographic model of the server, also by the tariff authority Org2
+# peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.example.com --tls --cafile "${PWD}/organizations/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem" -C $CHANNEL_NAME -n $CONTRACT_NAME --peerAddresses localhost:7051 --tlsRootCertFiles "${PWD}/organizations/peerOrganizations/org1.example.com/peers/peer0.org1.example.com/tls/ca.crt" --peerAddresses localhost:9051 --tlsRootCertFiles "${PWD}/organizations/peerOrganizations/org2.example.com/peers/peer0.org2.example.com/tls/ca.crt" -c "{\"function\":\"PublishModel\",\"Args\":[$(curl -s localhost:8905/geomodel | jq -c .data | jq -R .)]}"
+
 # peer chaincode query -C $CHANNEL_NAME -n $CONTRACT_NAME -c '{"Args":["GetAllAssets"]}'
 # peer chaincode query -C $CHANNEL_NAME -n $CONTRACT_NAME -c '{"Args":["ReadAsset","asset6"]}'
 